@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,20 +22,40 @@ import (
 	collector "github.com/rancher/telemetry/collector"
 	publish "github.com/rancher/telemetry/publish"
 	record "github.com/rancher/telemetry/record"
+	replay "github.com/rancher/telemetry/replay"
+	schema "github.com/rancher/telemetry/schema"
 )
 
 const (
-	RECORD_VERSION = 2
-	EXISTING_FILE  = ".existing"
+	RECORD_VERSION = record.VERSION
+
+	SOURCE_V3         = "v3"
+	SOURCE_KUBERNETES = "kubernetes"
+
+	// interruptGrace is how long a report interrupted at shutdown gets to
+	// wind down.
+	interruptGrace = 5 * time.Second
 )
 
 var (
-	publisher  *publish.ToUrl
-	url        string
-	accessKey  string
-	secretKey  string
-	tokenKey   string
-	rancherCli *rancher.Client
+	caCerts  string
+	insecure bool
+
+	// collectCtx is cancelled when the client shuts down, which interrupts
+	// any collection still running.
+	collectCtx, cancelCollect = context.WithCancel(context.Background())
+	reports                   sync.WaitGroup
+	shuttingDown              bool
+	// reportMu runs one report at a time, so two reports can't share a
+	// collection and publish it twice under different ids.
+	reportMu sync.Mutex
+
+	// recorder captures the Rancher API responses of each collection into
+	// recordFile. replayURL is the stand-in serving a capture instead of
+	// Rancher.
+	recorder   *replay.Recorder
+	recordFile string
+	replayURL  string
 )
 
 func ClientCommand() cli.Command {
@@ -39,7 +63,7 @@ func ClientCommand() cli.Command {
 		Name:   "client",
 		Usage:  "report stats to a telemetry server",
 		Action: clientRun,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.BoolFlag{
 				Name:  "once",
 				Usage: "print stats to stdout once and exit",
@@ -53,35 +77,31 @@ func ClientCommand() cli.Command {
 			},
 
 			cli.StringFlag{
-				Name:        "url",
-				Usage:       "url to reach cattle",
-				Value:       "",
-				EnvVar:      "CATTLE_URL",
-				Destination: &url,
+				Name:   "url",
+				Usage:  "url to reach cattle",
+				Value:  "",
+				EnvVar: "CATTLE_URL",
 			},
 
 			cli.StringFlag{
-				Name:        "access-key",
-				Usage:       "access key for api",
-				Value:       "",
-				EnvVar:      "CATTLE_ACCESS_KEY",
-				Destination: &accessKey,
+				Name:   "access-key",
+				Usage:  "access key for api",
+				Value:  "",
+				EnvVar: "CATTLE_ACCESS_KEY",
 			},
 
 			cli.StringFlag{
-				Name:        "secret-key",
-				Usage:       "secret key for api",
-				Value:       "",
-				EnvVar:      "CATTLE_SECRET_KEY",
-				Destination: &secretKey,
+				Name:   "secret-key",
+				Usage:  "secret key for api",
+				Value:  "",
+				EnvVar: "CATTLE_SECRET_KEY",
 			},
 
 			cli.StringFlag{
-				Name:        "token-key",
-				Usage:       "token key for api",
-				Value:       "",
-				EnvVar:      "CATTLE_TOKEN_KEY",
-				Destination: &tokenKey,
+				Name:   "token-key",
+				Usage:  "token key for api",
+				Value:  "",
+				EnvVar: "CATTLE_TOKEN_KEY",
 			},
 
 			cli.StringFlag{
@@ -91,6 +111,45 @@ func ClientCommand() cli.Command {
 				EnvVar: "CATTLE_CERTIFICATE",
 			},
 
+			cli.BoolFlag{
+				Name:        "insecure",
+				Usage:       "skip verifying the api certificate",
+				EnvVar:      "CATTLE_INSECURE",
+				Destination: &insecure,
+			},
+
+			cli.StringFlag{
+				Name:   "source",
+				Usage:  "where to read Rancher objects from, v3 for the Rancher API or kubernetes for its custom resources",
+				Value:  SOURCE_V3,
+				EnvVar: "TELEMETRY_SOURCE",
+			},
+
+			cli.StringFlag{
+				Name:   "kubeconfig",
+				Usage:  "kubeconfig for the kubernetes source, the in-cluster config if not given",
+				EnvVar: "KUBECONFIG",
+			},
+
+			cli.StringFlag{
+				Name:   "record",
+				Usage:  "file to save a redacted capture of the Rancher API responses of each collection to",
+				EnvVar: "TELEMETRY_RECORD",
+			},
+
+			cli.StringFlag{
+				Name:   "replay",
+				Usage:  "capture saved by --record to collect from instead of Rancher",
+				EnvVar: "TELEMETRY_REPLAY",
+			},
+
+			cli.StringFlag{
+				Name:   "downstream",
+				Usage:  "how to read downstream cluster data, v3 for the per cluster and project APIs or steve for the v1 API",
+				Value:  collector.DownstreamV3,
+				EnvVar: "TELEMETRY_DOWNSTREAM",
+			},
+
 			cli.StringFlag{
 				Name:   "interval",
 				Usage:  "reporting interval",
@@ -100,10 +159,199 @@ func ClientCommand() cli.Command {
 
 			cli.StringFlag{
 				Name:   "to-url",
-				Usage:  "url to send stats to",
+				Usage:  "url to send stats to, empty to only use destinations",
 				Value:  "https://telemetry.rancher.io/publish",
 				EnvVar: "TELEMETRY_TO_URL",
 			},
+
+			cli.StringSliceFlag{
+				Name:   "destination",
+				Usage:  "additional [name=]url to send stats to (http, https or file), may be repeated",
+				EnvVar: "TELEMETRY_DESTINATIONS",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-connect-timeout",
+				Usage:  "maximum time to connect to a url destination",
+				Value:  "10s",
+				EnvVar: "TELEMETRY_PUBLISH_CONNECT_TIMEOUT",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-timeout",
+				Usage:  "maximum time a single report to a url destination may take",
+				Value:  "60s",
+				EnvVar: "TELEMETRY_PUBLISH_TIMEOUT",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-idle-timeout",
+				Usage:  "how long idle connections to url destinations are kept open",
+				Value:  "90s",
+				EnvVar: "TELEMETRY_PUBLISH_IDLE_TIMEOUT",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-proxy",
+				Usage:  "proxy url for url destinations, defaults to HTTPS_PROXY/HTTP_PROXY/NO_PROXY",
+				EnvVar: "TELEMETRY_PUBLISH_PROXY",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-ca-file",
+				Usage:  "additional CA certificates to trust for url destinations",
+				EnvVar: "TELEMETRY_PUBLISH_CA_FILE",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-cert-file",
+				Usage:  "client certificate to present to url destinations",
+				EnvVar: "TELEMETRY_PUBLISH_CERT_FILE",
+			},
+
+			cli.StringFlag{
+				Name:   "publish-key-file",
+				Usage:  "key of the client certificate",
+				EnvVar: "TELEMETRY_PUBLISH_KEY_FILE",
+			},
+
+			cli.Int64Flag{
+				Name:   "file-max-size",
+				Usage:  "size in bytes at which file destinations are rotated, 0 to only rotate daily",
+				Value:  10 * 1024 * 1024,
+				EnvVar: "TELEMETRY_FILE_MAX_SIZE",
+			},
+
+			cli.BoolFlag{
+				Name:   "file-compress",
+				Usage:  "gzip rotated files of file destinations",
+				EnvVar: "TELEMETRY_FILE_COMPRESS",
+			},
+
+			cli.IntFlag{
+				Name:   "file-retain",
+				Usage:  "number of rotated files to keep for file destinations, 0 for all of them",
+				Value:  30,
+				EnvVar: "TELEMETRY_FILE_RETAIN",
+			},
+
+			cli.IntFlag{
+				Name:        "collector-workers",
+				Usage:       "number of collectors to run at once, 0 for all of them",
+				Value:       4,
+				EnvVar:      "TELEMETRY_COLLECTOR_WORKERS",
+				Destination: &collectOpt.Workers,
+			},
+
+			cli.StringFlag{
+				Name:   "collector-timeout",
+				Usage:  "maximum time a single collector may take, 0 for no limit",
+				Value:  "5m",
+				EnvVar: "TELEMETRY_COLLECTOR_TIMEOUT",
+			},
+
+			cli.StringFlag{
+				Name:   "collect-timeout",
+				Usage:  "maximum time a whole collection may take, 0 for no limit",
+				Value:  "15m",
+				EnvVar: "TELEMETRY_COLLECT_TIMEOUT",
+			},
+
+			cli.StringFlag{
+				Name:   "state-dir",
+				Usage:  "directory to keep the reporting schedule in",
+				Value:  ".",
+				EnvVar: "TELEMETRY_STATE_DIR",
+			},
+
+			cli.StringFlag{
+				Name:   "spool-dir",
+				Usage:  "directory to keep undelivered reports in, empty to drop them",
+				Value:  ".spool",
+				EnvVar: "TELEMETRY_SPOOL_DIR",
+			},
+
+			cli.Int64Flag{
+				Name:   "spool-max-size",
+				Usage:  "maximum size of the spool in bytes, oldest reports are dropped first",
+				Value:  10 * 1024 * 1024,
+				EnvVar: "TELEMETRY_SPOOL_MAX_SIZE",
+			},
+
+			cli.StringFlag{
+				Name:   "spool-max-age",
+				Usage:  "maximum age of a spooled report",
+				Value:  "168h",
+				EnvVar: "TELEMETRY_SPOOL_MAX_AGE",
+			},
+
+			cli.StringFlag{
+				Name:   "retry-min",
+				Usage:  "initial delay before retrying an undelivered report",
+				Value:  "30s",
+				EnvVar: "TELEMETRY_RETRY_MIN",
+			},
+
+			cli.StringFlag{
+				Name:   "retry-max",
+				Usage:  "maximum delay between retries of an undelivered report",
+				Value:  "1h",
+				EnvVar: "TELEMETRY_RETRY_MAX",
+			},
+
+			shutdownTimeoutFlag(),
+		}, collectorFlags()...),
+		Subcommands: []cli.Command{
+			{
+				Name:   "collectors",
+				Usage:  "list the registered collectors and whether they are enabled",
+				Action: clientCollectors,
+				Flags:  collectorFlags(),
+			},
+		},
+	}
+}
+
+// collectorFlags are the flags choosing which collectors run, shared with
+// the collectors subcommand.
+func collectorFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "JSON file overriding interval, url, keys, to-url, destinations and collectors, re-read on reload",
+			EnvVar: "TELEMETRY_CONFIG",
+		},
+
+		cli.StringSliceFlag{
+			Name:   "include-collectors, collectors",
+			Usage:  "record keys of the collectors to run, all of them if not given",
+			EnvVar: "TELEMETRY_INCLUDE_COLLECTORS,TELEMETRY_COLLECTORS",
+		},
+
+		cli.StringSliceFlag{
+			Name:   "exclude-collectors",
+			Usage:  "record keys of the collectors not to run",
+			EnvVar: "TELEMETRY_EXCLUDE_COLLECTORS",
+		},
+
+		cli.StringFlag{
+			Name:   "plugin-dir",
+			Usage:  "directory of executables to run as additional collectors",
+			EnvVar: "TELEMETRY_PLUGIN_DIR",
+		},
+
+		cli.StringFlag{
+			Name:   "plugin-timeout",
+			Usage:  "how long a plugin may run",
+			Value:  "30s",
+			EnvVar: "TELEMETRY_PLUGIN_TIMEOUT",
+		},
+
+		cli.IntFlag{
+			Name:   "plugin-max-output",
+			Usage:  "largest output in bytes a plugin may print",
+			Value:  1 << 20,
+			EnvVar: "TELEMETRY_PLUGIN_MAX_OUTPUT",
 		},
 	}
 }
@@ -111,56 +359,213 @@ func ClientCommand() cli.Command {
 func clientRun(c *cli.Context) error {
 	log.Infof("Telemetry Client %s", c.App.Version)
 
-	if url == "" || (tokenKey == "" && (accessKey == "" || secretKey == "")) {
-		return cli.NewExitError("URL, Access Key and Secret Key OR Token Key are required", 1)
+	clientCtx = c
+
+	if c.String("record") != "" && c.String("replay") != "" {
+		return cli.NewExitError("Can't record and replay at the same time", 1)
+	}
+
+	if file := c.String("replay"); file != "" {
+		archive, err := replay.Load(file)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		standIn, err := replay.NewServer(archive)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer standIn.Close()
+		replayURL = standIn.URL()
+		log.Infof("Replaying Rancher API responses recorded %s from %s", archive.Recorded.Format(time.RFC3339), file)
+	}
+
+	err := registerPlugins(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
 	}
 
-	url = normalizeURL(url)
+	cfg, err := loadClientConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	collectOpt.Timeout, err = time.ParseDuration(c.String("collector-timeout"))
+	if err != nil {
+		return cli.NewExitError("Collector timeout must be a valid GoLang duration string", 1)
+	}
 
-	if tokenKey == "" {
-		tokenKey = accessKey + ":" + secretKey
+	collectOpt.RunTimeout, err = time.ParseDuration(c.String("collect-timeout"))
+	if err != nil {
+		return cli.NewExitError("Collect timeout must be a valid GoLang duration string", 1)
+	}
+
+	crtFile := c.String("crt-file")
+	if crtFile != "" {
+		data, err := os.ReadFile(crtFile)
+		if err != nil {
+			return cli.NewExitError("Error reading crt-file: "+err.Error(), 1)
+		}
+		caCerts = string(data)
+	}
+
+	if file := c.String("record"); file != "" {
+		recorder, err = replay.NewRecorder(caCerts, insecure)
+		if err != nil {
+			return cli.NewExitError("Error starting the recorder: "+err.Error(), 1)
+		}
+		defer recorder.Close()
+		recordFile = file
+		log.Infof("Recording Rancher API responses to %s", file)
+	}
+
+	if insecure && cfg.Url != "" {
+		log.Warn("Not verifying the certificate of ", cfg.Url)
+	}
+
+	collectOpt.Downstream = c.String("downstream")
+	if collectOpt.Downstream != collector.DownstreamV3 && collectOpt.Downstream != collector.DownstreamSteve {
+		return cli.NewExitError(fmt.Sprintf("Downstream must be %s or %s", collector.DownstreamV3, collector.DownstreamSteve), 1)
+	}
+
+	if c.String("source") == SOURCE_KUBERNETES {
+		collectOpt.Source, err = collector.NewKubeSource(c.String("kubeconfig"))
+		if err != nil {
+			return cli.NewExitError("Error setting up the kubernetes source: "+err.Error(), 1)
+		}
+		if cfg.Url == "" {
+			log.Info("No url configured, leaving out data from downstream clusters")
+		}
 	}
 
 	if c.Bool("once") {
+		config = cfg
+		collectOpt.Collectors = cfg.IncludeCollectors
+		collectOpt.ExcludeCollectors = cfg.ExcludeCollectors
 		return clientShowOnce()
 	}
 
-	publisher = publish.NewToUrl(c)
+	grace, err := parseShutdownTimeout(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	err = loadClientState(c.String("state-dir"))
+	if err != nil {
+		return cli.NewExitError("Error loading state: "+err.Error(), 1)
+	}
+
+	err = applyClientConfig(cfg)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	reloadOnHangup()
 
 	router := mux.NewRouter()
 	router.HandleFunc("/favicon.ico", http.NotFound)
 	router.HandleFunc("/v1-telemetry", clientShow).Methods("GET")
 	router.HandleFunc("/v1-telemetry/reload", clientReload).Methods("POST")
 	router.HandleFunc("/v1-telemetry/report", clientReport).Methods("POST")
+	router.HandleFunc("/v1-telemetry/spool", clientSpool).Methods("GET")
+	router.HandleFunc("/v1-telemetry/destinations", clientDestinations).Methods("GET")
+	router.HandleFunc("/v1-telemetry/status", clientStatus).Methods("GET")
 
-	interval := c.String("interval")
-	if interval != "" {
-		dur, err := time.ParseDuration(interval)
-		if err != nil {
-			return cli.NewExitError("Interval must be a valid GoLang duration string", 1)
-		}
+	listen := c.String("listen")
+	log.Info("Listening on ", listen)
+	server := &http.Server{
+		Addr:    listen,
+		Handler: router,
+	}
 
-		if dur.Nanoseconds() > 0 {
-			ticker := time.NewTicker(dur)
-			go func() {
-				for range ticker.C {
-					report()
-				}
-			}()
-		}
+	deadline, err := serveUntilSignal(server, grace)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
 	}
 
-	// Report immediately on only the first run
-	if !isExisting() {
-		go report()
+	shutdownClient(deadline)
+	return nil
+}
+
+// registerPlugins registers the executables in plugin-dir as collectors.
+func registerPlugins(c *cli.Context) error {
+	dir := c.String("plugin-dir")
+	if dir == "" {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(c.String("plugin-timeout"))
+	if err != nil {
+		return errors.New("Plugin timeout must be a valid GoLang duration string")
+	}
+	plugins, err := collector.LoadPlugins(dir, timeout, c.Int("plugin-max-output"))
+	if err != nil {
+		return errors.New("Error loading plugins: " + err.Error())
+	}
+	for _, p := range plugins {
+		collector.Register(p)
 	}
 
-	listen := c.String("listen")
-	log.Info("Listening on ", listen)
-	log.Fatal(http.ListenAndServe(listen, router))
 	return nil
 }
 
+// clientCollectors lists the registered collectors, plugins included, and
+// whether the flags, env and config file enable them.
+func clientCollectors(c *cli.Context) error {
+	err := registerPlugins(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	cfg, err := readClientConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	err = cfg.checkCollectors()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	opt := &collector.CollectorOpts{
+		Collectors:        cfg.IncludeCollectors,
+		ExcludeCollectors: cfg.ExcludeCollectors,
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tENABLED\tDESCRIPTION")
+	for _, info := range collector.Describe(opt) {
+		fmt.Fprintf(w, "%s\t%t\t%s\n", info.Key, info.Enabled, info.Description)
+	}
+	return w.Flush()
+}
+
+// shutdownClient stops scheduling reports and gives the one in flight, if
+// any, until deadline to finish. Records already handed to an outbox are in
+// its spool by then and go out after the next start.
+func shutdownClient(deadline time.Time) {
+	clientMu.Lock()
+	shuttingDown = true
+	if stopScheduler != nil {
+		close(stopScheduler)
+		stopScheduler = nil
+	}
+	clientMu.Unlock()
+
+	if !waitUntil(&reports, deadline) {
+		log.Warn("Interrupting the report still running at the end of the grace period")
+		cancelCollect()
+		waitUntil(&reports, time.Now().Add(interruptGrace))
+	}
+	cancelCollect()
+
+	clientMu.Lock()
+	for _, outbox := range outboxes {
+		close(outbox.stop)
+	}
+	outboxes = nil
+	clientMu.Unlock()
+
+	log.Info("Stopped")
+}
+
 // CLI Handlers
 func clientShowOnce() error {
 	r, err := collect()
@@ -168,6 +573,11 @@ func clientShowOnce() error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	err = schema.ValidateRecord(r)
+	if err != nil {
+		log.Warn(err)
+	}
+
 	str, err := json.MarshalIndent(r, "", "  ")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -179,17 +589,43 @@ func clientShowOnce() error {
 }
 
 // HTTP Handlers
+// clientShow serves the latest snapshot, or a fresh one with ?fresh=true.
 func clientShow(w http.ResponseWriter, req *http.Request) {
-	r, err := collect()
-	if err == nil {
-		respondSuccess(w, req, r)
+	var (
+		snap *snapshot
+		err  error
+	)
+	if req.URL.Query().Get("fresh") == "true" {
+		snap, err = collectShared()
 	} else {
+		snap, err = cachedSnapshot()
+	}
+	if err != nil {
 		respondError(w, req, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("ETag", snap.etag)
+	w.Header().Set("Last-Modified", snap.collected.UTC().Format(http.TimeFormat))
+	if req.Header.Get("If-None-Match") == snap.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	_, err = w.Write(snap.body)
+	if err != nil {
+		log.Errorf("Error while writing in clientShow: %v", err)
 	}
 }
 
 func clientReload(w http.ResponseWriter, req *http.Request) {
-	_, err := w.Write([]byte("ok"))
+	err := reloadClientConfig()
+	if err != nil {
+		respondError(w, req, err.Error(), 400)
+		return
+	}
+
+	_, err = w.Write([]byte("ok"))
 	if err != nil {
 		log.Errorf("Error while writing in clientReload: %v", err)
 	}
@@ -203,73 +639,234 @@ func clientReport(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func clientSpool(w http.ResponseWriter, req *http.Request) {
+	out := map[string]publish.OutboxStats{}
+	for _, outbox := range currentOutboxes() {
+		out[outbox.Destination().Name] = outbox.Stats()
+	}
+	respondSuccess(w, req, out)
+}
+
+type DestinationStatus struct {
+	publish.DestinationStats
+	Spool publish.OutboxStats `json:"spool"`
+}
+
+func clientDestinations(w http.ResponseWriter, req *http.Request) {
+	out := []DestinationStatus{}
+	for _, outbox := range currentOutboxes() {
+		out = append(out, DestinationStatus{
+			DestinationStats: outbox.Destination().Stats(),
+			Spool:            outbox.Stats(),
+		})
+	}
+	respondSuccess(w, req, out)
+}
+
+func clientStatus(w http.ResponseWriter, req *http.Request) {
+	clientMu.Lock()
+	interval := config.interval
+	clientMu.Unlock()
+
+	respondSuccess(w, req, currentStatus(interval))
+}
+
+func currentOutboxes() []*clientOutbox {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	return outboxes
+}
+
+// report collects a record, hands it to every destination and keeps track
+// of how that went in the state file. A record that got spooled for retry
+// counts as reported. Reports asked for while one runs wait for it, then
+// collect their own record.
 func report() {
+	clientMu.Lock()
+	if shuttingDown {
+		clientMu.Unlock()
+		return
+	}
+	reports.Add(1)
+	clientMu.Unlock()
+	defer reports.Done()
+
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	clientMu.Lock()
+	stopping := shuttingDown
+	clientMu.Unlock()
+	if stopping {
+		return
+	}
+
+	start := time.Now()
+	err := publishReport()
+	recordAttempt(start, err)
+}
+
+func publishReport() error {
 	start := time.Now()
 	log.Debug("Starting report")
 
-	r, err := collect()
+	snap, err := collectShared()
 	if err != nil {
 		log.Errorf("Error collecting data: %s", err)
-		return
+		return err
 	}
 	diff := time.Since(start).String()
 	log.Debugf("Collected stats in %s", diff)
 
-	err = publisher.Report(r, "")
+	r, err := stampRecord(snap.record)
 	if err != nil {
-		log.Errorf("Error publishing report: %s", err)
-		return
+		log.Errorf("Error numbering report: %s", err)
+		return err
+	}
+
+	err = schema.ValidateRecord(r)
+	if err != nil {
+		log.Errorf("Not publishing report: %s", err)
+		return err
+	}
+
+	err = publishRecord(r)
+	if err != nil {
+		return err
 	}
 
 	diff = time.Since(start).String()
 	log.Debugf("Completed report in %s", diff)
+	return nil
+}
+
+// publishRecord hands r to every destination. A destination that spooled
+// it for retry has it, so that isn't an error.
+func publishRecord(r record.Record) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for _, outbox := range currentOutboxes() {
+		wg.Add(1)
+		go func(outbox *clientOutbox) {
+			defer wg.Done()
+			err := outbox.Report(r, "")
+			switch {
+			case errors.Is(err, publish.ErrSpooled):
+				log.Warnf("Report to %s is spooled for retry: %s", outbox.Destination().Name, err)
+			case err != nil:
+				log.Errorf("Error publishing report to %s: %s", outbox.Destination().Name, err)
+				mu.Lock()
+				failed = append(failed, outbox.Destination().Name)
+				mu.Unlock()
+			}
+		}(outbox)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Error publishing report to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// stampRecord returns a copy of r with the id and sequence number it is
+// published under. Retries send the copy as it is, so the server can tell
+// them apart from new records.
+func stampRecord(r record.Record) (record.Record, error) {
+	id, seq, err := nextRecordId(recordUid(r))
+	if err != nil {
+		return nil, err
+	}
+
+	out := record.Record{}
+	for key, value := range r {
+		out[key] = value
+	}
+	out[schema.RecordIdKey] = id
+	out[schema.RecordSeqKey] = seq
+	return out, nil
+}
+
+// recordUid returns the install uid of a record collect made.
+func recordUid(r record.Record) string {
+	switch install := r[schema.InstallRecordKey].(type) {
+	case collector.Installation:
+		return install.Uid
+	case map[string]interface{}:
+		uid, _ := install["uid"].(string)
+		return uid
+	}
+	return ""
 }
 
 func collect() (record.Record, error) {
-	log.Infof("Collecting anonymous data from %s", url)
-	if rancherCli == nil {
+	clientMu.Lock()
+	if collectOpt.Source != nil {
+		log.Info("Collecting anonymous data from the Kubernetes API")
+	} else {
+		log.Infof("Collecting anonymous data from %s", config.Url)
+	}
+	if rancherCli == nil && config.Url != "" {
+		url := config.Url
+		if recorder != nil {
+			err := recorder.SetUpstream(strings.TrimSuffix(config.Url, "/v3"))
+			if err != nil {
+				clientMu.Unlock()
+				return nil, err
+			}
+			url = recorder.URL() + "/v3"
+		}
+
 		cli, err := rancher.NewClient(&clientbase.ClientOpts{
 			URL:      url,
-			TokenKey: tokenKey,
-			Insecure: true,
+			TokenKey: config.TokenKey,
+			CACerts:  caCerts,
+			Insecure: insecure,
 		})
 		if err != nil {
+			clientMu.Unlock()
 			return nil, err
 		}
 		rancherCli = cli
 	}
 
+	opt := collectOpt
+	opt.Client = rancherCli
+	clientMu.Unlock()
+
 	r := record.Record{}
 	r["r"] = RECORD_VERSION
 	r["ts"] = time.Now().UTC().Format(time.RFC3339)
 
-	opt := collector.CollectorOpts{
-		Client: rancherCli,
+	if recorder != nil {
+		recorder.Reset()
 	}
 
-	collector.Run(&r, &opt)
-
-	return r, nil
-}
-
-func isExisting() bool {
-	want := strconv.Itoa(RECORD_VERSION)
-	have := ""
+	collector.Run(collectCtx, &r, &opt)
+	if collectCtx.Err() != nil {
+		return nil, errors.New("Collection interrupted by shutdown")
+	}
 
-	data, err := os.ReadFile(EXISTING_FILE)
-	if err == nil {
-		have = string(data)
+	// The server tells installations apart by install.uid, so it is sent
+	// even with the Installation collector disabled.
+	if _, ok := r["install"]; !ok {
+		uid, _ := collector.GetTelemetryUid(&opt)
+		r["install"] = map[string]interface{}{"uid": uid}
 	}
 
-	if want == have {
-		return true
-	} else {
-		err := os.WriteFile(EXISTING_FILE, []byte(want), 0644)
+	if recorder != nil {
+		err := recorder.Archive().Save(recordFile)
 		if err != nil {
-			log.Errorf("Error while writing file [%s]: %v", EXISTING_FILE, err)
+			log.Errorf("Failed to save the capture to %s: %s", recordFile, err)
 		}
-		return false
 	}
+
+	return r, nil
 }
 
 func normalizeURL(url string) string {
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+// newContext returns a context with the given string flags set.
+func newContext(flags ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for i := 0; i+1 < len(flags); i += 2 {
+		set.String(flags[i], flags[i+1], "")
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// useOutbox makes an outbox spooling to a temporary directory the only one
+// reports go to, for the length of the test.
+func useOutbox(t *testing.T, url string) *clientOutbox {
+	c := newContext("retry-min", "1h", "retry-max", "2h", "spool-dir", t.TempDir(), "spool-max-age", "24h")
+
+	dest, err := publish.NewDestination(c, "test="+url)
+	assert.Nil(t, err)
+	created, err := publish.NewOutbox(c, dest)
+	assert.Nil(t, err)
+
+	outbox := &clientOutbox{Outbox: created, spec: url}
+	clientMu.Lock()
+	outboxes = []*clientOutbox{outbox}
+	clientMu.Unlock()
+
+	stateMu.Lock()
+	state = clientState{}
+	stateMu.Unlock()
+
+	t.Cleanup(func() {
+		clientMu.Lock()
+		outboxes = nil
+		clientMu.Unlock()
+
+		stateMu.Lock()
+		state = clientState{}
+		stateMu.Unlock()
+	})
+	return outbox
+}
+
+func TestPublishSpooledCountsAsReported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	outbox := useOutbox(t, server.URL)
+
+	start := time.Now()
+	err := publishRecord(record.Record{"n": 1})
+	assert.Nil(t, err)
+	recordAttempt(start, err)
+
+	assert.Equal(t, 1, outbox.Stats().Pending)
+	status := currentStatus(time.Hour)
+	assert.NotNil(t, status.LastSuccess)
+	assert.Equal(t, start, *status.LastSuccess)
+	assert.Equal(t, "", status.LastError)
+}
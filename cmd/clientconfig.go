@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	collector "github.com/rancher/telemetry/collector"
+	publish "github.com/rancher/telemetry/publish"
+)
+
+// clientConfig is the part of the client configuration that can be changed
+// without a restart. It comes from flags and env, overlaid with the JSON
+// config file if there is one. The keys of the file match the flag names.
+type clientConfig struct {
+	Interval     string   `json:"interval"`
+	Url          string   `json:"url"`
+	AccessKey    string   `json:"access-key"`
+	SecretKey    string   `json:"secret-key"`
+	TokenKey     string   `json:"token-key"`
+	ToUrl        string   `json:"to-url"`
+	Destinations []string `json:"destinations"`
+
+	IncludeCollectors []string `json:"include-collectors"`
+	ExcludeCollectors []string `json:"exclude-collectors"`
+	// Collectors is the older name of include-collectors.
+	Collectors []string `json:"collectors"`
+
+	interval time.Duration
+}
+
+// clientOutbox is an Outbox along with what it was created from and how to
+// stop it.
+type clientOutbox struct {
+	*publish.Outbox
+	spec string
+	stop chan struct{}
+}
+
+// retire stops the outbox and closes it once a delivery in progress is
+// done, so a file it writes to isn't left open.
+func (o *clientOutbox) retire() {
+	close(o.stop)
+	go func() {
+		err := o.Close()
+		if err != nil {
+			log.Errorf("Error closing %s: %s", o.Destination().Name, err)
+		}
+	}()
+}
+
+var (
+	clientCtx *cli.Context
+
+	// clientMu guards the live configuration and everything built from it.
+	clientMu      sync.Mutex
+	config        *clientConfig
+	outboxes      []*clientOutbox
+	rancherCli    *rancher.Client
+	collectOpt    collector.CollectorOpts
+	stopScheduler chan struct{}
+)
+
+// readClientConfig reads the configuration from flags, env and the config
+// file without checking it.
+func readClientConfig(c *cli.Context) (*clientConfig, error) {
+	cfg := &clientConfig{
+		Interval:     c.String("interval"),
+		Url:          c.String("url"),
+		AccessKey:    c.String("access-key"),
+		SecretKey:    c.String("secret-key"),
+		TokenKey:     c.String("token-key"),
+		ToUrl:        c.String("to-url"),
+		Destinations: c.StringSlice("destination"),
+
+		IncludeCollectors: c.StringSlice("include-collectors"),
+		ExcludeCollectors: c.StringSlice("exclude-collectors"),
+	}
+
+	if file := c.String("config"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", file, err)
+		}
+	}
+
+	if cfg.Collectors != nil {
+		cfg.IncludeCollectors = cfg.Collectors
+		cfg.Collectors = nil
+	}
+
+	return cfg, nil
+}
+
+func loadClientConfig(c *cli.Context) (*clientConfig, error) {
+	cfg, err := readClientConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if replayURL != "" {
+		cfg.Url = replayURL
+		cfg.TokenKey = "replay"
+	}
+
+	source := c.String("source")
+	if source != SOURCE_V3 && source != SOURCE_KUBERNETES {
+		return nil, fmt.Errorf("Source must be %s or %s", SOURCE_V3, SOURCE_KUBERNETES)
+	}
+
+	// The kubernetes source only needs the Rancher API for downstream data.
+	if (cfg.Url == "" && source == SOURCE_V3) || (cfg.Url != "" && cfg.TokenKey == "" && (cfg.AccessKey == "" || cfg.SecretKey == "")) {
+		return nil, errors.New("URL, Access Key and Secret Key OR Token Key are required")
+	}
+
+	cfg.Url = normalizeURL(cfg.Url)
+
+	if cfg.TokenKey == "" && cfg.Url != "" {
+		cfg.TokenKey = cfg.AccessKey + ":" + cfg.SecretKey
+	}
+
+	if cfg.Interval != "" {
+		cfg.interval, err = time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, errors.New("Interval must be a valid GoLang duration string")
+		}
+	}
+
+	err = cfg.checkCollectors()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// checkCollectors makes sure the included and excluded collectors are
+// registered, so a typo doesn't silently change what is collected.
+func (cfg *clientConfig) checkCollectors() error {
+	known := map[string]bool{}
+	for _, key := range collector.RecordKeys() {
+		known[key] = true
+	}
+	for _, key := range append(append([]string{}, cfg.IncludeCollectors...), cfg.ExcludeCollectors...) {
+		if !known[key] {
+			return fmt.Errorf("Unknown collector %q", key)
+		}
+	}
+
+	return nil
+}
+
+// specs returns the destinations to publish to, to-url first.
+func (cfg *clientConfig) specs() []string {
+	out := []string{}
+	if cfg.ToUrl != "" {
+		out = append(out, cfg.ToUrl)
+	}
+	return append(out, cfg.Destinations...)
+}
+
+// applyClientConfig makes cfg the live configuration. Outboxes of unchanged
+// destinations are kept, so their spools and retry state carry over. Nothing
+// changes if cfg cannot be applied.
+func applyClientConfig(cfg *clientConfig) error {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if shuttingDown {
+		return errors.New("Shutting down")
+	}
+
+	current := map[string]*clientOutbox{}
+	for _, outbox := range outboxes {
+		current[outbox.spec] = outbox
+	}
+
+	next := []*clientOutbox{}
+	names := map[string]bool{}
+	for _, spec := range cfg.specs() {
+		outbox := current[spec]
+		if outbox == nil {
+			dest, err := publish.NewDestination(clientCtx, spec)
+			if err != nil {
+				return fmt.Errorf("Invalid destination %q: %s", spec, err)
+			}
+
+			created, err := publish.NewOutbox(clientCtx, dest)
+			if err != nil {
+				return fmt.Errorf("Invalid spool configuration for %s: %s", dest.Name, err)
+			}
+
+			outbox = &clientOutbox{
+				Outbox: created,
+				spec:   spec,
+			}
+		}
+
+		name := outbox.Destination().Name
+		if names[name] {
+			return fmt.Errorf("Duplicate destination name %q, use name=url to tell them apart", name)
+		}
+		names[name] = true
+
+		next = append(next, outbox)
+	}
+
+	if len(next) == 0 {
+		log.Warn("No to-url or destination configured, not publishing")
+	}
+
+	kept := map[*clientOutbox]bool{}
+	for _, outbox := range next {
+		kept[outbox] = true
+		if outbox.stop == nil {
+			log.Infof("Publishing to %s", outbox.Destination().Name)
+			outbox.stop = make(chan struct{})
+			go outbox.Run(outbox.stop)
+		}
+	}
+	for _, outbox := range outboxes {
+		if !kept[outbox] {
+			log.Infof("No longer publishing to %s", outbox.Destination().Name)
+			outbox.retire()
+		}
+	}
+	outboxes = next
+
+	if config == nil || config.Url != cfg.Url || config.TokenKey != cfg.TokenKey {
+		rancherCli = nil
+		collector.ResetClients()
+		resetSnapshot()
+	}
+
+	collectOpt.Collectors = cfg.IncludeCollectors
+	collectOpt.ExcludeCollectors = cfg.ExcludeCollectors
+
+	if config == nil || config.interval != cfg.interval {
+		startScheduler(cfg.interval)
+	}
+
+	if config != nil && (!reflect.DeepEqual(config.IncludeCollectors, cfg.IncludeCollectors) || !reflect.DeepEqual(config.ExcludeCollectors, cfg.ExcludeCollectors)) {
+		log.Infof("Included collectors: %v, excluded collectors: %v", cfg.IncludeCollectors, cfg.ExcludeCollectors)
+		resetSnapshot()
+	}
+
+	config = cfg
+	return nil
+}
+
+func reloadClientConfig() error {
+	cfg, err := loadClientConfig(clientCtx)
+	if err != nil {
+		return err
+	}
+
+	err = applyClientConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Reloaded configuration")
+	return nil
+}
+
+// reloadOnHangup reloads the configuration whenever the process gets SIGHUP.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			err := reloadClientConfig()
+			if err != nil {
+				log.Errorf("Error reloading configuration, keeping the current one: %s", err)
+			}
+		}
+	}()
+}
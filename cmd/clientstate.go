@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	STATE_FILE = "state.json"
+
+	// failedReportRetry is the longest the scheduler waits to try again
+	// after a report failed.
+	failedReportRetry = 10 * time.Minute
+)
+
+// clientState is what the client remembers about reporting across restarts.
+type clientState struct {
+	RecordVersion int        `json:"recordVersion"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastAttempt   *time.Time `json:"lastAttempt,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+
+	// Seq numbers the records published for installation Uid, and
+	// LastRecordId is the id of the latest one.
+	Uid          string `json:"uid,omitempty"`
+	Seq          int64  `json:"seq,omitempty"`
+	LastRecordId string `json:"lastRecordId,omitempty"`
+}
+
+type ClientStatus struct {
+	clientState
+	Interval string     `json:"interval"`
+	NextRun  *time.Time `json:"nextRun,omitempty"`
+}
+
+var (
+	stateMu   sync.Mutex
+	stateFile string
+	state     clientState
+	nextRun   time.Time
+)
+
+func loadClientState(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	stateFile = filepath.Join(dir, STATE_FILE)
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Warnf("Ignoring unreadable state file %s: %s", stateFile, err)
+		state = clientState{}
+	}
+
+	return nil
+}
+
+// saveClientState writes the state file. The caller must hold stateMu.
+func saveClientState() {
+	if stateFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Errorf("Error encoding state: %s", err)
+		return
+	}
+
+	tmp := stateFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, stateFile)
+	}
+	if err != nil {
+		log.Errorf("Error writing state file %s: %s", stateFile, err)
+	}
+}
+
+func recordAttempt(at time.Time, err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	state.LastAttempt = &at
+	if err == nil {
+		state.LastSuccess = &at
+		state.LastError = ""
+		state.RecordVersion = RECORD_VERSION
+	} else {
+		state.LastError = err.Error()
+	}
+
+	saveClientState()
+}
+
+// nextRecordId hands out the id and sequence number of the next record
+// published for installation uid. The sequence starts over when the uid
+// changes.
+func nextRecordId(uid string) (string, int64, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", 0, err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if state.Uid != uid {
+		state.Uid = uid
+		state.Seq = 0
+	}
+	state.Seq++
+	state.LastRecordId = id.String()
+
+	saveClientState()
+	return state.LastRecordId, state.Seq, nil
+}
+
+// scheduleNext works out from the state when to report next. Reports are
+// due right away when none succeeded within interval or the record version
+// changed since, and are retried sooner than interval after a failure.
+func scheduleNext(interval time.Duration, now time.Time) time.Time {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var next time.Time
+	switch {
+	case state.LastSuccess == nil || state.RecordVersion != RECORD_VERSION:
+		next = now
+	case state.LastAttempt != nil && state.LastAttempt.After(*state.LastSuccess):
+		retry := failedReportRetry
+		if interval < retry {
+			retry = interval
+		}
+		next = state.LastAttempt.Add(retry + jitter(retry))
+	default:
+		next = state.LastSuccess.Add(interval + jitter(interval))
+	}
+
+	if next.Before(now) {
+		next = now
+	}
+
+	nextRun = next
+	return next
+}
+
+// neverReported is true until a report of the current record version went
+// through.
+func neverReported() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	return state.LastSuccess == nil || state.RecordVersion != RECORD_VERSION
+}
+
+// jitter returns a random delay of up to a tenth of d, so clients started
+// together don't all report at the same moment.
+func jitter(d time.Duration) time.Duration {
+	if d < 10 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d / 10)))
+}
+
+func currentStatus(interval time.Duration) ClientStatus {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	out := ClientStatus{
+		clientState: state,
+		Interval:    interval.String(),
+	}
+
+	if interval > 0 && !nextRun.IsZero() {
+		next := nextRun
+		out.NextRun = &next
+	}
+
+	return out
+}
+
+// startScheduler replaces the reporting schedule with one for interval. The
+// caller must hold clientMu.
+func startScheduler(interval time.Duration) {
+	if stopScheduler != nil {
+		close(stopScheduler)
+		stopScheduler = nil
+	}
+
+	if interval <= 0 {
+		log.Info("Not reporting periodically")
+		if neverReported() {
+			go report()
+		}
+		return
+	}
+
+	stop := make(chan struct{})
+	stopScheduler = stop
+
+	log.Infof("Reporting every %s", interval)
+	go func() {
+		for {
+			next := scheduleNext(interval, time.Now())
+			log.Debugf("Next report at %s", next.Format(time.RFC3339))
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			report()
+		}
+	}()
+}
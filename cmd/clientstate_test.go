@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/record"
+)
+
+func TestScheduleAfterSpooledReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	useOutbox(t, server.URL)
+
+	start := time.Now()
+	recordAttempt(start, publishRecord(record.Record{"n": 1}))
+
+	// The spool retries the record, so the next report waits the interval
+	// rather than collecting another one after failedReportRetry.
+	interval := 3 * failedReportRetry
+	next := scheduleNext(interval, start)
+	assert.False(t, next.Before(start.Add(interval)))
+	assert.True(t, next.Before(start.Add(interval+interval/10)))
+}
+
+func TestScheduleAfterFailedReport(t *testing.T) {
+	useOutbox(t, "http://127.0.0.1:0")
+
+	start := time.Now()
+	recordAttempt(start.Add(-time.Hour), nil)
+	recordAttempt(start, assert.AnError)
+
+	interval := 3 * failedReportRetry
+	next := scheduleNext(interval, start)
+	assert.False(t, next.Before(start.Add(failedReportRetry)))
+	assert.True(t, next.Before(start.Add(interval)))
+}
@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+	record "github.com/rancher/telemetry/record"
+	schema "github.com/rancher/telemetry/schema"
+)
+
+const (
+	DEF_MAX_RECORD_SIZE   = 1024 * 1024
+	DEF_QUARANTINE_LIST   = 100
+	DEF_INGEST_QUEUE_SIZE = 1000
+	DEF_INGEST_BATCH_SIZE = 100
+	MAX_INGEST_BATCH_SIZE = 1000
+
+	// INGEST_RETRY_AFTER is how many seconds clients are told to wait when
+	// the ingest queue is full.
+	INGEST_RETRY_AFTER = 10
+)
+
+var (
+	maxRecordSize int64
+	ingestQueue   *publish.IngestQueue
+
+	validUid = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// ingestError is why a payload can't be stored as a record, and the status
+// to answer with.
+type ingestError struct {
+	status int
+	reason string
+}
+
+func (e *ingestError) Error() string {
+	return e.reason
+}
+
+// parseRecord checks that payload is a record the server can store: a JSON
+// object of a known version, with a valid install uid, that matches the
+// schema once upgraded. It returns the record as it arrived, upgraded, and
+// the version it arrived as.
+func parseRecord(payload []byte) (record.Record, record.Record, int, *ingestError) {
+	var r record.Record
+	err := json.Unmarshal(payload, &r)
+	if err != nil || r == nil {
+		return nil, nil, 0, &ingestError{400, "Error parsing Record: not a JSON object"}
+	}
+
+	install, ok := r[schema.InstallRecordKey].(map[string]interface{})
+	if !ok {
+		return nil, nil, 0, &ingestError{422, "Record has no install section"}
+	}
+	uid, ok := install["uid"].(string)
+	if !ok || !validUid.MatchString(uid) {
+		return nil, nil, 0, &ingestError{422, "Record has no valid install uid"}
+	}
+
+	upgraded, from, err := record.Upgrade(r)
+	if err != nil {
+		return nil, nil, 0, &ingestError{422, err.Error()}
+	}
+
+	err = schema.ValidateRecord(upgraded)
+	if err != nil {
+		return nil, nil, 0, &ingestError{422, err.Error()}
+	}
+
+	return r, upgraded, from, nil
+}
+
+// quarantine keeps a refused payload for the admin endpoints. Failing to
+// do so doesn't change the answer to the client.
+func quarantine(payload []byte, reason string, ip string) {
+	_, err := dbPublisher.Quarantine(payload, reason, ip)
+	if err != nil {
+		log.Errorf("Error quarantining payload: %s", err)
+	}
+}
+
+func serverPublish(w http.ResponseWriter, req *http.Request) {
+	// Without a DB there is no queue, nor anywhere to quarantine.
+	if dbPublisher.Conn == nil || ingestQueue == nil {
+		respondError(w, req, "Records can't be stored, no database is configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	realIp := requestIp(req)
+	ip := anonymizeIp(realIp)
+	if !checkSource(w, req, realIp, ip) {
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRecordSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reason := fmt.Sprintf("Record larger than %d bytes", maxRecordSize)
+			quarantine(payload, reason, ip)
+			respondError(w, req, reason, http.StatusRequestEntityTooLarge)
+			return
+		}
+		respondError(w, req, "Error reading Record", 400)
+		return
+	}
+
+	r, upgraded, from, ingestErr := parseRecord(payload)
+	if ingestErr != nil {
+		log.Debugf("Rejecting record from %s: %s", realIp, ingestErr)
+		quarantine(payload, ingestErr.reason, ip)
+		respondError(w, req, ingestErr.reason, ingestErr.status)
+		return
+	}
+
+	if !checkInstall(w, req, recordUid(upgraded), ip) {
+		return
+	}
+
+	log.Debugf("Publish from %s: %s", realIp, r)
+
+	err = ingestQueue.Enqueue(&publish.IngestItem{
+		Record:   r,
+		Upgraded: upgraded,
+		From:     from,
+		ClientIp: ip,
+	})
+	if err == publish.ErrQueueFull || err == publish.ErrQueueClosed {
+		w.Header().Set("Retry-After", strconv.Itoa(INGEST_RETRY_AFTER))
+		respondError(w, req, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error queueing record: %s", err)
+		respondError(w, req, "Error storing Record", 500)
+		return
+	}
+
+	// Records are written to the DB in batches; queued is as good as stored.
+	// A record sent again gets the same answer, and is skipped when written.
+	out := map[string]string{"ok": "1"}
+	if rid, ok := r[schema.RecordIdKey].(string); ok {
+		out["rid"] = rid
+	}
+	w.WriteHeader(http.StatusAccepted)
+	respondSuccess(w, req, out)
+}
+
+// newIngestQueue starts the queue records go through on their way to the DB,
+// which must be connected.
+func newIngestQueue(c *cli.Context) (*publish.IngestQueue, error) {
+	if dbPublisher.Conn == nil {
+		return nil, errors.New("Postgres is required to queue records")
+	}
+
+	batchSize := c.Int("ingest-batch-size")
+	if batchSize > MAX_INGEST_BATCH_SIZE {
+		return nil, fmt.Errorf("Ingest batch size must be <= %d", MAX_INGEST_BATCH_SIZE)
+	}
+
+	interval, err := time.ParseDuration(c.String("ingest-flush-interval"))
+	if err != nil {
+		return nil, errors.New("Ingest flush interval must be a valid GoLang duration string")
+	}
+
+	return publish.NewIngestQueue(dbPublisher, c.Int("ingest-queue-size"), batchSize, interval, c.String("ingest-journal-dir"))
+}
+
+// ------------
+// Quarantine
+// ------------
+func apiQuarantine(w http.ResponseWriter, req *http.Request) {
+	limit := DEF_QUARANTINE_LIST
+	if str := req.URL.Query().Get("limit"); str != "" {
+		num, err := strconv.Atoi(str)
+		if err != nil || num < 1 {
+			respondError(w, req, "Limit must be > 0", 422)
+			return
+		}
+		limit = num
+	}
+
+	out, err := dbPublisher.GetQuarantined(limit)
+	respond(w, req, out, err)
+}
+
+func apiQuarantinedById(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(req)["id"])
+
+	out, err := dbPublisher.GetQuarantinedById(id)
+	respondQuarantine(w, req, out, err)
+}
+
+func apiDeleteQuarantined(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(req)["id"])
+
+	err := dbPublisher.DeleteQuarantined(id)
+	respondQuarantine(w, req, map[string]string{"ok": "1"}, err)
+}
+
+// apiReplayQuarantined runs a quarantined payload through ingest again, for
+// when the reason it was refused is fixed. It is stored as a record and
+// leaves the quarantine if it passes now.
+func apiReplayQuarantined(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(req)["id"])
+
+	q, err := dbPublisher.GetQuarantinedById(id)
+	if err != nil {
+		respondQuarantine(w, req, nil, err)
+		return
+	}
+
+	r, upgraded, from, ingestErr := parseRecord([]byte(q.Payload))
+	if ingestErr != nil {
+		err = dbPublisher.UpdateQuarantineReason(id, ingestErr.reason)
+		if err != nil {
+			log.Errorf("Error updating quarantined payload %d: %s", id, err)
+		}
+		respondError(w, req, ingestErr.reason, 422)
+		return
+	}
+
+	err = dbPublisher.Ingest(r, upgraded, from, q.ClientIp)
+	if err != nil {
+		respondError(w, req, "Error storing Record: "+err.Error(), 500)
+		return
+	}
+
+	err = dbPublisher.DeleteQuarantined(id)
+	respondQuarantine(w, req, map[string]string{"ok": "1"}, err)
+}
+
+func respondQuarantine(w http.ResponseWriter, req *http.Request, val interface{}, err error) {
+	if errors.Is(err, publish.ErrNotQuarantined) {
+		respondError(w, req, err.Error(), 404)
+		return
+	}
+	respond(w, req, val, err)
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+// DENYLIST_REFRESH is how often the denylist is read again, for changes
+// made through other servers sharing the DB.
+const DENYLIST_REFRESH = time.Minute
+
+var (
+	ipLimiter  *publish.RateLimiter
+	uidLimiter *publish.RateLimiter
+	installCap *publish.InstallCap
+	denylist   = publish.NewDenylist()
+)
+
+func limitFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.Float64Flag{
+			Name:   "ip-rate-limit",
+			Usage:  "records a minute one anonymized source IP may publish, 0 for no limit",
+			Value:  60,
+			EnvVar: "TELEMETRY_IP_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "ip-rate-burst",
+			Usage:  "records one anonymized source IP may publish at once",
+			Value:  300,
+			EnvVar: "TELEMETRY_IP_RATE_BURST",
+		},
+		cli.Float64Flag{
+			Name:   "uid-rate-limit",
+			Usage:  "records a minute one installation may publish, 0 for no limit",
+			Value:  1,
+			EnvVar: "TELEMETRY_UID_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "uid-rate-burst",
+			Usage:  "records one installation may publish at once",
+			Value:  5,
+			EnvVar: "TELEMETRY_UID_RATE_BURST",
+		},
+		cli.IntFlag{
+			Name:   "max-new-installs",
+			Usage:  "new installations one anonymized source IP may create a day, 0 for no limit",
+			Value:  50,
+			EnvVar: "TELEMETRY_MAX_NEW_INSTALLS",
+		},
+	}
+}
+
+func setupLimits(c *cli.Context) {
+	ipLimiter = publish.NewRateLimiter(c.Float64("ip-rate-limit"), c.Int("ip-rate-burst"))
+	uidLimiter = publish.NewRateLimiter(c.Float64("uid-rate-limit"), c.Int("uid-rate-burst"))
+	installCap = publish.NewInstallCap(c.Int("max-new-installs"), dbPublisher.HasInstallation)
+}
+
+// watchDenylist reads the denylist from the DB until stop is closed.
+func watchDenylist(stop <-chan struct{}) {
+	if dbPublisher.Conn == nil {
+		return
+	}
+
+	ticker := time.NewTicker(DENYLIST_REFRESH)
+	defer ticker.Stop()
+
+	for {
+		refreshDenylist()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func refreshDenylist() {
+	entries, err := dbPublisher.GetDenylist()
+	if err != nil {
+		log.Errorf("Error reading the denylist: %s", err)
+		return
+	}
+	denylist.Set(entries)
+}
+
+// checkSource turns away publishes from denied or too busy sources, before
+// their payload is read. realIp is the client address and ip its
+// anonymized form. It tells whether the publish may go on.
+func checkSource(w http.ResponseWriter, req *http.Request, realIp, ip string) bool {
+	if denylist.DeniesIp(realIp) {
+		reject(w, req, publish.RejectedDeniedIp, "Source is denied", http.StatusForbidden, 0)
+		return false
+	}
+
+	ok, wait := ipLimiter.Allow(ip, time.Now())
+	if !ok {
+		reject(w, req, publish.RejectedRateIp, "Too many records from this source", http.StatusTooManyRequests, wait)
+		return false
+	}
+
+	return true
+}
+
+// checkInstall turns away records of denied or too busy installations, and
+// of new ones past the cap of their source. It tells whether the publish
+// may go on.
+func checkInstall(w http.ResponseWriter, req *http.Request, uid, ip string) bool {
+	if denylist.DeniesUid(uid) {
+		reject(w, req, publish.RejectedDeniedUid, "Installation is denied", http.StatusForbidden, 0)
+		return false
+	}
+
+	now := time.Now()
+	ok, wait := uidLimiter.Allow(uid, now)
+	if !ok {
+		reject(w, req, publish.RejectedRateUid, "Too many records from this installation", http.StatusTooManyRequests, wait)
+		return false
+	}
+
+	// A DB hiccup shouldn't turn installations away, so they're let through.
+	ok, err := installCap.Allow(ip, uid, now)
+	if err != nil {
+		log.Errorf("Error checking new installations of %s: %s", ip, err)
+		return true
+	}
+	if !ok {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		reject(w, req, publish.RejectedInstallCap, "Too many new installations from this source today", http.StatusTooManyRequests, tomorrow.Sub(now))
+		return false
+	}
+
+	return true
+}
+
+func reject(w http.ResponseWriter, req *http.Request, rejection publish.Rejection, msg string, status int, wait time.Duration) {
+	rejection.Count()
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	respondError(w, req, msg, status)
+}
+
+// ------------
+// Denylist
+// ------------
+func apiDenylist(w http.ResponseWriter, req *http.Request) {
+	out, err := dbPublisher.GetDenylist()
+	respond(w, req, out, err)
+}
+
+func apiAddDenied(w http.ResponseWriter, req *http.Request) {
+	entry := publish.DenyEntry{}
+	err := json.NewDecoder(req.Body).Decode(&entry)
+	if err != nil {
+		respondError(w, req, "Error parsing denylist entry: "+err.Error(), 400)
+		return
+	}
+
+	err = entry.Normalize()
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	out, err := dbPublisher.AddDenied(entry)
+	if err == nil {
+		refreshDenylist()
+	}
+	respond(w, req, out, err)
+}
+
+func apiDeleteDenied(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(req)["id"])
+
+	err := dbPublisher.DeleteDenied(id)
+	if errors.Is(err, publish.ErrNotDenied) {
+		respondError(w, req, err.Error(), 404)
+		return
+	}
+	if err == nil {
+		refreshDenylist()
+	}
+	respond(w, req, map[string]string{"ok": "1"}, err)
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+const (
+	DEF_BACKFILL_BATCH = 1000
+	DEF_BACKFILL_PAUSE = 100 * time.Millisecond
+)
+
+func migrateCommand() cli.Command {
+	return cli.Command{
+		Name:  "migrate",
+		Usage: "manage the DB schema",
+		Subcommands: []cli.Command{
+			{
+				Name:   "up",
+				Usage:  "apply the pending migrations",
+				Action: serverMigrateUp,
+				Flags: append([]cli.Flag{
+					cli.IntFlag{
+						Name:  "to",
+						Usage: "stop after this schema version, 0 for the latest",
+					},
+					cli.IntFlag{
+						Name:  "backfill-batch",
+						Usage: "records converted to jsonb at a time",
+						Value: DEF_BACKFILL_BATCH,
+					},
+					cli.StringFlag{
+						Name:  "backfill-pause",
+						Usage: "pause between batches of records converted to jsonb",
+						Value: DEF_BACKFILL_PAUSE.String(),
+					},
+				}, postgresFlags()...),
+			},
+			{
+				Name:   "down",
+				Usage:  "revert the latest migrations",
+				Action: serverMigrateDown,
+				Flags: append([]cli.Flag{
+					cli.IntFlag{
+						Name:  "steps",
+						Usage: "how many migrations to revert",
+						Value: 1,
+					},
+				}, postgresFlags()...),
+			},
+			{
+				Name:   "status",
+				Usage:  "list the migrations and whether they are applied",
+				Action: serverMigrateStatus,
+				Flags:  postgresFlags(),
+			},
+		},
+	}
+}
+
+func schemaFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:   "migrate",
+			Usage:  "apply pending DB schema migrations at start",
+			EnvVar: "TELEMETRY_MIGRATE",
+		},
+		cli.BoolTFlag{
+			Name:   "require-schema",
+			Usage:  "refuse to start while DB schema migrations are pending, --require-schema=false to only warn",
+			EnvVar: "TELEMETRY_REQUIRE_SCHEMA",
+		},
+	}
+}
+
+// checkSchema compares the DB schema with the migrations built in. Pending
+// migrations are applied with --migrate, and otherwise stop the server:
+// records can't be stored in an older schema. --require-schema=false only
+// warns about them. Records are then
+// converted to jsonb in the background until stop is closed.
+func checkSchema(c *cli.Context, db *publish.Postgres, stop <-chan struct{}) error {
+	if c.Bool("migrate") {
+		_, err := db.MigrateUp(0)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			err := backfillDocs(db, DEF_BACKFILL_BATCH, DEF_BACKFILL_PAUSE, stop)
+			if err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := publish.LatestMigration()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current > latest:
+		log.Warnf("DB schema version %d is newer than this server's %d", current, latest)
+	case current < latest && c.BoolT("require-schema"):
+		return fmt.Errorf("DB schema version %d is behind %d, run telemetry server migrate up", current, latest)
+	case current < latest:
+		log.Warnf("DB schema version %d is behind %d, run telemetry server migrate up", current, latest)
+	}
+
+	return nil
+}
+
+func migrateDb(c *cli.Context) (*publish.Postgres, error) {
+	db := publish.NewPostgres(c)
+	if db.Conn == nil {
+		return nil, cli.NewExitError("Postgres host, user and password are required", 1)
+	}
+	return db, nil
+}
+
+func serverMigrateUp(c *cli.Context) error {
+	batch := c.Int("backfill-batch")
+	if batch < 1 {
+		return cli.NewExitError("Backfill batch must be > 0", 1)
+	}
+
+	pause, err := time.ParseDuration(c.String("backfill-pause"))
+	if err != nil || pause < 0 {
+		return cli.NewExitError("Backfill pause must be a valid GoLang duration string", 1)
+	}
+
+	db, err := migrateDb(c)
+	if err != nil {
+		return err
+	}
+	defer db.Conn.Close()
+
+	done, err := db.MigrateUp(c.Int("to"))
+	log.Infof("Applied %d migrations", len(done))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return backfillDocs(db, batch, pause, nil)
+}
+
+// backfillDocs converts the records stored before record.doc existed, if
+// the schema has it.
+func backfillDocs(db *publish.Postgres, batch int, pause time.Duration, stop <-chan struct{}) error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if current < publish.RecordDocMigration {
+		return nil
+	}
+
+	_, err = db.BackfillDocs(batch, pause, stop)
+	if err != nil {
+		return cli.NewExitError("Error converting records to jsonb: "+err.Error(), 1)
+	}
+	return nil
+}
+
+func serverMigrateDown(c *cli.Context) error {
+	steps := c.Int("steps")
+	if steps < 1 {
+		return cli.NewExitError("Steps must be > 0", 1)
+	}
+
+	db, err := migrateDb(c)
+	if err != nil {
+		return err
+	}
+	defer db.Conn.Close()
+
+	done, err := db.MigrateDown(steps)
+	log.Infof("Reverted %d migrations", len(done))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func serverMigrateStatus(c *cli.Context) error {
+	db, err := migrateDb(c)
+	if err != nil {
+		return err
+	}
+	defer db.Conn.Close()
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+func rollupFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:   "rollup-fields",
+			Usage:  "numeric record paths to roll up daily aggregates of, may be repeated",
+			EnvVar: "TELEMETRY_ROLLUP_FIELDS",
+		},
+		cli.StringSliceFlag{
+			Name:   "rollup-maps",
+			Usage:  "map record paths to roll up daily key counts of, may be repeated",
+			EnvVar: "TELEMETRY_ROLLUP_MAPS",
+		},
+		cli.StringSliceFlag{
+			Name:   "rollup-values",
+			Usage:  "string record paths to roll up daily value counts of, may be repeated",
+			EnvVar: "TELEMETRY_ROLLUP_VALUES",
+		},
+		cli.StringFlag{
+			Name:   "rollup-interval",
+			Usage:  "how often to look for closed days to roll up",
+			Value:  "15m",
+			EnvVar: "TELEMETRY_ROLLUP_INTERVAL",
+		},
+	}
+}
+
+func rollupConfig(c *cli.Context) (publish.RollupConfig, time.Duration, error) {
+	config, err := publish.NewRollupConfig(c.StringSlice("rollup-fields"), c.StringSlice("rollup-maps"), c.StringSlice("rollup-values"))
+	if err != nil {
+		return config, 0, err
+	}
+
+	interval, err := time.ParseDuration(c.String("rollup-interval"))
+	if err != nil || interval <= 0 {
+		return config, 0, errors.New("Rollup interval must be a valid GoLang duration string")
+	}
+
+	return config, interval, nil
+}
+
+// runRollups rolls up the days closed since it last looked, every interval
+// until stop is closed.
+func runRollups(config publish.RollupConfig, interval time.Duration, stop <-chan struct{}) {
+	if dbPublisher.Conn == nil || config.Empty() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		current, err := dbPublisher.SchemaVersion()
+		if err != nil {
+			log.Errorf("Error reading the DB schema version: %s", err)
+		} else if current < publish.RollupMigration {
+			log.Warnf("DB schema version %d has no rollup tables, run telemetry server migrate up", current)
+		} else {
+			dbPublisher.Rollup(config, stop)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
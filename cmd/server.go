@@ -3,6 +3,7 @@ package cmd
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"math/rand"
 	"net"
@@ -21,9 +22,13 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	publish "github.com/rancher/telemetry/publish"
-	record "github.com/rancher/telemetry/record"
+	schema "github.com/rancher/telemetry/schema"
 )
 
+// metricsVars are the expvars served at /admin/metrics. The others, like
+// cmdline, could give away secrets passed as flags.
+var metricsVars = []string{"ingest", "publish_rejected"}
+
 const DEF_HOURS = 7
 const DEF_DAYS = 28
 
@@ -60,7 +65,7 @@ func ServerCommand() cli.Command {
 		Name:   "server",
 		Usage:  "gather stats from a telemetry client",
 		Action: serverRun,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "listen, l",
 				Usage: "address/port to listen on",
@@ -73,41 +78,40 @@ func ServerCommand() cli.Command {
 				Destination: &enableXff,
 			},
 
-			cli.StringFlag{
-				Name:   "pg-host",
-				Usage:  "postgres host",
-				Value:  "localhost",
-				EnvVar: "TELEMETRY_PG_HOST",
-			},
-			cli.StringFlag{
-				Name:   "pg-port",
-				Usage:  "postgres port",
-				Value:  "5432",
-				EnvVar: "TELEMETRY_PG_PORT",
+			cli.Int64Flag{
+				Name:        "max-record-size",
+				Usage:       "largest record in bytes the server accepts",
+				Value:       DEF_MAX_RECORD_SIZE,
+				EnvVar:      "TELEMETRY_MAX_RECORD_SIZE",
+				Destination: &maxRecordSize,
 			},
-			cli.StringFlag{
-				Name:   "pg-user",
-				Usage:  "postgres user",
-				Value:  "telemetry",
-				EnvVar: "TELEMETRY_PG_USER",
+
+			cli.IntFlag{
+				Name:   "ingest-queue-size",
+				Usage:  "how many records may wait to be written to the DB before clients are turned away",
+				Value:  DEF_INGEST_QUEUE_SIZE,
+				EnvVar: "TELEMETRY_INGEST_QUEUE_SIZE",
 			},
-			cli.StringFlag{
-				Name:   "pg-pass",
-				Usage:  "postgres password",
-				Value:  "",
-				EnvVar: "TELEMETRY_PG_PASS",
+
+			cli.IntFlag{
+				Name:   "ingest-batch-size",
+				Usage:  "most records written to the DB in one transaction",
+				Value:  DEF_INGEST_BATCH_SIZE,
+				EnvVar: "TELEMETRY_INGEST_BATCH_SIZE",
 			},
+
 			cli.StringFlag{
-				Name:   "pg-dbname",
-				Usage:  "postgres dbname",
-				Value:  "telemetry",
-				EnvVar: "TELEMETRY_PG_DBNAME",
+				Name:   "ingest-flush-interval",
+				Usage:  "longest a record waits for its batch to fill up",
+				Value:  "1s",
+				EnvVar: "TELEMETRY_INGEST_FLUSH_INTERVAL",
 			},
+
 			cli.StringFlag{
-				Name:   "pg-ssl",
-				Usage:  "postgres ssl mode (disable, require, verify-ca, verify-full)",
-				Value:  "disable",
-				EnvVar: "TELEMETRY_PG_SSL",
+				Name:   "ingest-journal-dir",
+				Usage:  "directory keeping queued records across restarts",
+				Value:  ".ingest",
+				EnvVar: "TELEMETRY_INGEST_JOURNAL_DIR",
 			},
 
 			cli.StringFlag{
@@ -123,10 +127,89 @@ func ServerCommand() cli.Command {
 				Value:  "",
 				EnvVar: "TELEMETRY_SECRET_KEY",
 			},
+
+			shutdownTimeoutFlag(),
+		}, append(append(append(limitFlags(), schemaFlags()...), rollupFlags()...), postgresFlags()...)...),
+		Subcommands: []cli.Command{
+			{
+				Name:   "upgrade-records",
+				Usage:  "run the record upgraders again over the stored records",
+				Action: serverUpgradeRecords,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only count the records that would change",
+					},
+				}, postgresFlags()...),
+			},
+			migrateCommand(),
 		},
 	}
 }
 
+func postgresFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "pg-host",
+			Usage:  "postgres host",
+			Value:  "localhost",
+			EnvVar: "TELEMETRY_PG_HOST",
+		},
+		cli.StringFlag{
+			Name:   "pg-port",
+			Usage:  "postgres port",
+			Value:  "5432",
+			EnvVar: "TELEMETRY_PG_PORT",
+		},
+		cli.StringFlag{
+			Name:   "pg-user",
+			Usage:  "postgres user",
+			Value:  "telemetry",
+			EnvVar: "TELEMETRY_PG_USER",
+		},
+		cli.StringFlag{
+			Name:   "pg-pass",
+			Usage:  "postgres password",
+			Value:  "",
+			EnvVar: "TELEMETRY_PG_PASS",
+		},
+		cli.StringFlag{
+			Name:   "pg-dbname",
+			Usage:  "postgres dbname",
+			Value:  "telemetry",
+			EnvVar: "TELEMETRY_PG_DBNAME",
+		},
+		cli.StringFlag{
+			Name:   "pg-ssl",
+			Usage:  "postgres ssl mode (disable, require, verify-ca, verify-full)",
+			Value:  "disable",
+			EnvVar: "TELEMETRY_PG_SSL",
+		},
+	}
+}
+
+func serverUpgradeRecords(c *cli.Context) error {
+	db := publish.NewPostgres(c)
+	if db.Conn == nil {
+		return cli.NewExitError("Postgres host, user and password are required", 1)
+	}
+	defer db.Conn.Close()
+
+	dryRun := c.Bool("dry-run")
+	stats, err := db.UpgradeRecords(dryRun)
+
+	updated := "updated"
+	if dryRun {
+		updated = "to update"
+	}
+	log.Infof("Read %d records, %d arrived as an older version, %d %s, %d failed", stats.Records, stats.Upgraded, stats.Updated, updated, stats.Failed)
+	if err != nil {
+		return cli.NewExitError("Error upgrading records: "+err.Error(), 1)
+	}
+
+	return nil
+}
+
 func getHash(user string, realm string) string {
 	if user == adminUser && adminHash != "" {
 		return adminHash
@@ -144,7 +227,38 @@ func serverRun(c *cli.Context) error {
 	log.Infof("Telemetry Server %s", c.App.Version)
 
 	version = c.App.Version
+
+	grace, err := parseShutdownTimeout(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	rollups, rollupInterval, err := rollupConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	// Closed at shutdown, for the background jobs.
+	stop := make(chan struct{})
+
 	dbPublisher = publish.NewPostgres(c)
+	if dbPublisher.Conn != nil {
+		err = checkSchema(c, dbPublisher, stop)
+		if err != nil {
+			return cli.NewExitError("Error checking the DB schema: "+err.Error(), 1)
+		}
+
+		ingestQueue, err = newIngestQueue(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		log.Warn("Postgres is not configured, published records will be refused")
+	}
+
+	setupLimits(c)
+	go watchDenylist(stop)
+	go runRollups(rollups, rollupInterval, stop)
 
 	adminUser = c.String("admin-key")
 	adminSecret := c.String("admin-secret")
@@ -157,6 +271,8 @@ func serverRun(c *cli.Context) error {
 	router.HandleFunc("/favicon.ico", http.NotFound)
 	router.HandleFunc("/healthcheck.html", serverCheck).Methods("GET")
 	router.HandleFunc("/publish", serverPublish).Methods("POST")
+	router.HandleFunc("/schema/record", serverSchema).Methods("GET")
+	router.HandleFunc("/schema/record/{version:[0-9]+}", serverSchema).Methods("GET")
 	router.HandleFunc("/", serverRoot).Methods("GET")
 
 	// Admin
@@ -168,6 +284,7 @@ func serverRun(c *cli.Context) error {
 	admin.HandleFunc("/admin/active/fields/{fields}", apiActiveFields) // ?hours=7
 	admin.HandleFunc("/admin/active/map/{field}", apiActiveMap)        // ?hours=7
 	admin.HandleFunc("/admin/active/value/{field}", apiActiveValue)    // ?hours=7
+	admin.HandleFunc("/admin/active/collectors", apiActiveCollectors)  // ?hours=7
 
 	admin.HandleFunc("/admin/history", apiHistory)                       // ?days=28
 	admin.HandleFunc("/admin/history/fields/{fields}", apiHistoryFields) // ?days=28
@@ -180,10 +297,22 @@ func serverRun(c *cli.Context) error {
 	admin.HandleFunc("/admin/installs/{uid}/map/{field}", apiInstallMap)        // ?days=28
 	admin.HandleFunc("/admin/installs/{uid}/value/{field}", apiInstallValue)    // ?days=28
 
-	admin.HandleFunc("/admin/records/{id}", apiRecordById) // nothing
+	admin.HandleFunc("/admin/records/{id}", apiRecordById)       // nothing
+	admin.HandleFunc("/admin/records/rid/{rid}", apiRecordByRid) // nothing
 
 	admin.HandleFunc("/admin/restore/{day}", apiRestoreByDay)
 
+	admin.HandleFunc("/admin/quarantine", apiQuarantine).Methods("GET") // ?limit=100
+	admin.HandleFunc("/admin/quarantine/{id:[0-9]+}", apiQuarantinedById).Methods("GET")
+	admin.HandleFunc("/admin/quarantine/{id:[0-9]+}", apiDeleteQuarantined).Methods("DELETE")
+	admin.HandleFunc("/admin/quarantine/{id:[0-9]+}/replay", apiReplayQuarantined).Methods("POST")
+
+	admin.HandleFunc("/admin/denylist", apiDenylist).Methods("GET")
+	admin.HandleFunc("/admin/denylist", apiAddDenied).Methods("POST")
+	admin.HandleFunc("/admin/denylist/{id:[0-9]+}", apiDeleteDenied).Methods("DELETE")
+
+	admin.HandleFunc("/admin/metrics", apiMetrics).Methods("GET")
+
 	n := negroni.New()
 	n.Use(negroni.HandlerFunc(checkAuth))
 	n.UseHandler(admin)
@@ -198,7 +327,34 @@ func serverRun(c *cli.Context) error {
 
 	listen := c.String("listen")
 	log.Info("Listening on ", listen)
-	log.Fatal(http.ListenAndServe(listen, logged))
+	server := &http.Server{
+		Addr:    listen,
+		Handler: logged,
+	}
+
+	// Shutdown waits for in-flight publish requests, then the queue writes
+	// what they queued before the connection pool goes away.
+	deadline, err := serveUntilSignal(server, grace)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	close(stop)
+
+	if ingestQueue != nil {
+		err = ingestQueue.Close(deadline)
+		if err != nil {
+			log.Warnf("Stopped before writing every queued record, the rest stay in the journal: %s", err)
+		}
+	}
+
+	if dbPublisher.Conn != nil {
+		err = dbPublisher.Conn.Close()
+		if err != nil {
+			log.Errorf("Error closing Postgres connection: %s", err)
+		}
+	}
+
+	log.Info("Stopped")
 	return nil
 }
 
@@ -321,26 +477,25 @@ func serverRoot(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write([]byte("+" + strings.Repeat("-", nCols-2) + "+\n"))
 }
 
-func serverPublish(w http.ResponseWriter, req *http.Request) {
-	var r record.Record
+// serverSchema serves the published JSON Schema of a record version, the
+// current one by default.
+func serverSchema(w http.ResponseWriter, req *http.Request) {
+	version := RECORD_VERSION
+	if str := mux.Vars(req)["version"]; str != "" {
+		version, _ = strconv.Atoi(str)
+	}
 
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&r)
-	if err != nil {
-		respondError(w, req, "Error parsing Record", 400)
+	data := schema.Published(version)
+	if data == nil {
+		respondError(w, req, fmt.Sprintf("No schema for record version %d", version), 404)
 		return
 	}
 
-	realIp := requestIp(req)
-	ip := anonymizeIp(realIp)
-	log.Debugf("Publish from %s: %s", realIp, r)
-
-	err = dbPublisher.Report(r, ip)
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, err := w.Write(data)
 	if err != nil {
-		log.Errorf("Error publishing to DB: %s", err)
+		log.Errorf("Error while writing in serverSchema: %v", err)
 	}
-
-	respondSuccess(w, req, map[string]string{"ok": "1"})
 }
 
 // ------------
@@ -422,6 +577,17 @@ func apiHistoryInstalls(w http.ResponseWriter, req *http.Request) {
 	respondSuccess(w, req, out)
 }
 
+func apiMetrics(w http.ResponseWriter, req *http.Request) {
+	out := map[string]json.RawMessage{}
+	for _, name := range metricsVars {
+		if v := expvar.Get(name); v != nil {
+			out[name] = json.RawMessage(v.String())
+		}
+	}
+
+	respondSuccess(w, req, out)
+}
+
 // ------------
 // Counts
 // ------------
@@ -435,6 +601,14 @@ func getFields(w http.ResponseWriter, req *http.Request, which string) {
 		return
 	}
 
+	for _, field := range opt.Fields {
+		err = checkSummable(field, false)
+		if err != nil {
+			respondError(w, req, err.Error(), 422)
+			return
+		}
+	}
+
 	switch which {
 	case "active":
 		out, err = dbPublisher.SumOfActiveInstalls(opt.Hours, opt.Fields)
@@ -460,6 +634,12 @@ func getMap(w http.ResponseWriter, req *http.Request, which string) {
 		return
 	}
 
+	err = checkSummable(opt.Field, true)
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
 	switch which {
 	case "active":
 		out, err = dbPublisher.SumOfActiveInstallsMap(opt.Hours, opt.Field)
@@ -525,6 +705,17 @@ func apiActive(w http.ResponseWriter, req *http.Request) {
 	respondSuccess(w, req, coll)
 }
 
+func apiActiveCollectors(w http.ResponseWriter, req *http.Request) {
+	opt, err := getOptions(req, RequiredOptions{})
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	out, err := dbPublisher.SumOfActiveCollectors(opt.Hours)
+	respond(w, req, out, err)
+}
+
 func apiActiveFields(w http.ResponseWriter, req *http.Request) {
 	getFields(w, req, "active")
 }
@@ -617,6 +808,22 @@ func apiRecordById(w http.ResponseWriter, req *http.Request) {
 	respond(w, req, out, err)
 }
 
+// apiRecordByRid looks a record up by the id the client gave it.
+func apiRecordByRid(w http.ResponseWriter, req *http.Request) {
+	rid := mux.Vars(req)["rid"]
+	if !validUid.MatchString(rid) {
+		respondError(w, req, "rid must be a UUID", 422)
+		return
+	}
+
+	out, err := dbPublisher.GetRecordByRid(rid)
+	if errors.Is(err, publish.ErrNoRecord) {
+		respondError(w, req, err.Error(), 404)
+		return
+	}
+	respond(w, req, out, err)
+}
+
 func apiRestoreByDay(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	day := vars["day"]
@@ -640,9 +847,11 @@ func apiRestoreByDay(w http.ResponseWriter, req *http.Request) {
 	respondSuccess(w, req, coll)
 }
 
+// requestIp is the client address, as seen by the proxy in front of the
+// server with --xff.
 func requestIp(req *http.Request) string {
 	if enableXff {
-		clientIp := req.Header.Get("X-Forwarded-For")
+		clientIp := publish.ForwardedIp(req.Header.Values("X-Forwarded-For"))
 		if len(clientIp) > 0 {
 			return clientIp
 		}
@@ -721,6 +930,24 @@ func getOptions(req *http.Request, required RequiredOptions) (RequestOpts, error
 	return out, nil
 }
 
+// checkSummable makes sure the record schema has integers at field, or in
+// the map at field, as the aggregate queries sum them as such. Fields the
+// schema doesn't know about, like those of plugins, are left to the query.
+func checkSummable(field string, isMap bool) error {
+	s := schema.ForVersion(RECORD_VERSION).Lookup(strings.Split(field, "."))
+	if s != nil && isMap {
+		s = s.AdditionalProperties
+		if s == nil {
+			return fmt.Errorf("Field %s is not a map", field)
+		}
+	}
+	if s != nil && !s.Type.Has("integer") {
+		return fmt.Errorf("Field %s is not an integer", field)
+	}
+
+	return nil
+}
+
 func (r *RequiredOptions) Contains(needle string) bool {
 	needle = strings.ToLower(needle)
 	for _, val := range *r {
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func shutdownTimeoutFlag() cli.Flag {
+	return cli.StringFlag{
+		Name:   "shutdown-timeout",
+		Usage:  "how long in-flight work may take to finish after SIGTERM or SIGINT",
+		Value:  "30s",
+		EnvVar: "TELEMETRY_SHUTDOWN_TIMEOUT",
+	}
+}
+
+func parseShutdownTimeout(c *cli.Context) (time.Duration, error) {
+	grace, err := time.ParseDuration(c.String("shutdown-timeout"))
+	if err != nil || grace < 0 {
+		return 0, errors.New("Shutdown timeout must be a valid GoLang duration string")
+	}
+	return grace, nil
+}
+
+// serveUntilSignal serves HTTP with server until the process gets SIGTERM or
+// SIGINT. It then stops accepting connections and waits for in-flight
+// requests until grace has passed. It returns the end of the grace period,
+// so the caller can use what is left of it to wind down.
+func serveUntilSignal(server *http.Server, grace time.Duration) (time.Time, error) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-errs:
+		return time.Time{}, err
+	case sig := <-sigs:
+		log.Infof("Got %s, shutting down", sig)
+	}
+
+	deadline := time.Now().Add(grace)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Warnf("Requests still running at the end of the grace period: %s", err)
+	}
+
+	return deadline, nil
+}
+
+// waitUntil waits for wg until deadline and tells whether it got done.
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// snapshot is the outcome of a collection, kept around so the HTTP API
+// doesn't hit Rancher on every request.
+type snapshot struct {
+	record    record.Record
+	body      []byte
+	etag      string
+	collected time.Time
+}
+
+// collectCall is a collection in progress. Everyone asking for a record
+// while it runs waits for it instead of starting their own.
+type collectCall struct {
+	done chan struct{}
+	snap *snapshot
+	err  error
+}
+
+var (
+	snapshotMu   sync.Mutex
+	inflight     *collectCall
+	lastSnapshot *snapshot
+	// snapshotGen changes whenever the snapshot is reset, so a run that was
+	// already going at the time doesn't bring back a stale one.
+	snapshotGen int
+)
+
+// collectShared runs collect, or joins the run already in progress, and
+// keeps the result as the latest snapshot.
+func collectShared() (*snapshot, error) {
+	snapshotMu.Lock()
+	call := inflight
+	if call == nil {
+		call = &collectCall{
+			done: make(chan struct{}),
+		}
+		inflight = call
+		go runCollectCall(call, snapshotGen)
+	}
+	snapshotMu.Unlock()
+
+	<-call.done
+	return call.snap, call.err
+}
+
+func runCollectCall(call *collectCall, gen int) {
+	defer close(call.done)
+
+	snap, err := newSnapshot()
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	inflight = nil
+	call.snap = snap
+	call.err = err
+	if err == nil && gen == snapshotGen {
+		lastSnapshot = snap
+	}
+}
+
+func newSnapshot() (*snapshot, error) {
+	r, err := collect()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	return &snapshot{
+		record:    r,
+		body:      body,
+		etag:      `"` + hex.EncodeToString(sum[:16]) + `"`,
+		collected: time.Now(),
+	}, nil
+}
+
+// cachedSnapshot returns the latest snapshot, or collects one if there is
+// none yet.
+func cachedSnapshot() (*snapshot, error) {
+	snapshotMu.Lock()
+	snap := lastSnapshot
+	snapshotMu.Unlock()
+
+	if snap != nil {
+		return snap, nil
+	}
+
+	return collectShared()
+}
+
+// resetSnapshot drops the cached snapshot, e.g. because it was collected
+// with a configuration that no longer applies.
+func resetSnapshot() {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	lastSnapshot = nil
+	snapshotGen++
+}
@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -34,11 +35,16 @@ func (a App) RecordKey() string {
 	return "app"
 }
 
+func (a App) Description() string {
+	return "Apps deployed from catalogs, by catalog, template and version"
+}
+
 func (a App) Collect(c *CollectorOpts) interface{} {
-	log.Debug("Collecting Apps")
-	opts := NonRemoved()
-	opts.Filters["all"] = "true"
+	return a.CollectContext(context.Background(), c)
+}
 
+func (a App) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
+	log.Debug("Collecting Apps")
 	nonRemoved := NonRemoved()
 
 	a.Catalogs = map[string]*AppTemplate{}
@@ -56,14 +62,19 @@ func (a App) Collect(c *CollectorOpts) interface{} {
 	}
 
 	log.Debug("  Collecting Projects")
-	projectList, err := c.Client.Project.ListAll(&opts)
-	if err != nil {
+	projectList, err := c.source().Projects("")
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Projects err=%s", err)
 		return nil
 	}
-	log.Debugf("  Found %d Projects", len(projectList.Data))
+	log.Debugf("  Found %d Projects", len(projectList))
+
+	for i, project := range projectList {
+		if ctx.Err() != nil {
+			log.Warnf("Stopped collecting Apps after %d of %d Projects err=%s", i, len(projectList), ctx.Err())
+			break
+		}
 
-	for _, project := range projectList.Data {
 		projectClient, err := AppGetProjectClient(c, project.ID)
 		if err != nil {
 			log.Errorf("Failed to get project client ID %s err=%s", project.ID, err)
@@ -72,7 +83,7 @@ func (a App) Collect(c *CollectorOpts) interface{} {
 
 		log.Debugf("  Collecting Apps")
 		appsCollection, err := projectClient.App.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get Apps for project %s err=%s", project.ID, err)
 		} else {
 			log.Debugf("  Found %d Apps", len(appsCollection.Data))
@@ -128,8 +139,8 @@ func SplitAppExternalID(externalID string) (map[string]string, error) {
 }
 
 func GetAppCatalogState(c *CollectorOpts, id string) (string, error) {
-	catalog, err := c.Client.Catalog.ByID(id)
-	if err != nil {
+	catalog, err := c.source().Catalog(id)
+	if c.Track(err) != nil {
 		if IsNotFound(err) {
 			return "disabled", nil
 		}
@@ -1,21 +1,67 @@
 package collector
 
 import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	rancherCluster "github.com/rancher/rancher/pkg/client/generated/cluster/v3"
 	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
 	rancherProject "github.com/rancher/rancher/pkg/client/generated/project/v3"
 	"github.com/rancher/telemetry/record"
+	log "github.com/sirupsen/logrus"
+)
+
+// partialGrace is how long Run waits, once a ContextCollector's deadline has
+// passed, for it to hand back what it collected so far.
+const partialGrace = 5 * time.Second
+
+// Collector goroutine states, so the one giving up on a collector and the
+// collector itself agree on which of them logs it.
+const (
+	collectorRunning int32 = iota
+	collectorFinished
+	collectorAbandoned
 )
 
+// abandoned counts the collectors still running after Run gave up on them.
+var abandoned int32
+
 var (
 	ClusterClients          = map[string]*rancherCluster.Client{}
 	ProjectClients          = map[string]*rancherProject.Client{}
 	NewRancherClusterClient = rancherCluster.NewClient
 	NewRancherProjectClient = rancherProject.NewClient
+
+	clientsMu sync.Mutex
 )
 
 type CollectorOpts struct {
+	// Client is the Rancher API, needed for data from downstream clusters.
+	// It may be nil when Source provides the management objects.
 	Client *rancher.Client
+	// Source provides the management objects, the Rancher API through
+	// Client if nil.
+	Source Source
+
+	// Workers is how many collectors Run executes at once, 0 for all of them.
+	Workers int
+	// Timeout bounds each collector and RunTimeout the whole run, 0 for no limit.
+	Timeout    time.Duration
+	RunTimeout time.Duration
+	// Collectors are the record keys of the collectors Run executes, all
+	// registered ones when empty. Those in ExcludeCollectors are left out
+	// either way.
+	Collectors        []string
+	ExcludeCollectors []string
+	// Downstream is how cluster and project clients read namespaces,
+	// workloads, pods, HPAs and apps: DownstreamV3, the default, or
+	// DownstreamSteve.
+	Downstream string
+
+	stats *runStats
 }
 
 type Collector interface {
@@ -23,26 +69,284 @@ type Collector interface {
 	Collect(opt *CollectorOpts) interface{}
 }
 
+// DescribedCollector is a Collector that can say what it collects, for
+// listings of the registered collectors.
+type DescribedCollector interface {
+	Collector
+	Description() string
+}
+
+// ContextCollector is a Collector that stops early when ctx is done and
+// returns whatever it collected up to that point.
+type ContextCollector interface {
+	Collector
+	CollectContext(ctx context.Context, opt *CollectorOpts) interface{}
+}
+
 var registered []Collector
 
 func Register(c Collector) {
 	registered = append(registered, c)
 }
 
-func Run(record *record.Record, opt *CollectorOpts) {
+// RecordKeys returns the record keys of the registered collectors.
+func RecordKeys() []string {
+	out := []string{}
+	for _, c := range registered {
+		out = append(out, c.RecordKey())
+	}
+	return out
+}
+
+// ResetClients forgets the cached cluster and project clients, so they get
+// created again from the current management client.
+func ResetClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	ClusterClients = map[string]*rancherCluster.Client{}
+	ProjectClients = map[string]*rancherProject.Client{}
+	steveRancher = nil
+	steveClusters = map[string]*steveAPI{}
+}
+
+// CollectorInfo describes a registered collector.
+type CollectorInfo struct {
+	Key         string
+	Description string
+	Enabled     bool
+}
+
+// Describe returns the registered collectors in the order they were
+// registered, and whether Run would execute them with opt.
+func Describe(opt *CollectorOpts) []CollectorInfo {
+	out := []CollectorInfo{}
+	for _, c := range registered {
+		info := CollectorInfo{
+			Key:     c.RecordKey(),
+			Enabled: opt.isEnabled(c.RecordKey()),
+		}
+		if dc, ok := c.(DescribedCollector); ok {
+			info.Description = dc.Description()
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+func (opt *CollectorOpts) isEnabled(key string) bool {
+	for _, excluded := range opt.ExcludeCollectors {
+		if key == excluded {
+			return false
+		}
+	}
+
+	if len(opt.Collectors) == 0 {
+		return true
+	}
+	for _, included := range opt.Collectors {
+		if key == included {
+			return true
+		}
+	}
+	return false
+}
+
+func enabled(opt *CollectorOpts) []Collector {
+	out := []Collector{}
+	for _, c := range registered {
+		if opt.isEnabled(c.RecordKey()) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Run executes the enabled collectors concurrently and stores their
+// results in record, along with a MetaRecordKey section describing each
+// run and which collectors were enabled. A collector that runs out of time
+// leaves a partial section, or nil, but keeps its worker slot until it
+// returns, so no more than Workers collectors ever run at once.
+func Run(ctx context.Context, record *record.Record, opt *CollectorOpts) {
+	if opt.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.RunTimeout)
+		defer cancel()
+	}
+
+	collectors := enabled(opt)
+
+	workers := opt.Workers
+	if workers <= 0 || workers > len(collectors) {
+		workers = len(collectors)
+	}
+
+	sem := make(chan struct{}, workers)
+	results := make([]interface{}, len(collectors))
+	metas := make([]*CollectorMeta, len(collectors))
+
+	var wg sync.WaitGroup
+	for i, c := range collectors {
+		wg.Add(1)
+		go func(i int, c Collector) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				log.Warnf("Skipping collector %s: %s", c.RecordKey(), ctx.Err())
+				metas[i] = &CollectorMeta{Error: ErrorTimeout}
+				return
+			}
+
+			results[i], metas[i] = collect(ctx, c, opt, func() { <-sem })
+		}(i, c)
+	}
+	wg.Wait()
+
+	meta := Meta{
+		Collectors: map[string]*CollectorMeta{},
+		Enabled:    []string{},
+		Disabled:   []string{},
+	}
+
+	for i, c := range collectors {
+		(*record)[c.RecordKey()] = results[i]
+		meta.Collectors[c.RecordKey()] = metas[i]
+	}
+
 	for _, c := range registered {
-		(*record)[c.RecordKey()] = c.Collect(opt)
+		if opt.isEnabled(c.RecordKey()) {
+			meta.Enabled = append(meta.Enabled, c.RecordKey())
+		} else {
+			meta.Disabled = append(meta.Disabled, c.RecordKey())
+		}
 	}
+	sort.Strings(meta.Enabled)
+	sort.Strings(meta.Disabled)
+
+	(*record)[MetaRecordKey] = meta
 }
 
+// collect runs c until it returns or runs out of time. release is called
+// once c returns, which may be after collect gave up on it.
+func collect(ctx context.Context, c Collector, opt *CollectorOpts, release func()) (interface{}, *CollectorMeta) {
+	start := time.Now()
+
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		defer cancel()
+	}
+
+	// Each collector tracks its API calls on its own copy of the options.
+	own := *opt
+	own.stats = &runStats{}
+
+	cc, isContext := c.(ContextCollector)
+
+	state := collectorRunning
+	done := make(chan interface{}, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, collectorRunning, collectorFinished) {
+				n := atomic.AddInt32(&abandoned, -1)
+				log.Warnf("Collector %s returned after its deadline, %d collectors still running", c.RecordKey(), n)
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Collector %s panicked: %v", c.RecordKey(), r)
+				own.stats.fail(ErrorPanic)
+				done <- nil
+			}
+		}()
+
+		if isContext {
+			done <- cc.CollectContext(ctx, &own)
+		} else {
+			done <- c.Collect(&own)
+		}
+	}()
+
+	var out interface{}
+	timedOut := false
+
+	select {
+	case out = <-done:
+	case <-ctx.Done():
+		timedOut = true
+		if isContext {
+			select {
+			case out = <-done:
+				log.Warnf("Collector %s stopped early: %s", c.RecordKey(), ctx.Err())
+			case <-time.After(partialGrace):
+			}
+		}
+		if out == nil {
+			log.Errorf("Collector %s gave up: %s", c.RecordKey(), ctx.Err())
+		}
+		if atomic.CompareAndSwapInt32(&state, collectorRunning, collectorAbandoned) {
+			n := atomic.AddInt32(&abandoned, 1)
+			log.Warnf("Collector %s is still running after its deadline, %d collectors are", c.RecordKey(), n)
+		}
+	}
+
+	calls, lastError := own.stats.snapshot()
+	meta := &CollectorMeta{
+		DurationMs: time.Since(start).Milliseconds(),
+		ApiCalls:   calls,
+	}
+
+	switch {
+	case timedOut:
+		meta.Error = ErrorTimeout
+	case out == nil && lastError != "":
+		meta.Error = lastError
+	case out == nil:
+		meta.Error = ErrorNoData
+	default:
+		meta.Ok = 1
+	}
+
+	return out, meta
+}
+
+// GetClusterClient returns the cached client for cluster id. It starts from
+// a copy of the management client options, so it trusts the same CA and
+// verifies TLS the same way.
 func GetClusterClient(c *CollectorOpts, id string) (*rancherCluster.Client, error) {
+	if c.Client == nil {
+		return nil, ErrNoRancherAPI
+	}
+
 	options := *c.Client.Opts
 	options.URL = options.URL + "/clusters/" + id
 
+	clientsMu.Lock()
+	cli := ClusterClients[id]
+	clientsMu.Unlock()
+	if cli != nil {
+		return cli, nil
+	}
+
+	// Creating the client fetches its schemas, so other collectors aren't
+	// held up meanwhile. The first one stored wins.
+	cli, err := NewRancherClusterClient(&options)
+	if err != nil {
+		return nil, err
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
 	if ClusterClients[id] == nil {
-		cli, err := NewRancherClusterClient(&options)
-		if err != nil {
-			return nil, err
+		if c.Downstream == DownstreamSteve {
+			err = useSteveCluster(c.Client.Opts, id, cli)
+			if err != nil {
+				return nil, err
+			}
 		}
 		ClusterClients[id] = cli
 	}
@@ -50,14 +354,36 @@ func GetClusterClient(c *CollectorOpts, id string) (*rancherCluster.Client, erro
 	return ClusterClients[id], nil
 }
 
+// GetProjectClient is GetClusterClient for projects.
 func GetProjectClient(c *CollectorOpts, id string) (*rancherProject.Client, error) {
+	if c.Client == nil {
+		return nil, ErrNoRancherAPI
+	}
+
 	options := *c.Client.Opts
 	options.URL = options.URL + "/projects/" + id
 
+	clientsMu.Lock()
+	cli := ProjectClients[id]
+	clientsMu.Unlock()
+	if cli != nil {
+		return cli, nil
+	}
+
+	cli, err := NewRancherProjectClient(&options)
+	if err != nil {
+		return nil, err
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
 	if ProjectClients[id] == nil {
-		cli, err := NewRancherProjectClient(&options)
-		if err != nil {
-			return nil, err
+		if c.Downstream == DownstreamSteve {
+			err = useSteveProject(c.Client.Opts, id, cli)
+			if err != nil {
+				return nil, err
+			}
 		}
 		ProjectClients[id] = cli
 	}
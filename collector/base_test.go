@@ -1,9 +1,12 @@
 package collector_test
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rancher/norman/clientbase"
 	rancherCluster "github.com/rancher/rancher/pkg/client/generated/cluster/v3"
@@ -30,6 +33,59 @@ func (c *CollectorMock) Collect(opt *collector.CollectorOpts) interface{} {
 	return "Collected" + c.Key
 }
 
+// BlockingCollectorMock ignores deadlines and only returns once Release
+// is closed.
+type BlockingCollectorMock struct {
+	Key     string
+	Release chan struct{}
+}
+
+func (c *BlockingCollectorMock) RecordKey() string {
+	return c.Key
+}
+
+func (c *BlockingCollectorMock) Collect(opt *collector.CollectorOpts) interface{} {
+	<-c.Release
+	return "Collected" + c.Key
+}
+
+// PartialCollectorMock hands back a partial result as soon as its context
+// is done.
+type PartialCollectorMock struct {
+	BlockingCollectorMock
+}
+
+func (c *PartialCollectorMock) CollectContext(ctx context.Context, opt *collector.CollectorOpts) interface{} {
+	select {
+	case <-c.Release:
+		return "Collected" + c.Key
+	case <-ctx.Done():
+		return "Partial" + c.Key
+	}
+}
+
+func NewBaseClientMock() *rancher.Client {
+	baseClient := &rancher.Client{}
+	baseClient.Opts = &clientbase.ClientOpts{}
+	baseClient.Opts.URL = fmt.Sprintf("TEST_URL_%d", rand.Int())
+	baseClient.Catalog = NewCatalogOperationsMock("FAIL_BY_ID_NOT_FOUND")
+	baseClient.Project = NewProjectOperationsMock(`[]`)
+	baseClient.Cluster = NewClusterOperationsMock(`[]`)
+	baseClient.ClusterLogging = NewClusterLoggingOperationsMock(`[]`)
+	baseClient.ClusterTemplate = NewClusterTemplateOperationsMock(`[]`)
+	baseClient.ClusterTemplateRevision = NewClusterTemplateRevisionOperationsMock(`[]`)
+	baseClient.Setting = NewSettingOperationsMock("FAIL_BY_ID", nil)
+	baseClient.AuthConfig = NewAuthConfigOperationsMock(`[]`)
+	baseClient.User = NewUserOperationsMock(`[]`)
+	baseClient.NodeDriver = NewNodeDriverOperationsMock(`[]`)
+	baseClient.KontainerDriver = NewKontainerDriverOperationsMock(`[]`)
+	baseClient.MultiClusterApp = NewMultiClusterAppOperationsMock(`[]`)
+	baseClient.GlobalDnsProvider = NewGlobalDnsProviderOperationsMock(`[]`)
+	baseClient.GlobalDns = NewGlobalDnsOperationsMock(`[]`)
+	baseClient.Node = NewNodeOperationsMock(`[]`)
+	return baseClient
+}
+
 func TestBaseGetClusterClient(t *testing.T) {
 	prevFunc := collector.NewRancherClusterClient
 	defer func() { collector.NewRancherClusterClient = prevFunc }()
@@ -42,7 +98,7 @@ func TestBaseGetClusterClient(t *testing.T) {
 	baseClient.Opts = &clientbase.ClientOpts{}
 	testUrlString := fmt.Sprintf("TEST_URL_%d", rand.Int())
 	baseClient.Opts.URL = testUrlString
-	collectorOpts := &collector.CollectorOpts{baseClient}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
 
 	testID := fmt.Sprintf("ID_%d", rand.Int())
 	clusterClient, err := collector.GetClusterClient(collectorOpts, testID)
@@ -69,7 +125,7 @@ func TestBaseGetClusterClientReturnsError(t *testing.T) {
 	baseClient.Opts = &clientbase.ClientOpts{}
 	testUrlString := fmt.Sprintf("TEST_URL_%d", rand.Int())
 	baseClient.Opts.URL = testUrlString
-	collectorOpts := &collector.CollectorOpts{baseClient}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
 
 	testID := fmt.Sprintf("ID_%d", rand.Int())
 	clusterClient, err := collector.GetClusterClient(collectorOpts, testID)
@@ -78,6 +134,47 @@ func TestBaseGetClusterClientReturnsError(t *testing.T) {
 	assert.Equal(t, "ERROR: I'm a test", err.Error())
 }
 
+func TestBaseGetClusterClientDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slowID := fmt.Sprintf("SLOW_%d", rand.Int())
+
+	prevFunc := collector.NewRancherClusterClient
+	defer func() { collector.NewRancherClusterClient = prevFunc }()
+	collector.NewRancherClusterClient = func(opts *clientbase.ClientOpts) (*rancherCluster.Client, error) {
+		if strings.HasSuffix(opts.URL, "/"+slowID) {
+			<-release
+		}
+		client := &rancherCluster.Client{}
+		client.Opts = opts
+		return client, nil
+	}
+	baseClient := &rancher.Client{}
+	baseClient.Opts = &clientbase.ClientOpts{URL: fmt.Sprintf("TEST_URL_%d", rand.Int())}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
+
+	slow := make(chan *rancherCluster.Client)
+	go func() {
+		client, _ := collector.GetClusterClient(collectorOpts, slowID)
+		slow <- client
+	}()
+
+	fast := make(chan *rancherCluster.Client)
+	go func() {
+		client, _ := collector.GetClusterClient(collectorOpts, fmt.Sprintf("FAST_%d", rand.Int()))
+		fast <- client
+	}()
+
+	select {
+	case client := <-fast:
+		assert.NotNil(t, client)
+	case <-time.After(time.Second):
+		t.Error("Creating a client waited for another cluster's")
+	}
+
+	close(release)
+	assert.NotNil(t, <-slow)
+}
+
 func TestBaseGetProjectClient(t *testing.T) {
 	prevFunc := collector.NewRancherProjectClient
 	defer func() { collector.NewRancherProjectClient = prevFunc }()
@@ -90,7 +187,7 @@ func TestBaseGetProjectClient(t *testing.T) {
 	baseClient.Opts = &clientbase.ClientOpts{}
 	testUrlString := fmt.Sprintf("TEST_URL_%d", rand.Int())
 	baseClient.Opts.URL = testUrlString
-	collectorOpts := &collector.CollectorOpts{baseClient}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
 
 	testID := fmt.Sprintf("ID_%d", rand.Int())
 	projectClient, err := collector.GetProjectClient(collectorOpts, testID)
@@ -119,7 +216,7 @@ func TestBaseGetProjectClientReturnsError(t *testing.T) {
 	baseClient.Opts = &clientbase.ClientOpts{}
 	testUrlString := fmt.Sprintf("TEST_URL_%d", rand.Int())
 	baseClient.Opts.URL = testUrlString
-	collectorOpts := &collector.CollectorOpts{baseClient}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
 
 	testID := fmt.Sprintf("ID_%d", rand.Int())
 	projectClient, err := collector.GetProjectClient(collectorOpts, testID)
@@ -128,6 +225,41 @@ func TestBaseGetProjectClientReturnsError(t *testing.T) {
 	assert.Equal(t, "ERROR: I'm a test", err.Error())
 }
 
+func TestBaseDownstreamClientsInheritTLS(t *testing.T) {
+	prevCluster := collector.NewRancherClusterClient
+	prevProject := collector.NewRancherProjectClient
+	defer func() {
+		collector.NewRancherClusterClient = prevCluster
+		collector.NewRancherProjectClient = prevProject
+	}()
+	collector.NewRancherClusterClient = func(opts *clientbase.ClientOpts) (*rancherCluster.Client, error) {
+		client := &rancherCluster.Client{}
+		client.Opts = opts
+		return client, nil
+	}
+	collector.NewRancherProjectClient = func(opts *clientbase.ClientOpts) (*rancherProject.Client, error) {
+		client := &rancherProject.Client{}
+		client.Opts = opts
+		return client, nil
+	}
+	baseClient := &rancher.Client{}
+	baseClient.Opts = &clientbase.ClientOpts{
+		URL:     fmt.Sprintf("TEST_URL_%d", rand.Int()),
+		CACerts: "TEST_CA",
+	}
+	collectorOpts := &collector.CollectorOpts{Client: baseClient}
+
+	clusterClient, err := collector.GetClusterClient(collectorOpts, fmt.Sprintf("ID_%d", rand.Int()))
+	assert.Nil(t, err)
+	assert.Equal(t, "TEST_CA", clusterClient.Opts.CACerts)
+	assert.False(t, clusterClient.Opts.Insecure)
+
+	projectClient, err := collector.GetProjectClient(collectorOpts, fmt.Sprintf("ID_%d", rand.Int()))
+	assert.Nil(t, err)
+	assert.Equal(t, "TEST_CA", projectClient.Opts.CACerts)
+	assert.False(t, projectClient.Opts.Insecure)
+}
+
 func TestBaseCollectAll(t *testing.T) {
 	collector1 := CollectorMock{}
 	collector1.Key = "Collector1"
@@ -136,32 +268,13 @@ func TestBaseCollectAll(t *testing.T) {
 	collector3 := CollectorMock{}
 	collector3.Key = "Collector3"
 
-	baseClient := &rancher.Client{}
-	baseClient.Opts = &clientbase.ClientOpts{}
-	testUrlString := fmt.Sprintf("TEST_URL_%d", rand.Int())
-	baseClient.Opts.URL = testUrlString
-	baseClient.Catalog = NewCatalogOperationsMock("FAIL_BY_ID_NOT_FOUND")
-	baseClient.Project = NewProjectOperationsMock(`[]`)
-	baseClient.Cluster = NewClusterOperationsMock(`[]`)
-	baseClient.ClusterLogging = NewClusterLoggingOperationsMock(`[]`)
-	baseClient.ClusterTemplate = NewClusterTemplateOperationsMock(`[]`)
-	baseClient.ClusterTemplateRevision = NewClusterTemplateRevisionOperationsMock(`[]`)
-	baseClient.Setting = NewSettingOperationsMock("FAIL_BY_ID", nil)
-	baseClient.AuthConfig = NewAuthConfigOperationsMock(`[]`)
-	baseClient.User = NewUserOperationsMock(`[]`)
-	baseClient.NodeDriver = NewNodeDriverOperationsMock(`[]`)
-	baseClient.KontainerDriver = NewKontainerDriverOperationsMock(`[]`)
-	baseClient.MultiClusterApp = NewMultiClusterAppOperationsMock(`[]`)
-	baseClient.GlobalDnsProvider = NewGlobalDnsProviderOperationsMock(`[]`)
-	baseClient.GlobalDns = NewGlobalDnsOperationsMock(`[]`)
-	baseClient.Node = NewNodeOperationsMock(`[]`)
-	collectorOpts := &collector.CollectorOpts{baseClient}
+	collectorOpts := &collector.CollectorOpts{Client: NewBaseClientMock()}
 	record := &record.Record{}
 	collector.Register(&collector1)
 	collector.Register(&collector2)
 	collector.Register(&collector3)
 
-	collector.Run(record, collectorOpts)
+	collector.Run(context.Background(), record, collectorOpts)
 	// check that all collectors were called
 	assert.True(t, collector1.Collected)
 	assert.True(t, collector2.Collected)
@@ -177,3 +290,141 @@ func TestBaseCollectAll(t *testing.T) {
 	assert.Equal(t, "Collected"+collector3.Key, colectorResult3)
 
 }
+
+func TestBaseRunCollectorTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	slow := &BlockingCollectorMock{Key: "Slow", Release: release}
+	partial := &PartialCollectorMock{BlockingCollectorMock{Key: "Partial", Release: release}}
+	fast := &CollectorMock{Key: "Fast"}
+	collector.Register(slow)
+	collector.Register(partial)
+	collector.Register(fast)
+
+	collectorOpts := &collector.CollectorOpts{
+		Client:  NewBaseClientMock(),
+		Workers: 2,
+		Timeout: 50 * time.Millisecond,
+	}
+	record := &record.Record{}
+	collector.Run(context.Background(), record, collectorOpts)
+
+	slowResult, ok := (*record)[slow.Key]
+	assert.True(t, ok)
+	assert.Nil(t, slowResult)
+	assert.Equal(t, "Partial"+partial.Key, (*record)[partial.Key])
+	assert.True(t, fast.Collected)
+	assert.Equal(t, "Collected"+fast.Key, (*record)[fast.Key])
+
+	meta := (*record)[collector.MetaRecordKey].(collector.Meta)
+	assert.Equal(t, 0, meta.Collectors[slow.Key].Ok)
+	assert.Equal(t, collector.ErrorTimeout, meta.Collectors[slow.Key].Error)
+	assert.Equal(t, 0, meta.Collectors[partial.Key].Ok)
+	assert.Equal(t, collector.ErrorTimeout, meta.Collectors[partial.Key].Error)
+	assert.Equal(t, 1, meta.Collectors[fast.Key].Ok)
+	assert.Equal(t, "", meta.Collectors[fast.Key].Error)
+}
+
+func TestBaseRunCollectorTimeoutKeepsSlot(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	first := &BlockingCollectorMock{Key: fmt.Sprintf("Blocking_%d", rand.Int()), Release: release}
+	second := &BlockingCollectorMock{Key: fmt.Sprintf("Blocking_%d", rand.Int()), Release: release}
+	collector.Register(first)
+	collector.Register(second)
+
+	collectorOpts := &collector.CollectorOpts{
+		Client:     NewBaseClientMock(),
+		Workers:    1,
+		Timeout:    50 * time.Millisecond,
+		RunTimeout: 200 * time.Millisecond,
+		Collectors: []string{first.Key, second.Key},
+	}
+	record := &record.Record{}
+	collector.Run(context.Background(), record, collectorOpts)
+
+	// The one that got the slot still holds it past its deadline, so the
+	// other is skipped once the run is out of time.
+	meta := (*record)[collector.MetaRecordKey].(collector.Meta)
+	started := 0
+	for _, key := range []string{first.Key, second.Key} {
+		assert.Equal(t, collector.ErrorTimeout, meta.Collectors[key].Error)
+		if meta.Collectors[key].DurationMs > 0 {
+			started++
+		}
+	}
+	assert.Equal(t, 1, started)
+}
+
+func TestBaseRunEnabledCollectors(t *testing.T) {
+	enabled := &CollectorMock{Key: fmt.Sprintf("Enabled_%d", rand.Int())}
+	disabled := &CollectorMock{Key: fmt.Sprintf("Disabled_%d", rand.Int())}
+	collector.Register(enabled)
+	collector.Register(disabled)
+	assert.Contains(t, collector.RecordKeys(), enabled.Key)
+	assert.Contains(t, collector.RecordKeys(), disabled.Key)
+
+	collectorOpts := &collector.CollectorOpts{
+		Client:     NewBaseClientMock(),
+		Collectors: []string{enabled.Key},
+	}
+	record := &record.Record{}
+	collector.Run(context.Background(), record, collectorOpts)
+
+	assert.True(t, enabled.Collected)
+	assert.False(t, disabled.Collected)
+	_, ok := (*record)[disabled.Key]
+	assert.False(t, ok)
+	meta := (*record)[collector.MetaRecordKey].(collector.Meta)
+	assert.Equal(t, 1, len(meta.Collectors))
+}
+
+func TestBaseRunExcludedCollectors(t *testing.T) {
+	included := &CollectorMock{Key: fmt.Sprintf("Included_%d", rand.Int())}
+	excluded := &CollectorMock{Key: fmt.Sprintf("Excluded_%d", rand.Int())}
+	collector.Register(included)
+	collector.Register(excluded)
+
+	collectorOpts := &collector.CollectorOpts{
+		Client:            NewBaseClientMock(),
+		Collectors:        []string{included.Key, excluded.Key},
+		ExcludeCollectors: []string{excluded.Key},
+	}
+	record := &record.Record{}
+	collector.Run(context.Background(), record, collectorOpts)
+
+	assert.True(t, included.Collected)
+	assert.False(t, excluded.Collected)
+	_, ok := (*record)[excluded.Key]
+	assert.False(t, ok)
+
+	meta := (*record)[collector.MetaRecordKey].(collector.Meta)
+	assert.Equal(t, []string{included.Key}, meta.Enabled)
+	assert.Contains(t, meta.Disabled, excluded.Key)
+	assert.Contains(t, meta.Disabled, "install")
+}
+
+func TestBaseDescribe(t *testing.T) {
+	infos := map[string]collector.CollectorInfo{}
+	for _, info := range collector.Describe(&collector.CollectorOpts{ExcludeCollectors: []string{"project"}}) {
+		infos[info.Key] = info
+	}
+
+	assert.True(t, infos["cluster"].Enabled)
+	assert.NotEmpty(t, infos["cluster"].Description)
+	assert.False(t, infos["project"].Enabled)
+	assert.NotEmpty(t, infos["project"].Description)
+}
+
+func TestBaseResetClients(t *testing.T) {
+	testID := fmt.Sprintf("ID_%d", rand.Int())
+	collector.ClusterClients[testID] = &rancherCluster.Client{}
+	collector.ProjectClients[testID] = &rancherProject.Client{}
+
+	collector.ResetClients()
+
+	assert.Nil(t, collector.ClusterClients[testID])
+	assert.Nil(t, collector.ProjectClients[testID])
+}
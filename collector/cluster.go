@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
@@ -37,17 +38,23 @@ func (h Cluster) RecordKey() string {
 	return "cluster"
 }
 
+func (h Cluster) Description() string {
+	return "Clusters by driver, cloud provider and logging, with their capacity and usage"
+}
+
 func (h Cluster) Collect(c *CollectorOpts) interface{} {
-	nonRemoved := NonRemoved()
+	return h.CollectContext(context.Background(), c)
+}
 
+func (h Cluster) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
 	log.Debug("Collecting Clusters")
-	clusterList, err := c.Client.Cluster.ListAll(&nonRemoved)
-	if err != nil {
+	clusterList, err := c.source().Clusters()
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Clusters err=%s", err)
 		return nil
 	}
 
-	log.Debugf("  Found %d Clusters", len(clusterList.Data))
+	log.Debugf("  Found %d Clusters", len(clusterList))
 
 	h.Ns = &NsInfo{}
 	h.Cpu = &CpuInfo{}
@@ -62,7 +69,12 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 	var nsUtils []float64
 
 	// Clusters
-	for _, cluster := range clusterList.Data {
+	for i, cluster := range clusterList {
+		if ctx.Err() != nil {
+			log.Warnf("Stopped collecting Clusters after %d of %d err=%s", i, len(clusterList), ctx.Err())
+			break
+		}
+
 		var utilFloat float64
 		var util int
 
@@ -132,7 +144,7 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 			log.Errorf("Failed to get Cluster client err=%s", err)
 		} else {
 			nsCollection, err := clusterClient.Namespace.ListAll(nil)
-			if err != nil {
+			if c.Track(err) != nil {
 				log.Errorf("Failed to get Namespaces err=%s", err)
 			} else {
 				totalNs := len(nsCollection.Data)
@@ -160,10 +172,13 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 
 	// Cluster Logging
 	h.LogProviderCount = make(LabelCount)
+	if ctx.Err() != nil {
+		return h
+	}
 
-	logList, err := c.Client.ClusterLogging.ListAll(nil)
-	if err == nil {
-		for _, logging := range logList.Data {
+	logList, err := c.source().ClusterLoggings()
+	if c.Track(err) == nil {
+		for _, logging := range logList {
 			if logging.AppliedSpec != nil {
 				switch {
 				case logging.AppliedSpec.ElasticsearchConfig != nil:
@@ -219,7 +234,7 @@ func isK3sEmbedded(c *CollectorOpts, cluster rancher.Cluster) bool {
 		listOpts.Filters["name"] = k3sRancherDeploy
 		listOpts.Filters["namespaceId"] = k3sRancherDeployNs
 		projects, err := projectCli.Workload.List(&listOpts)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Debugf("Failed to get System project deployments err=%s", err)
 			return false
 		}
@@ -231,15 +246,12 @@ func isK3sEmbedded(c *CollectorOpts, cluster rancher.Cluster) bool {
 }
 
 func getClusterProjects(c *CollectorOpts, id string) ([]rancher.Project, error) {
-	listOpts := NonRemoved()
-	listOpts.Filters["clusterId"] = id
-
-	collection, err := c.Client.Project.List(&listOpts)
-	if err != nil {
+	projects, err := c.source().Projects(id)
+	if c.Track(err) != nil {
 		return nil, err
 	}
 
-	return collection.Data, nil
+	return projects, nil
 }
 
 func getClusterSystemProjectID(c *CollectorOpts, id string) (string, error) {
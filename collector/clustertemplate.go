@@ -14,25 +14,27 @@ func (ct ClusterTemplate) RecordKey() string {
 	return "clustertemplate"
 }
 
-func (ct ClusterTemplate) Collect(c *CollectorOpts) interface{} {
-	nonRemoved := NonRemoved()
+func (ct ClusterTemplate) Description() string {
+	return "Cluster templates, revisions and whether they are enforced"
+}
 
-	clusterTemplateList, err := c.Client.ClusterTemplate.ListAll(&nonRemoved)
-	if err != nil {
+func (ct ClusterTemplate) Collect(c *CollectorOpts) interface{} {
+	clusterTemplateList, err := c.source().ClusterTemplates()
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Clusters Templates err=%s", err)
 		return nil
 	}
-	ct.TotalClusterTemplates = len(clusterTemplateList.Data)
+	ct.TotalClusterTemplates = len(clusterTemplateList)
 
-	revisionsList, err := c.Client.ClusterTemplateRevision.ListAll(&nonRemoved)
-	if err != nil {
+	revisionsList, err := c.source().ClusterTemplateRevisions()
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Cluster Revisions err=%s", err)
 		return nil
 	}
-	ct.TotalTemplateRevisions = len(revisionsList.Data)
+	ct.TotalTemplateRevisions = len(revisionsList)
 
-	setting, err := c.Client.Setting.ByID("cluster-template-enforcement")
-	if err != nil {
+	setting, err := c.source().Setting("cluster-template-enforcement")
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get setting in Clusters Templates collect err=%s", err)
 		return nil
 	}
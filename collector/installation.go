@@ -34,11 +34,13 @@ func (i Installation) RecordKey() string {
 	return "install"
 }
 
+func (i Installation) Description() string {
+	return "Version, UI landing page, auth providers, users by provider and active drivers"
+}
+
 func (i Installation) Collect(c *CollectorOpts) interface{} {
 	log.Debug("Collecting Installation")
 
-	nonRemoved := NonRemoved()
-
 	i.GetUid(c)
 	i.GetVersion(c)
 	i.GetUILanding(c)
@@ -48,9 +50,9 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 	i.NodeDrivers = make(LabelCount)
 
 	log.Debug("  Collecting AuthConfigs")
-	configList, err := c.Client.AuthConfig.ListAll(&nonRemoved)
-	if err == nil {
-		for _, config := range configList.Data {
+	configList, err := c.source().AuthConfigs()
+	if c.Track(err) == nil {
+		for _, config := range configList {
 			if config.Enabled {
 				name := regexp.MustCompile("(?i)^(.*?)Config$").ReplaceAllString(config.Type, "$1")
 				i.AuthConfig.Increment(name)
@@ -61,9 +63,9 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 	}
 
 	log.Debug("  Collecting Users")
-	userList, err := c.Client.User.ListAll(&nonRemoved)
-	if err == nil {
-		for _, user := range userList.Data {
+	userList, err := c.source().Users()
+	if c.Track(err) == nil {
+		for _, user := range userList {
 			for _, principalID := range user.PrincipalIDs {
 				provider := strings.Split(principalID, "://")
 				if len(provider) > 1 {
@@ -76,9 +78,9 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 	}
 
 	log.Debug("  Collecting NodeDrivers")
-	nodeDriverList, err := c.Client.NodeDriver.ListAll(&nonRemoved)
-	if err == nil {
-		for _, driver := range nodeDriverList.Data {
+	nodeDriverList, err := c.source().NodeDrivers()
+	if c.Track(err) == nil {
+		for _, driver := range nodeDriverList {
 			if driver.Active {
 				i.NodeDrivers.Increment(driver.Name)
 				i.NodeDriverCount++
@@ -89,9 +91,9 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 	}
 
 	log.Debug("  Collecting KontainerDrivers")
-	kontainerDriverList, err := c.Client.KontainerDriver.ListAll(&nonRemoved)
-	if err == nil {
-		for _, driver := range kontainerDriverList.Data {
+	kontainerDriverList, err := c.source().KontainerDrivers()
+	if c.Track(err) == nil {
+		for _, driver := range kontainerDriverList {
 			if driver.Active {
 				i.KontainerDrivers.Increment(driver.Name)
 				i.KontainerDriverCount++
@@ -104,9 +106,9 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 	i.HasInternal = false
 
 	log.Debug("  Looking for Local cluser")
-	clusterList, err := c.Client.Cluster.ListAll(&nonRemoved)
-	if err == nil {
-		for _, cluster := range clusterList.Data {
+	clusterList, err := c.source().Clusters()
+	if c.Track(err) == nil {
+		for _, cluster := range clusterList {
 			if cluster.Internal {
 				i.HasInternal = true
 				break
@@ -120,8 +122,8 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 }
 
 func (i *Installation) GetUILanding(c *CollectorOpts) {
-	uiLanding, err := c.Client.Setting.ByID(UI_DEFAULT_LANDING_SETTING)
-	if err != nil {
+	uiLanding, err := c.source().Setting(UI_DEFAULT_LANDING_SETTING)
+	if c.Track(err) != nil {
 		if !IsNotFound(err) {
 			log.Errorf("Failed to get setting %s err=%s", UI_DEFAULT_LANDING_SETTING, err)
 		}
@@ -135,8 +137,8 @@ func (i *Installation) GetUILanding(c *CollectorOpts) {
 }
 
 func (i *Installation) GetVersion(c *CollectorOpts) {
-	version, err := c.Client.Setting.ByID(SERVER_VERSION_SETTING)
-	if err != nil {
+	version, err := c.source().Setting(SERVER_VERSION_SETTING)
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get setting %s err=%s", SERVER_VERSION_SETTING, err)
 	}
 	defer log.Debugf("  Installation Server Version: %s", i.Version)
@@ -149,8 +151,8 @@ func (i *Installation) GetVersion(c *CollectorOpts) {
 }
 
 func GetTelemetryUid(c *CollectorOpts) (string, bool) {
-	telemetryUid, err := c.Client.Setting.ByID(TELEMETRY_UID_SETTING)
-	if err != nil {
+	telemetryUid, err := c.source().Setting(TELEMETRY_UID_SETTING)
+	if c.Track(err) != nil {
 		if !IsNotFound(err) {
 			log.Errorf("Failed to get setting %s err=%s", TELEMETRY_UID_SETTING, err)
 			return "", false
@@ -165,7 +167,7 @@ func GetTelemetryUid(c *CollectorOpts) (string, bool) {
 
 	newuid, _ := uuid.NewV4()
 	uid = newuid.String()
-	err = SetSetting(c.Client, TELEMETRY_UID_SETTING, uid)
+	err = c.source().SetSetting(TELEMETRY_UID_SETTING, uid)
 	if err != nil {
 		log.Errorf("Error Setting generated Telemetry Uid: %s", err)
 		return "", false
@@ -0,0 +1,692 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	managementAPI     = "/apis/management.cattle.io/v3"
+	kubeListLimit     = 500
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kubeAPI sends requests to a Kubernetes style JSON API.
+type kubeAPI struct {
+	host   string
+	client *http.Client
+	// token returns the bearer token, read again on every request since
+	// service account tokens get rotated.
+	token    func() (string, error)
+	username string
+	password string
+}
+
+// kubeSource reads management objects as management.cattle.io custom
+// resources from the Kubernetes API of the cluster Rancher runs in, and
+// shapes them like the v3 API does.
+type kubeSource struct {
+	api *kubeAPI
+}
+
+// NewKubeSource returns a Source reading from the Kubernetes API described
+// by the kubeconfig file, or from the one the process runs in if empty.
+func NewKubeSource(kubeconfig string) (Source, error) {
+	if kubeconfig == "" {
+		return newInClusterSource()
+	}
+	return newKubeconfigSource(kubeconfig)
+}
+
+func newInClusterSource() (*kubeSource, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster, a kubeconfig is needed")
+	}
+
+	caData, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newKubeTLSConfig(caData, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenFile := filepath.Join(serviceAccountDir, "token")
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, err
+	}
+
+	return &kubeSource{
+		api: &kubeAPI{
+			host:   "https://" + net.JoinHostPort(host, port),
+			client: newKubeHTTPClient(tlsConfig),
+			token:  readTokenFile(tokenFile),
+		},
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Username              string      `yaml:"username"`
+			Password              string      `yaml:"password"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func newKubeconfigSource(path string) (*kubeSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse kubeconfig %s: %s", path, err)
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, ctx := range config.Contexts {
+		if ctx.Name == config.CurrentContext {
+			clusterName, userName = ctx.Context.Cluster, ctx.Context.User
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Context %q not found in kubeconfig %s", config.CurrentContext, path)
+	}
+
+	api := &kubeAPI{}
+	var (
+		caData   []byte
+		insecure bool
+	)
+	found = false
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		found = true
+		api.host = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		insecure = cluster.Cluster.InsecureSkipTLSVerify
+		caData, err = kubeconfigData(path, cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if !found || api.host == "" {
+		return nil, fmt.Errorf("Cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+
+	var certData, keyData []byte
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		if user.User.Exec != nil || user.User.AuthProvider != nil {
+			return nil, fmt.Errorf("User %q in kubeconfig %s uses an exec or auth-provider plugin, which is not supported", userName, path)
+		}
+		certData, err = kubeconfigData(path, user.User.ClientCertificateData, user.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err = kubeconfigData(path, user.User.ClientKeyData, user.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case user.User.Token != "":
+			token := user.User.Token
+			api.token = func() (string, error) { return token, nil }
+		case user.User.TokenFile != "":
+			api.token = readTokenFile(kubeconfigPath(path, user.User.TokenFile))
+		}
+		api.username = user.User.Username
+		api.password = user.User.Password
+		break
+	}
+
+	tlsConfig, err := newKubeTLSConfig(caData, insecure, certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+	api.client = newKubeHTTPClient(tlsConfig)
+
+	return &kubeSource{api: api}, nil
+}
+
+// kubeconfigData returns inline base64 data, or else the contents of file,
+// relative to the kubeconfig.
+func kubeconfigData(kubeconfig, data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(kubeconfigPath(kubeconfig, file))
+	}
+	return nil, nil
+}
+
+func kubeconfigPath(kubeconfig, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(filepath.Dir(kubeconfig), file)
+}
+
+func readTokenFile(path string) func() (string, error) {
+	return func() (string, error) {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
+
+func newKubeTLSConfig(caData []byte, insecure bool, certData, keyData []byte) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("No certificates found in the CA data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(certData) > 0 || len(keyData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newKubeHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// do sends a request to the Kubernetes API and decodes the response into
+// out. Failed requests return a *clientbase.APIError, like the v3 client.
+func (a *kubeAPI) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, a.host+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != nil {
+		token, err := a.token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &clientbase.APIError{
+			StatusCode: resp.StatusCode,
+			URL:        req.URL.String(),
+			Msg:        fmt.Sprintf("Bad response statusCode [%d]. Status [%s]. Body: [%s] from [%s]", resp.StatusCode, resp.Status, data, req.URL),
+			Status:     resp.Status,
+			Body:       string(data),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// resourcePath returns the API path of a resource, namespaced if namespace
+// is set.
+func resourcePath(resource, namespace string) string {
+	if namespace == "" {
+		return managementAPI + "/" + resource
+	}
+	return managementAPI + "/namespaces/" + url.PathEscape(namespace) + "/" + resource
+}
+
+// splitID splits a v3 API id into namespace and name.
+func splitID(id string) (string, string) {
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return "", id
+}
+
+type kubeObject = map[string]interface{}
+
+type kubeList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []kubeObject `json:"items"`
+}
+
+// list fetches all objects of resource, page by page, leaving out the ones
+// being removed, and stores them in the v3 API shape into out.
+func (s *kubeSource) list(resource, namespace string, fix func(obj, out kubeObject), out interface{}) error {
+	var objs []kubeObject
+	cont := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(kubeListLimit))
+		if cont != "" {
+			query.Set("continue", cont)
+		}
+
+		var page kubeList
+		err := s.api.do(http.MethodGet, resourcePath(resource, namespace)+"?"+query.Encode(), nil, &page)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			if beingRemoved(item) {
+				continue
+			}
+			objs = append(objs, normanObject(item, fix))
+		}
+
+		cont = page.Metadata.Continue
+		if cont == "" {
+			break
+		}
+	}
+
+	log.Debugf("  Listed %d %s from Kubernetes", len(objs), resource)
+	return convertObject(objs, out)
+}
+
+// get fetches the object of resource with the v3 API id and stores it in
+// the v3 API shape into out.
+func (s *kubeSource) get(resource, id string, fix func(obj, out kubeObject), out interface{}) error {
+	namespace, name := splitID(id)
+
+	var obj kubeObject
+	err := s.api.do(http.MethodGet, resourcePath(resource, namespace)+"/"+url.PathEscape(name), nil, &obj)
+	if err != nil {
+		return err
+	}
+
+	return convertObject(normanObject(obj, fix), out)
+}
+
+func convertObject(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func objectMeta(obj kubeObject) kubeObject {
+	meta, _ := obj["metadata"].(kubeObject)
+	return meta
+}
+
+func objectSection(obj kubeObject, name string) kubeObject {
+	section, _ := obj[name].(kubeObject)
+	return section
+}
+
+func beingRemoved(obj kubeObject) bool {
+	return objectMeta(obj)["deletionTimestamp"] != nil
+}
+
+// normanObject flattens a custom resource the way the v3 API presents it:
+// the fields of spec and status at the top, next to id, uuid, labels and
+// a name that prefers the display name.
+func normanObject(obj kubeObject, fix func(obj, out kubeObject)) kubeObject {
+	out := kubeObject{}
+	for k, v := range obj {
+		switch k {
+		case "apiVersion", "kind", "metadata", "spec", "status":
+		default:
+			out[k] = v
+		}
+	}
+	for _, section := range []string{"spec", "status"} {
+		for k, v := range objectSection(obj, section) {
+			out[k] = v
+		}
+	}
+
+	meta := objectMeta(obj)
+	name, _ := meta["name"].(string)
+	namespace, _ := meta["namespace"].(string)
+
+	out["id"] = name
+	if namespace != "" {
+		out["id"] = namespace + ":" + name
+	}
+	out["uuid"] = meta["uid"]
+	out["labels"] = meta["labels"]
+	out["annotations"] = meta["annotations"]
+	out["name"] = name
+	if displayName, _ := out["displayName"].(string); displayName != "" {
+		out["name"] = displayName
+	}
+	out["state"] = objectState(obj)
+
+	if fix != nil {
+		fix(obj, out)
+	}
+	return out
+}
+
+// objectState approximates the v3 API state from the Ready condition.
+func objectState(obj kubeObject) string {
+	if beingRemoved(obj) {
+		return "removing"
+	}
+
+	conditions, _ := objectSection(obj, "status")["conditions"].([]interface{})
+	for _, c := range conditions {
+		condition, _ := c.(kubeObject)
+		if condition["type"] != "Ready" {
+			continue
+		}
+		if condition["status"] == "True" {
+			return "active"
+		}
+		return "unavailable"
+	}
+
+	return "active"
+}
+
+// inCluster sets the cluster of objects living in the cluster's namespace.
+func inCluster(obj, out kubeObject) {
+	out["clusterId"] = objectMeta(obj)["namespace"]
+}
+
+func fixNode(obj, out kubeObject) {
+	inCluster(obj, out)
+
+	spec := objectSection(obj, "spec")
+	out["hostname"] = spec["requestedHostname"]
+	out["nodeTemplateId"] = spec["nodeTemplateName"]
+
+	internal, _ := objectSection(obj, "status")["internalNodeStatus"].(kubeObject)
+	if allocatable, ok := internal["allocatable"]; ok {
+		out["allocatable"] = allocatable
+	}
+
+	info, _ := internal["nodeInfo"].(kubeObject)
+	runtime, _ := info["containerRuntimeVersion"].(string)
+	out["info"] = kubeObject{
+		"os": kubeObject{
+			"kernelVersion":   info["kernelVersion"],
+			"operatingSystem": info["osImage"],
+			"dockerVersion":   strings.TrimPrefix(runtime, "docker://"),
+		},
+		"kubernetes": kubeObject{
+			"kubeletVersion":   info["kubeletVersion"],
+			"kubeProxyVersion": info["kubeProxyVersion"],
+		},
+	}
+}
+
+func fixMultiClusterApp(obj, out kubeObject) {
+	spec := objectSection(obj, "spec")
+	out["templateVersionId"] = spec["templateVersionName"]
+
+	targets, _ := spec["targets"].([]interface{})
+	fixed := make([]interface{}, 0, len(targets))
+	for _, t := range targets {
+		target, _ := t.(kubeObject)
+		fixed = append(fixed, kubeObject{
+			"projectId": target["projectName"],
+			"appId":     target["appName"],
+			"state":     target["state"],
+		})
+	}
+	out["targets"] = fixed
+}
+
+func (s *kubeSource) Clusters() ([]rancher.Cluster, error) {
+	var clusters []rancher.Cluster
+	err := s.list("clusters", "", nil, &clusters)
+	return clusters, err
+}
+
+func (s *kubeSource) Nodes() ([]rancher.Node, error) {
+	var nodes []rancher.Node
+	err := s.list("nodes", "", fixNode, &nodes)
+	return nodes, err
+}
+
+func (s *kubeSource) Projects(clusterID string) ([]rancher.Project, error) {
+	var projects []rancher.Project
+	err := s.list("projects", clusterID, inCluster, &projects)
+	return projects, err
+}
+
+func (s *kubeSource) Users() ([]rancher.User, error) {
+	var users []rancher.User
+	err := s.list("users", "", nil, &users)
+	return users, err
+}
+
+func (s *kubeSource) AuthConfigs() ([]rancher.AuthConfig, error) {
+	var configs []rancher.AuthConfig
+	err := s.list("authconfigs", "", nil, &configs)
+	return configs, err
+}
+
+func (s *kubeSource) NodeDrivers() ([]rancher.NodeDriver, error) {
+	var drivers []rancher.NodeDriver
+	err := s.list("nodedrivers", "", nil, &drivers)
+	return drivers, err
+}
+
+func (s *kubeSource) KontainerDrivers() ([]rancher.KontainerDriver, error) {
+	var drivers []rancher.KontainerDriver
+	err := s.list("kontainerdrivers", "", nil, &drivers)
+	return drivers, err
+}
+
+func (s *kubeSource) ClusterLoggings() ([]rancher.ClusterLogging, error) {
+	var loggings []rancher.ClusterLogging
+	err := s.list("clusterloggings", "", inCluster, &loggings)
+	return loggings, err
+}
+
+func (s *kubeSource) ClusterTemplates() ([]rancher.ClusterTemplate, error) {
+	var templates []rancher.ClusterTemplate
+	err := s.list("clustertemplates", "", nil, &templates)
+	return templates, err
+}
+
+func (s *kubeSource) ClusterTemplateRevisions() ([]rancher.ClusterTemplateRevision, error) {
+	var revisions []rancher.ClusterTemplateRevision
+	err := s.list("clustertemplaterevisions", "", nil, &revisions)
+	return revisions, err
+}
+
+func (s *kubeSource) MultiClusterApps() ([]rancher.MultiClusterApp, error) {
+	var apps []rancher.MultiClusterApp
+	err := s.list("multiclusterapps", "", fixMultiClusterApp, &apps)
+	return apps, err
+}
+
+func (s *kubeSource) GlobalDnsProviders() ([]rancher.GlobalDnsProvider, error) {
+	var providers []rancher.GlobalDnsProvider
+	err := s.list("globaldnsproviders", "", nil, &providers)
+	return providers, err
+}
+
+func (s *kubeSource) GlobalDnses() ([]rancher.GlobalDns, error) {
+	var entries []rancher.GlobalDns
+	err := s.list("globaldnses", "", nil, &entries)
+	return entries, err
+}
+
+func (s *kubeSource) Setting(name string) (*rancher.Setting, error) {
+	setting := &rancher.Setting{}
+	err := s.get("settings", name, nil, setting)
+	if err != nil {
+		return nil, err
+	}
+	return setting, nil
+}
+
+func (s *kubeSource) SetSetting(name, value string) error {
+	path := resourcePath("settings", "")
+
+	var setting kubeObject
+	err := s.api.do(http.MethodGet, path+"/"+url.PathEscape(name), nil, &setting)
+	if IsNotFound(err) {
+		err = s.api.do(http.MethodPost, path, kubeObject{
+			"apiVersion": "management.cattle.io/v3",
+			"kind":       "Setting",
+			"metadata":   kubeObject{"name": name},
+			"value":      value,
+		}, nil)
+		if err == nil {
+			log.Debugf("CreateSetting(%s,%s)", name, value)
+		} else {
+			log.Debugf("CreateSetting(%s,%s): Error: %s", name, value, err)
+		}
+		return err
+	}
+	if err != nil {
+		log.Debugf("Failed to get setting %s err=%s", name, err)
+		return err
+	}
+
+	setting["value"] = value
+	err = s.api.do(http.MethodPut, path+"/"+url.PathEscape(name), setting, nil)
+	if err == nil {
+		log.Debugf("UpdateSetting(%s,%s)", name, value)
+	} else {
+		log.Debugf("UpdateSetting(%s,%s): Error: %s", name, value, err)
+	}
+	return err
+}
+
+func (s *kubeSource) Catalog(name string) (*rancher.Catalog, error) {
+	catalog := &rancher.Catalog{}
+	err := s.get("catalogs", name, nil, catalog)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func (s *kubeSource) NodeTemplate(id string) (*rancher.NodeTemplate, error) {
+	template := &rancher.NodeTemplate{}
+	err := s.get("nodetemplates", id, nil, template)
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// TemplateVersion looks up a global catalog template version, or a cluster
+// or project catalog one for ids with a namespace.
+func (s *kubeSource) TemplateVersion(id string) (*rancher.TemplateVersion, error) {
+	resource := "templateversions"
+	if strings.Contains(id, ":") {
+		resource = "catalogtemplateversions"
+	}
+
+	version := &rancher.TemplateVersion{}
+	err := s.get(resource, id, nil, version)
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
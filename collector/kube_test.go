@@ -0,0 +1,261 @@
+package collector_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/collector"
+)
+
+const kubeconfigTemplate = `apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: local
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: local
+    user: admin
+users:
+- name: admin
+  user:
+    %s
+`
+
+func newTestKubeSource(t *testing.T, handler http.HandlerFunc, user string) collector.Source {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(kubeconfigTemplate, server.URL, user)), 0600)
+	assert.Nil(t, err)
+
+	source, err := collector.NewKubeSource(path)
+	assert.Nil(t, err)
+	return source
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestKubeSourceClustersPaginated(t *testing.T) {
+	var tokens []string
+	source := newTestKubeSource(t, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+		assert.Equal(t, "/apis/management.cattle.io/v3/clusters", req.URL.Path)
+		assert.Equal(t, "500", req.URL.Query().Get("limit"))
+		tokens = append(tokens, req.URL.Query().Get("continue"))
+
+		if req.URL.Query().Get("continue") == "" {
+			writeJSON(w, map[string]interface{}{
+				"metadata": map[string]interface{}{"continue": "page2"},
+				"items": []interface{}{
+					map[string]interface{}{
+						"metadata": map[string]interface{}{"name": "local", "uid": "uid-1"},
+						"spec":     map[string]interface{}{"displayName": "local", "internal": true},
+						"status": map[string]interface{}{
+							"driver":      "k3s",
+							"allocatable": map[string]interface{}{"cpu": "4", "memory": "8Gi", "pods": "110"},
+							"conditions": []interface{}{
+								map[string]interface{}{"type": "Ready", "status": "True"},
+							},
+						},
+					},
+				},
+			})
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"metadata": map[string]interface{}{},
+			"items": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "c-abcde"},
+					"spec":     map[string]interface{}{"displayName": "downstream"},
+					"status": map[string]interface{}{
+						"conditions": []interface{}{
+							map[string]interface{}{"type": "Ready", "status": "False"},
+						},
+					},
+				},
+				map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "c-gone", "deletionTimestamp": "2021-01-01T00:00:00Z"},
+				},
+			},
+		})
+	}, "token: secret")
+
+	clusters, err := source.Clusters()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "page2"}, tokens)
+	assert.Len(t, clusters, 2)
+
+	assert.Equal(t, "local", clusters[0].ID)
+	assert.Equal(t, "local", clusters[0].Name)
+	assert.Equal(t, "uid-1", clusters[0].UUID)
+	assert.Equal(t, "active", clusters[0].State)
+	assert.Equal(t, "k3s", clusters[0].Driver)
+	assert.True(t, clusters[0].Internal)
+	assert.Equal(t, "8Gi", clusters[0].Allocatable["memory"])
+
+	assert.Equal(t, "c-abcde", clusters[1].ID)
+	assert.Equal(t, "downstream", clusters[1].Name)
+	assert.Equal(t, "unavailable", clusters[1].State)
+}
+
+func TestKubeSourceNodes(t *testing.T) {
+	source := newTestKubeSource(t, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "m-1", "namespace": "c-abcde"},
+					"spec": map[string]interface{}{
+						"requestedHostname": "node1",
+						"nodeTemplateName":  "cattle-global-nt:nt-1",
+						"worker":            true,
+					},
+					"status": map[string]interface{}{
+						"requested": map[string]interface{}{"cpu": "500m"},
+						"internalNodeStatus": map[string]interface{}{
+							"allocatable": map[string]interface{}{"cpu": "2"},
+							"nodeInfo": map[string]interface{}{
+								"kernelVersion":           "5.4.0",
+								"osImage":                 "Ubuntu 20.04",
+								"containerRuntimeVersion": "docker://20.10.7",
+								"kubeletVersion":          "v1.20.9",
+								"kubeProxyVersion":        "v1.20.9",
+							},
+						},
+					},
+				},
+			},
+		})
+	}, "token: secret")
+
+	nodes, err := source.Nodes()
+	assert.Nil(t, err)
+	assert.Len(t, nodes, 1)
+
+	node := nodes[0]
+	assert.Equal(t, "c-abcde:m-1", node.ID)
+	assert.Equal(t, "c-abcde", node.ClusterID)
+	assert.Equal(t, "node1", node.Hostname)
+	assert.Equal(t, "cattle-global-nt:nt-1", node.NodeTemplateID)
+	assert.True(t, node.Worker)
+	assert.Equal(t, "2", node.Allocatable["cpu"])
+	assert.Equal(t, "500m", node.Requested["cpu"])
+	assert.Equal(t, "5.4.0", node.Info.OS.KernelVersion)
+	assert.Equal(t, "Ubuntu 20.04", node.Info.OS.OperatingSystem)
+	assert.Equal(t, "20.10.7", node.Info.OS.DockerVersion)
+	assert.Equal(t, "v1.20.9", node.Info.Kubernetes.KubeletVersion)
+}
+
+func TestKubeSourceProjectsOfCluster(t *testing.T) {
+	source := newTestKubeSource(t, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/apis/management.cattle.io/v3/namespaces/c-abcde/projects", req.URL.Path)
+		writeJSON(w, map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"name":      "p-1",
+						"namespace": "c-abcde",
+						"labels":    map[string]interface{}{"authz.management.cattle.io/system-project": "true"},
+					},
+					"spec": map[string]interface{}{"displayName": "System", "clusterName": "c-abcde"},
+				},
+			},
+		})
+	}, "token: secret")
+
+	projects, err := source.Projects("c-abcde")
+	assert.Nil(t, err)
+	assert.Len(t, projects, 1)
+	assert.Equal(t, "c-abcde:p-1", projects[0].ID)
+	assert.Equal(t, "System", projects[0].Name)
+	assert.Equal(t, "c-abcde", projects[0].ClusterID)
+	assert.Equal(t, "true", projects[0].Labels["authz.management.cattle.io/system-project"])
+}
+
+func TestKubeSourceSettings(t *testing.T) {
+	var put map[string]interface{}
+	source := newTestKubeSource(t, func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/apis/management.cattle.io/v3/settings/server-version":
+			writeJSON(w, map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "server-version"},
+				"value":    "v2.5.9",
+			})
+		case req.Method == http.MethodPut && req.URL.Path == "/apis/management.cattle.io/v3/settings/server-version":
+			body, _ := io.ReadAll(req.Body)
+			json.Unmarshal(body, &put)
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}, "token: secret")
+
+	setting, err := source.Setting("server-version")
+	assert.Nil(t, err)
+	assert.Equal(t, "v2.5.9", setting.Value)
+
+	_, err = source.Setting("telemetry-uid")
+	assert.True(t, collector.IsNotFound(err))
+
+	err = source.SetSetting("server-version", "v2.6.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "v2.6.0", put["value"])
+	assert.Equal(t, "server-version", put["metadata"].(map[string]interface{})["name"])
+}
+
+func TestKubeSourceRejectsExecPlugin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	user := "exec:\n      command: aws"
+	err := os.WriteFile(path, []byte(fmt.Sprintf(kubeconfigTemplate, "https://127.0.0.1:6443", user)), 0600)
+	assert.Nil(t, err)
+
+	_, err = collector.NewKubeSource(path)
+	assert.NotNil(t, err)
+}
+
+func TestKubeSourceRunsCollectors(t *testing.T) {
+	source := newTestKubeSource(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/apis/management.cattle.io/v3/clusters":
+			writeJSON(w, map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{
+						"metadata": map[string]interface{}{"name": "c-abcde"},
+						"status": map[string]interface{}{
+							"driver":      "rancherKubernetesEngine",
+							"allocatable": map[string]interface{}{"cpu": "4", "memory": "8Gi", "pods": "110"},
+							"requested":   map[string]interface{}{"cpu": "1", "memory": "1Gi", "pods": "10"},
+						},
+					},
+				},
+			})
+		default:
+			writeJSON(w, map[string]interface{}{"items": []interface{}{}})
+		}
+	}, "token: secret")
+
+	opt := &collector.CollectorOpts{
+		Source: source,
+	}
+	cluster := collector.Cluster{}.Collect(opt).(collector.Cluster)
+	assert.Equal(t, 1, cluster.Total)
+	assert.Equal(t, 1, cluster.Active)
+	assert.Equal(t, 1, cluster.Driver["rancherKubernetesEngine"])
+}
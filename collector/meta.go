@@ -0,0 +1,128 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/rancher/norman/clientbase"
+)
+
+// MetaRecordKey is the record section where Run reports how each collector
+// went, so a missing section can be told apart from a broken collector.
+const MetaRecordKey = "meta"
+
+const (
+	ErrorTimeout      = "timeout"
+	ErrorPanic        = "panic"
+	ErrorNoData       = "no_data"
+	ErrorUnauthorized = "unauthorized"
+	ErrorForbidden    = "forbidden"
+	ErrorNotFound     = "not_found"
+	ErrorClient       = "client_error"
+	ErrorServer       = "server_error"
+	ErrorNetwork      = "network"
+	ErrorOther        = "error"
+)
+
+type Meta struct {
+	Collectors map[string]*CollectorMeta `json:"collectors"`
+	// Enabled and Disabled are the record keys of the registered
+	// collectors, by whether the run was configured to execute them. The
+	// sections of disabled collectors are left out on purpose.
+	Enabled  []string `json:"enabled"`
+	Disabled []string `json:"disabled"`
+}
+
+type CollectorMeta struct {
+	DurationMs int64  `json:"duration_ms"`
+	Ok         int    `json:"ok"` // 1 if the collector returned a complete section
+	Error      string `json:"error,omitempty"`
+	ApiCalls   int    `json:"api_calls"`
+}
+
+// runStats is what a single collector run has tracked so far.
+type runStats struct {
+	mu        sync.Mutex
+	calls     int
+	lastError string
+}
+
+// Track counts an API call made by the running collector and remembers the
+// class of its error, if any, for the run metadata. Not found errors are
+// expected by several collectors and are only counted. It returns err
+// unchanged.
+func (c *CollectorOpts) Track(err error) error {
+	if c.stats == nil {
+		return err
+	}
+
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	c.stats.calls++
+	if err != nil && !IsNotFound(err) {
+		c.stats.lastError = ErrorClass(err)
+	}
+
+	return err
+}
+
+// fail marks the running collector as failed with the error class.
+func (c *CollectorOpts) fail(class string) {
+	if c.stats != nil {
+		c.stats.fail(class)
+	}
+}
+
+func (s *runStats) fail(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastError = class
+}
+
+func (s *runStats) snapshot() (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls, s.lastError
+}
+
+// ErrorClass maps err to one of a few fixed classes, so nothing from the
+// error message, like URLs or resource names, ends up in the record.
+func ErrorClass(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ErrorTimeout
+	}
+
+	var apiErr *clientbase.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == 401:
+			return ErrorUnauthorized
+		case apiErr.StatusCode == 403:
+			return ErrorForbidden
+		case apiErr.StatusCode == 404:
+			return ErrorNotFound
+		case apiErr.StatusCode >= 500:
+			return ErrorServer
+		case apiErr.StatusCode >= 400:
+			return ErrorClient
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return ErrorNetwork
+	}
+
+	return ErrorOther
+}
@@ -0,0 +1,105 @@
+package collector_test
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/rancher/norman/clientbase"
+	"github.com/rancher/telemetry/collector"
+	"github.com/rancher/telemetry/record"
+	"github.com/stretchr/testify/assert"
+)
+
+// TrackingCollectorMock makes one tracked API call per entry in Errors and
+// fails if any of them fails with anything but not found.
+type TrackingCollectorMock struct {
+	Key    string
+	Errors []error
+	Panic  bool
+}
+
+func (c *TrackingCollectorMock) RecordKey() string {
+	return c.Key
+}
+
+func (c *TrackingCollectorMock) Collect(opt *collector.CollectorOpts) interface{} {
+	if c.Panic {
+		panic("I'm a test")
+	}
+
+	failed := false
+	for _, err := range c.Errors {
+		if opt.Track(err) != nil && !collector.IsNotFound(err) {
+			failed = true
+		}
+	}
+
+	if failed {
+		return nil
+	}
+	return "Collected" + c.Key
+}
+
+func apiError(status int) error {
+	retErr := &clientbase.APIError{}
+	retErr.StatusCode = status
+	return retErr
+}
+
+func TestMetaErrorClass(t *testing.T) {
+	assert.Equal(t, collector.ErrorTimeout, collector.ErrorClass(context.DeadlineExceeded))
+	assert.Equal(t, collector.ErrorTimeout, collector.ErrorClass(fmt.Errorf("wrapped: %w", context.Canceled)))
+	assert.Equal(t, collector.ErrorUnauthorized, collector.ErrorClass(apiError(401)))
+	assert.Equal(t, collector.ErrorForbidden, collector.ErrorClass(apiError(403)))
+	assert.Equal(t, collector.ErrorNotFound, collector.ErrorClass(apiError(404)))
+	assert.Equal(t, collector.ErrorClient, collector.ErrorClass(apiError(422)))
+	assert.Equal(t, collector.ErrorServer, collector.ErrorClass(apiError(503)))
+	assert.Equal(t, collector.ErrorNetwork, collector.ErrorClass(&url.Error{Op: "Get", URL: "https://secret.example.com", Err: fmt.Errorf("connection refused")}))
+	assert.Equal(t, collector.ErrorOther, collector.ErrorClass(fmt.Errorf("https://secret.example.com went away")))
+}
+
+func TestMetaTrackWithoutRun(t *testing.T) {
+	opts := &collector.CollectorOpts{}
+	err := fmt.Errorf("ERROR: I'm a test")
+	assert.Equal(t, err, opts.Track(err))
+	assert.Nil(t, opts.Track(nil))
+}
+
+func TestMetaRun(t *testing.T) {
+	healthy := &TrackingCollectorMock{Key: "Healthy", Errors: []error{nil, apiError(404), nil}}
+	broken := &TrackingCollectorMock{Key: "Broken", Errors: []error{nil, apiError(403)}}
+	empty := &CollectorMock{Key: "Empty"}
+	panicking := &TrackingCollectorMock{Key: "Panicking", Panic: true}
+	collector.Register(healthy)
+	collector.Register(broken)
+	collector.Register(empty)
+	collector.Register(panicking)
+
+	record := &record.Record{}
+	collector.Run(context.Background(), record, &collector.CollectorOpts{Client: NewBaseClientMock()})
+
+	meta := (*record)[collector.MetaRecordKey].(collector.Meta)
+
+	assert.Equal(t, 1, meta.Collectors[healthy.Key].Ok)
+	assert.Equal(t, "", meta.Collectors[healthy.Key].Error)
+	assert.Equal(t, 3, meta.Collectors[healthy.Key].ApiCalls)
+
+	assert.Nil(t, (*record)[broken.Key])
+	assert.Equal(t, 0, meta.Collectors[broken.Key].Ok)
+	assert.Equal(t, collector.ErrorForbidden, meta.Collectors[broken.Key].Error)
+	assert.Equal(t, 2, meta.Collectors[broken.Key].ApiCalls)
+
+	assert.Equal(t, 1, meta.Collectors[empty.Key].Ok)
+	assert.Equal(t, 0, meta.Collectors[empty.Key].ApiCalls)
+
+	assert.Nil(t, (*record)[panicking.Key])
+	assert.Equal(t, 0, meta.Collectors[panicking.Key].Ok)
+	assert.Equal(t, collector.ErrorPanic, meta.Collectors[panicking.Key].Error)
+
+	installMeta, ok := meta.Collectors["install"]
+	assert.True(t, ok)
+	assert.Equal(t, 1, installMeta.Ok)
+	assert.True(t, installMeta.ApiCalls > 0)
+}
@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -23,13 +24,19 @@ func (mca MultiClusterApp) RecordKey() string {
 	return "mca"
 }
 
+func (mca MultiClusterApp) Description() string {
+	return "Multi-cluster apps, their targets and global DNS"
+}
+
 func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
-	nonRemoved := NonRemoved()
+	return mca.CollectContext(context.Background(), c)
+}
 
+func (mca MultiClusterApp) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
 	log.Debug("Collecting MultiClusterApps")
-	appList, err := c.Client.MultiClusterApp.ListAll(&nonRemoved)
-	if err == nil {
-		log.Debugf("  Found %d MultiClusterApps", len(appList.Data))
+	appList, err := c.source().MultiClusterApps()
+	if c.Track(err) == nil {
+		log.Debugf("  Found %d MultiClusterApps", len(appList))
 
 		var targetCounts []float64
 		mca.Catalogs = map[string]*AppTemplate{}
@@ -47,7 +54,12 @@ func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
 		}
 
 		// Clusters
-		for _, app := range appList.Data {
+		for i, app := range appList {
+			if ctx.Err() != nil {
+				log.Warnf("Stopped collecting MultiClusterApps after %d of %d err=%s", i, len(appList), ctx.Err())
+				break
+			}
+
 			mca.Total++
 			if app.State == "active" {
 				mca.Active++
@@ -60,8 +72,8 @@ func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
 			mca.TargetMax = Max(mca.TargetMax, targets)
 			targetCounts = append(targetCounts, float64(targets))
 
-			templateVersion, err := c.Client.TemplateVersion.ByID(app.TemplateVersionID)
-			if err != nil {
+			templateVersion, err := c.source().TemplateVersion(app.TemplateVersionID)
+			if c.Track(err) != nil {
 				continue
 			}
 			externalID, err := SplitMultiClusterAppExternalID(templateVersion.ExternalID)
@@ -84,20 +96,24 @@ func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
 		log.Errorf("Failed to get Apps err=%s", err)
 	}
 
+	if ctx.Err() != nil {
+		return mca
+	}
+
 	// Global DNS Providers (only with management cluster, so ignore errors)
 	log.Debug("  Collecting DNS Providers")
-	dnsList, err := c.Client.GlobalDnsProvider.ListAll(&nonRemoved)
-	if err == nil {
-		count := len(dnsList.Data)
+	dnsList, err := c.source().GlobalDnsProviders()
+	if c.Track(err) == nil {
+		count := len(dnsList)
 		log.Debugf("    Found %d DNS Providers", count)
 		mca.DnsProviders = count
 	}
 
 	// Global DNS Entries (only with management cluster, so ignore errors)
 	log.Debug("  Collecting DNS Entries")
-	entryList, err := c.Client.GlobalDns.ListAll(&nonRemoved)
-	if err == nil {
-		count := len(entryList.Data)
+	entryList, err := c.source().GlobalDnses()
+	if c.Track(err) == nil {
+		count := len(entryList)
 		log.Debugf("    Found %d DNS Entries", count)
 		mca.DnsEntries = count
 	}
@@ -1,6 +1,8 @@
 package collector
 
 import (
+	"context"
+
 	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
 	log "github.com/sirupsen/logrus"
 )
@@ -26,17 +28,23 @@ func (m Node) RecordKey() string {
 	return "node"
 }
 
+func (m Node) Description() string {
+	return "Nodes by OS, kernel, Docker, kubelet and kube-proxy version, with their capacity"
+}
+
 func (h Node) Collect(c *CollectorOpts) interface{} {
-	nonRemoved := NonRemoved()
+	return h.CollectContext(context.Background(), c)
+}
 
+func (h Node) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
 	log.Debug("Collecting Nodes")
-	nodeList, err := c.Client.Node.ListAll(&nonRemoved)
-	if err != nil {
+	nodeList, err := c.source().Nodes()
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Nodes err=%s", err)
 		return nil
 	}
 
-	log.Debugf("  Found %d Nodes", len(nodeList.Data))
+	log.Debugf("  Found %d Nodes", len(nodeList))
 
 	var cpuUtils []float64
 	var memUtils []float64
@@ -51,7 +59,12 @@ func (h Node) Collect(c *CollectorOpts) interface{} {
 	h.Role = make(LabelCount)
 
 	// Nodes
-	for _, node := range nodeList.Data {
+	for i, node := range nodeList {
+		if ctx.Err() != nil {
+			log.Warnf("Stopped collecting Nodes after %d of %d err=%s", i, len(nodeList), ctx.Err())
+			break
+		}
+
 		var utilFloat float64
 		var util int
 
@@ -129,8 +142,8 @@ func (h Node) Collect(c *CollectorOpts) interface{} {
 
 		// Driver
 		if len(node.NodeTemplateID) > 0 {
-			nodeTemplate, err := c.Client.NodeTemplate.ByID(node.NodeTemplateID)
-			if err != nil {
+			nodeTemplate, err := c.source().NodeTemplate(node.NodeTemplateID)
+			if c.Track(err) != nil {
 				if IsNotFound(err) {
 					log.Debugf("    nodeTemplate not found [%s]", node.NodeTemplateID)
 				} else {
@@ -0,0 +1,305 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ErrorPluginExit   = "plugin_exit"
+	ErrorPluginOutput = "plugin_output"
+
+	pluginPath            = "/usr/local/bin:/usr/bin:/bin"
+	pluginDescribeTimeout = 10 * time.Second
+	pluginMaxStderr       = 4096
+)
+
+var (
+	pluginKey = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+	// reservedKeys are the record keys that don't belong to a collector.
+	reservedKeys = map[string]bool{MetaRecordKey: true, "r": true, "ts": true}
+
+	pluginFieldTypes = map[string]bool{"string": true, "number": true, "boolean": true, "object": true, "array": true}
+
+	errOutputTooLarge = errors.New("Output too large")
+)
+
+// Plugin is a collector run as an external executable. It is asked to
+// "describe" itself once when loaded and to "collect" on every run, and
+// answers with JSON on stdout. It only sees the Rancher URL and token, no
+// other environment.
+type Plugin struct {
+	Key     string `json:"key"`
+	Summary string `json:"description,omitempty"`
+	// Fields declares the JSON type of each field of the output. Output
+	// with other fields or types is rejected. Anything goes if empty.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	path      string
+	timeout   time.Duration
+	maxOutput int
+}
+
+// LoadPlugins describes the executables in dir and returns them as
+// collectors. Executables that fail to describe themselves or whose key is
+// taken are left out.
+func LoadPlugins(dir string, timeout time.Duration, maxOutput int) ([]*Plugin, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+	for _, key := range RecordKeys() {
+		taken[key] = true
+	}
+
+	out := []*Plugin{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			log.Debugf("Skipping %s in the plugin directory, not an executable", entry.Name())
+			continue
+		}
+
+		p := &Plugin{
+			path:      filepath.Join(dir, entry.Name()),
+			timeout:   timeout,
+			maxOutput: maxOutput,
+		}
+		err = p.describe()
+		if err != nil {
+			log.Errorf("Skipping plugin %s: %s", entry.Name(), err)
+			continue
+		}
+		if taken[p.Key] || reservedKeys[p.Key] {
+			log.Errorf("Skipping plugin %s: key %q is already taken", entry.Name(), p.Key)
+			continue
+		}
+		taken[p.Key] = true
+
+		log.Infof("Loaded plugin %s for %s", entry.Name(), p.Key)
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+func (p *Plugin) describe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDescribeTimeout)
+	defer cancel()
+
+	data, err := p.run(ctx, "describe", nil)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(p)
+	if err != nil {
+		return fmt.Errorf("Invalid description: %s", err)
+	}
+
+	if !pluginKey.MatchString(p.Key) {
+		return fmt.Errorf("Invalid key %q, must match %s", p.Key, pluginKey)
+	}
+	for field, typ := range p.Fields {
+		if !pluginFieldTypes[typ] {
+			return fmt.Errorf("Invalid type %q for field %s", typ, field)
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) RecordKey() string {
+	return p.Key
+}
+
+func (p *Plugin) Description() string {
+	if p.Summary == "" {
+		return "Plugin " + filepath.Base(p.path)
+	}
+	return p.Summary + " (plugin " + filepath.Base(p.path) + ")"
+}
+
+func (p *Plugin) Collect(c *CollectorOpts) interface{} {
+	return p.CollectContext(context.Background(), c)
+}
+
+func (p *Plugin) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	log.Debugf("Collecting from plugin %s", p.Key)
+	data, err := p.run(ctx, "collect", c)
+	if err != nil {
+		log.Errorf("Plugin %s failed: %s", p.Key, err)
+		switch {
+		case ctx.Err() != nil:
+			c.fail(ErrorTimeout)
+		case errors.Is(err, errOutputTooLarge):
+			c.fail(ErrorPluginOutput)
+		default:
+			c.fail(ErrorPluginExit)
+		}
+		return nil
+	}
+
+	out, err := p.parse(data)
+	if err != nil {
+		log.Errorf("Plugin %s returned invalid output: %s", p.Key, err)
+		c.fail(ErrorPluginOutput)
+		return nil
+	}
+
+	return out
+}
+
+// parse checks the output is a JSON object matching the declared fields.
+func (p *Plugin) parse(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	out := map[string]interface{}{}
+	err := dec.Decode(&out)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("Trailing data after the JSON object")
+	}
+
+	if len(p.Fields) == 0 {
+		return out, nil
+	}
+
+	fields := make([]string, 0, len(out))
+	for field := range out {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		want, ok := p.Fields[field]
+		if !ok {
+			return nil, fmt.Errorf("Undeclared field %s", field)
+		}
+		if got := jsonType(out[field]); out[field] != nil && got != want {
+			return nil, fmt.Errorf("Field %s is a %s, declared as %s", field, got, want)
+		}
+	}
+
+	return out, nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
+
+// run executes the plugin with arg and returns its stdout.
+func (p *Plugin) run(ctx context.Context, arg string, c *CollectorOpts) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, p.path, arg)
+	cmd.Dir = filepath.Dir(p.path)
+	cmd.Env = p.env(c)
+
+	stdout := &limitedBuffer{max: p.maxOutput}
+	stderr := &limitedBuffer{max: pluginMaxStderr, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		log.Debugf("Plugin %s %s stderr: %s", filepath.Base(p.path), arg, stderr.String())
+	}
+	if stdout.overflow {
+		return nil, errOutputTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// env is the whole environment of the plugin: a fixed PATH, its key and how
+// to reach Rancher.
+func (p *Plugin) env(c *CollectorOpts) []string {
+	env := []string{
+		"PATH=" + pluginPath,
+		"TELEMETRY_PLUGIN_KEY=" + p.Key,
+	}
+
+	if c == nil || c.Client == nil || c.Client.Opts == nil {
+		return env
+	}
+
+	opts := c.Client.Opts
+	env = append(env, "CATTLE_URL="+opts.URL)
+	if opts.TokenKey != "" {
+		env = append(env, "CATTLE_TOKEN_KEY="+opts.TokenKey)
+	} else if opts.AccessKey != "" {
+		env = append(env, "CATTLE_TOKEN_KEY="+opts.AccessKey+":"+opts.SecretKey)
+	}
+	if opts.CACerts != "" {
+		env = append(env, "CATTLE_CA_CERTS="+opts.CACerts)
+	}
+	if opts.Insecure {
+		env = append(env, "CATTLE_INSECURE=true")
+	}
+
+	return env
+}
+
+// limitedBuffer keeps up to max bytes. Past that it fails the write, or
+// drops the rest if truncate is set.
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int
+	truncate bool
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if b.max > 0 && b.Len()+len(data) > b.max {
+		b.overflow = true
+		if !b.truncate {
+			return 0, errOutputTooLarge
+		}
+		b.Buffer.Write(data[:b.max-b.Len()])
+		return len(data), nil
+	}
+	return b.Buffer.Write(data)
+}
@@ -0,0 +1,117 @@
+package collector_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/collector"
+	"github.com/rancher/telemetry/record"
+)
+
+func writePlugin(t *testing.T, dir, name, describe, collect string) {
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = describe ]; then\n%s\nelse\n%s\nfi\n", describe, collect)
+	err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+	assert.Nil(t, err)
+}
+
+func runPlugin(t *testing.T, p *collector.Plugin) (interface{}, *collector.CollectorMeta) {
+	collector.Register(p)
+
+	client := &rancher.Client{}
+	client.Opts = &clientbase.ClientOpts{
+		URL:      "https://rancher.test/v3",
+		TokenKey: "token-abc:secret",
+	}
+	opt := &collector.CollectorOpts{
+		Client:     client,
+		Collectors: []string{p.RecordKey()},
+	}
+
+	r := &record.Record{}
+	collector.Run(context.Background(), r, opt)
+	meta := (*r)[collector.MetaRecordKey].(collector.Meta)
+	return (*r)[p.RecordKey()], meta.Collectors[p.RecordKey()]
+}
+
+func TestPluginCollects(t *testing.T) {
+	os.Setenv("TELEMETRY_PLUGIN_TEST_LEAK", "leaked")
+	defer os.Unsetenv("TELEMETRY_PLUGIN_TEST_LEAK")
+
+	key := fmt.Sprintf("plugin_%d", rand.Int())
+	dir := t.TempDir()
+	writePlugin(t, dir, "storage",
+		fmt.Sprintf(`echo '{"key":"%s","fields":{"url":"string","token":"string","leak":"string","volumes":"number"}}'`, key),
+		`echo "{\"url\":\"$CATTLE_URL\",\"token\":\"$CATTLE_TOKEN_KEY\",\"leak\":\"$TELEMETRY_PLUGIN_TEST_LEAK\",\"volumes\":3}"`)
+
+	plugins, err := collector.LoadPlugins(dir, time.Second, 1024)
+	assert.Nil(t, err)
+	assert.Len(t, plugins, 1)
+
+	out, meta := runPlugin(t, plugins[0])
+	data := out.(map[string]interface{})
+	assert.Equal(t, "https://rancher.test/v3", data["url"])
+	assert.Equal(t, "token-abc:secret", data["token"])
+	assert.Equal(t, "", data["leak"])
+	assert.Equal(t, "3", fmt.Sprint(data["volumes"]))
+	assert.Equal(t, 1, meta.Ok)
+}
+
+func TestPluginRejectsBadOutput(t *testing.T) {
+	dir := t.TempDir()
+	keys := map[string]string{}
+	for _, name := range []string{"garbage", "undeclared", "wrongtype", "huge", "fails", "slow"} {
+		keys[name] = fmt.Sprintf("plugin_%s_%d", name, rand.Int())
+	}
+
+	describe := func(name string) string {
+		return fmt.Sprintf(`echo '{"key":"%s","fields":{"total":"number"}}'`, keys[name])
+	}
+	writePlugin(t, dir, "garbage", describe("garbage"), `echo 'not json'`)
+	writePlugin(t, dir, "undeclared", describe("undeclared"), `echo '{"other":1}'`)
+	writePlugin(t, dir, "wrongtype", describe("wrongtype"), `echo '{"total":"1"}'`)
+	writePlugin(t, dir, "huge", describe("huge"), `head -c 4096 /dev/zero | tr '\0' 'x'`)
+	writePlugin(t, dir, "fails", describe("fails"), `exit 3`)
+	writePlugin(t, dir, "slow", describe("slow"), `exec sleep 5`)
+
+	plugins, err := collector.LoadPlugins(dir, 200*time.Millisecond, 1024)
+	assert.Nil(t, err)
+	assert.Len(t, plugins, 6)
+
+	expected := map[string]string{
+		keys["garbage"]:    collector.ErrorPluginOutput,
+		keys["undeclared"]: collector.ErrorPluginOutput,
+		keys["wrongtype"]:  collector.ErrorPluginOutput,
+		keys["huge"]:       collector.ErrorPluginOutput,
+		keys["fails"]:      collector.ErrorPluginExit,
+		keys["slow"]:       collector.ErrorTimeout,
+	}
+	for _, p := range plugins {
+		out, meta := runPlugin(t, p)
+		assert.Nil(t, out, p.Key)
+		assert.Equal(t, 0, meta.Ok, p.Key)
+		assert.Equal(t, expected[p.Key], meta.Error, p.Key)
+	}
+}
+
+func TestPluginSkipsInvalidPlugins(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "badkey", `echo '{"key":"Not Valid"}'`, `echo '{}'`)
+	writePlugin(t, dir, "taken", `echo '{"key":"cluster"}'`, `echo '{}'`)
+	writePlugin(t, dir, "reserved", `echo '{"key":"meta"}'`, `echo '{}'`)
+	writePlugin(t, dir, "badtype", `echo '{"key":"fine","fields":{"x":"date"}}'`, `echo '{}'`)
+	err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644)
+	assert.Nil(t, err)
+
+	plugins, err := collector.LoadPlugins(dir, time.Second, 1024)
+	assert.Nil(t, err)
+	assert.Len(t, plugins, 0)
+}
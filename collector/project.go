@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -31,21 +32,26 @@ func (p Project) RecordKey() string {
 	return "project"
 }
 
+func (p Project) Description() string {
+	return "Projects with their namespaces, workloads, pipelines, HPAs, pods and charts, read from each downstream cluster"
+}
+
 func (p Project) Collect(c *CollectorOpts) interface{} {
-	opts := NonRemoved()
-	opts.Filters["all"] = "true"
+	return p.CollectContext(context.Background(), c)
+}
 
+func (p Project) CollectContext(ctx context.Context, c *CollectorOpts) interface{} {
 	nonRemoved := NonRemoved()
 
 	log.Debug("Collecting Projects")
-	list, err := c.Client.Project.ListAll(&opts)
+	list, err := c.source().Projects("")
 
-	if err != nil {
+	if c.Track(err) != nil {
 		log.Errorf("Failed to get Projects err=%s", err)
 		return nil
 	}
 
-	total := len(list.Data)
+	total := len(list)
 	log.Debugf("  Found %d Projects", total)
 
 	p.LibraryCharts = make(LabelCount)
@@ -61,13 +67,18 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 
 	// Setup vars for catalogs
 	perClusterCatalogMap := make(map[string]bool)
-	rancherCatalog, err := c.Client.Catalog.ByID("library")
-	if err != nil || rancherCatalog.URL != rancherCatalogURL {
+	rancherCatalog, err := c.source().Catalog("library")
+	if c.Track(err) != nil || rancherCatalog.URL != rancherCatalogURL {
 		log.Error("Failed to find a valid rancher default catalog")
 		rancherCatalog = nil
 	}
 
-	for _, project := range list.Data {
+	for i, project := range list {
+		if ctx.Err() != nil {
+			log.Warnf("Stopped collecting Projects after %d of %d err=%s", i, total, ctx.Err())
+			break
+		}
+
 		parts := strings.SplitN(project.ID, ":", 2)
 		clusterID := parts[0]
 		clusterClient, err := ProjectGetClusterClient(c, clusterID)
@@ -79,7 +90,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 			nsFilter := NonRemoved()
 			nsFilter.Filters["projectId"] = project.ID
 			nsCollection, err := clusterClient.Namespace.ListAll(&nsFilter)
-			if err != nil {
+			if c.Track(err) != nil {
 				log.Errorf("Failed to get Namespaces for project %s err=%s", project.ID, err)
 			} else {
 				totalNs := len(nsCollection.Data)
@@ -99,7 +110,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		// Workload
 		log.Debugf("  Collecting Workloads")
 		wlCollection, err := projectClient.Workload.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get Workload for project %s err=%s", project.ID, err)
 		} else {
 			totalWl := len(wlCollection.Data)
@@ -111,7 +122,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		// Pipeline
 		log.Debugf("  Collecting Pipelines")
 		pipelineCollection, err := projectClient.Pipeline.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get Pipelines for project %s err=%s", project.ID, err)
 		} else {
 			p.Pipeline.TotalPipelines += len(pipelineCollection.Data)
@@ -121,7 +132,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		// Source provider
 		log.Debugf("  Collecting SourceCodeProviders")
 		sourceCollection, err := projectClient.SourceCodeProvider.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get SourceCodeProvider for project %s err=%s", project.ID, err)
 		} else {
 			p.Pipeline.Enabled = 1
@@ -134,7 +145,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		// HPA
 		log.Debugf("  Collecting HPAs")
 		hpaCollection, err := projectClient.HorizontalPodAutoscaler.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get HPA for project %s err=%s", project.ID, err)
 		} else {
 			totalHPAs := len(hpaCollection.Data)
@@ -146,7 +157,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		// Pod
 		log.Debugf("  Collecting Pods")
 		poCollection, err := projectClient.Pod.ListAll(&nonRemoved)
-		if err != nil {
+		if c.Track(err) != nil {
 			log.Errorf("Failed to get Pod for project %s err=%s", project.ID, err)
 		} else {
 			totalPo := len(poCollection.Data)
@@ -161,7 +172,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 			if rancherCatalog != nil {
 				log.Debugf("  Collecting Apps")
 				appsCollection, err := projectClient.App.ListAll(&nonRemoved)
-				if err != nil {
+				if c.Track(err) != nil {
 					log.Errorf("Failed to get Apps for project %s err=%s", project.ID, err)
 				} else {
 					for _, app := range appsCollection.Data {
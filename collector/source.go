@@ -0,0 +1,203 @@
+package collector
+
+import (
+	"errors"
+
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+)
+
+// ErrNoRancherAPI is returned for data only the Rancher API can provide,
+// like the contents of downstream clusters, when collecting without it.
+var ErrNoRancherAPI = errors.New("Not available without the Rancher API")
+
+// Source is where collectors get Rancher management objects from. Lists
+// leave out objects that are being removed. Errors for objects that don't
+// exist satisfy IsNotFound.
+type Source interface {
+	Clusters() ([]rancher.Cluster, error)
+	Nodes() ([]rancher.Node, error)
+	// Projects lists the projects of clusterID, or of all clusters if empty.
+	Projects(clusterID string) ([]rancher.Project, error)
+	Users() ([]rancher.User, error)
+	AuthConfigs() ([]rancher.AuthConfig, error)
+	NodeDrivers() ([]rancher.NodeDriver, error)
+	KontainerDrivers() ([]rancher.KontainerDriver, error)
+	ClusterLoggings() ([]rancher.ClusterLogging, error)
+	ClusterTemplates() ([]rancher.ClusterTemplate, error)
+	ClusterTemplateRevisions() ([]rancher.ClusterTemplateRevision, error)
+	MultiClusterApps() ([]rancher.MultiClusterApp, error)
+	GlobalDnsProviders() ([]rancher.GlobalDnsProvider, error)
+	GlobalDnses() ([]rancher.GlobalDns, error)
+
+	Setting(name string) (*rancher.Setting, error)
+	SetSetting(name, value string) error
+	Catalog(name string) (*rancher.Catalog, error)
+	NodeTemplate(id string) (*rancher.NodeTemplate, error)
+	TemplateVersion(id string) (*rancher.TemplateVersion, error)
+}
+
+// source returns the Source to collect from, the Rancher v3 API through
+// Client unless another one was set.
+func (c *CollectorOpts) source() Source {
+	if c.Source != nil {
+		return c.Source
+	}
+	return NewV3Source(c.Client)
+}
+
+// v3Source reads management objects through the Rancher v3 API.
+type v3Source struct {
+	client *rancher.Client
+}
+
+func NewV3Source(client *rancher.Client) Source {
+	return &v3Source{
+		client: client,
+	}
+}
+
+func (s *v3Source) Clusters() ([]rancher.Cluster, error) {
+	opts := NonRemoved()
+	list, err := s.client.Cluster.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) Nodes() ([]rancher.Node, error) {
+	opts := NonRemoved()
+	list, err := s.client.Node.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) Projects(clusterID string) ([]rancher.Project, error) {
+	opts := NonRemoved()
+	if clusterID == "" {
+		opts.Filters["all"] = "true"
+		list, err := s.client.Project.ListAll(&opts)
+		if err != nil {
+			return nil, err
+		}
+		return list.Data, nil
+	}
+
+	opts.Filters["clusterId"] = clusterID
+	list, err := s.client.Project.List(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) Users() ([]rancher.User, error) {
+	opts := NonRemoved()
+	list, err := s.client.User.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) AuthConfigs() ([]rancher.AuthConfig, error) {
+	opts := NonRemoved()
+	list, err := s.client.AuthConfig.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) NodeDrivers() ([]rancher.NodeDriver, error) {
+	opts := NonRemoved()
+	list, err := s.client.NodeDriver.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) KontainerDrivers() ([]rancher.KontainerDriver, error) {
+	opts := NonRemoved()
+	list, err := s.client.KontainerDriver.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) ClusterLoggings() ([]rancher.ClusterLogging, error) {
+	list, err := s.client.ClusterLogging.ListAll(nil)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) ClusterTemplates() ([]rancher.ClusterTemplate, error) {
+	opts := NonRemoved()
+	list, err := s.client.ClusterTemplate.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) ClusterTemplateRevisions() ([]rancher.ClusterTemplateRevision, error) {
+	opts := NonRemoved()
+	list, err := s.client.ClusterTemplateRevision.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) MultiClusterApps() ([]rancher.MultiClusterApp, error) {
+	opts := NonRemoved()
+	list, err := s.client.MultiClusterApp.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) GlobalDnsProviders() ([]rancher.GlobalDnsProvider, error) {
+	opts := NonRemoved()
+	list, err := s.client.GlobalDnsProvider.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) GlobalDnses() ([]rancher.GlobalDns, error) {
+	opts := NonRemoved()
+	list, err := s.client.GlobalDns.ListAll(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func (s *v3Source) Setting(name string) (*rancher.Setting, error) {
+	return s.client.Setting.ByID(name)
+}
+
+func (s *v3Source) SetSetting(name, value string) error {
+	return SetSetting(s.client, name, value)
+}
+
+func (s *v3Source) Catalog(name string) (*rancher.Catalog, error) {
+	return s.client.Catalog.ByID(name)
+}
+
+func (s *v3Source) NodeTemplate(id string) (*rancher.NodeTemplate, error) {
+	return s.client.NodeTemplate.ByID(id)
+}
+
+func (s *v3Source) TemplateVersion(id string) (*rancher.TemplateVersion, error) {
+	return s.client.TemplateVersion.ByID(id)
+}
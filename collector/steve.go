@@ -0,0 +1,483 @@
+package collector
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+	"github.com/rancher/norman/types"
+	rancherCluster "github.com/rancher/rancher/pkg/client/generated/cluster/v3"
+	rancherProject "github.com/rancher/rancher/pkg/client/generated/project/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways of reading data from downstream clusters, for CollectorOpts.Downstream.
+const (
+	DownstreamV3    = "v3"
+	DownstreamSteve = "steve"
+)
+
+const (
+	projectIDLabel      = "field.cattle.io/projectId"
+	projectIDAnnotation = "field.cattle.io/projectId"
+	localCluster        = "local"
+)
+
+// workloadTypes are the Steve types the v3 API presents as workloads, along
+// with their v3 workload type.
+var workloadTypes = []struct {
+	kind      string
+	steveType string
+}{
+	{"deployment", "apps.deployments"},
+	{"daemonSet", "apps.daemonsets"},
+	{"statefulSet", "apps.statefulsets"},
+	{"replicaSet", "apps.replicasets"},
+	{"replicationController", "replicationcontrollers"},
+	{"job", "batch.jobs"},
+	{"cronJob", "batch.cronjobs"},
+}
+
+// steveListTTL is how long a list of every object of a type in a cluster is
+// reused, so the projects of a cluster collected in one run share it.
+const steveListTTL = time.Minute
+
+var (
+	// steveRancher is the connection to Rancher shared by the Steve backed
+	// clients, and steveClusters their cluster APIs, guarded by clientsMu.
+	steveRancher  *kubeAPI
+	steveClusters = map[string]*steveAPI{}
+)
+
+// steveAPI lists the resources of one cluster through the Rancher Steve API.
+type steveAPI struct {
+	api  *kubeAPI
+	path string
+
+	mu    sync.Mutex
+	lists map[string]*steveList
+}
+
+// steveList is the objects of a type in every namespace of a cluster.
+type steveList struct {
+	mu      sync.Mutex
+	fetched time.Time
+	objs    []kubeObject
+}
+
+type steveCollection struct {
+	Data     []kubeObject `json:"data"`
+	Continue string       `json:"continue"`
+}
+
+// newSteveAPI returns the Steve API of cluster id, reached through the
+// Rancher server of the management client options. The clients of a
+// cluster share it. It must be called with clientsMu held.
+func newSteveAPI(opts *clientbase.ClientOpts, id string) (*steveAPI, error) {
+	if steveRancher == nil {
+		tlsConfig, err := newKubeTLSConfig([]byte(opts.CACerts), opts.Insecure, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		api := &kubeAPI{
+			host:   strings.TrimSuffix(strings.TrimSuffix(opts.URL, "/"), "/v3"),
+			client: newKubeHTTPClient(tlsConfig),
+		}
+		if opts.Timeout > 0 {
+			api.client.Timeout = opts.Timeout
+		}
+		if opts.TokenKey != "" {
+			token := opts.TokenKey
+			api.token = func() (string, error) { return token, nil }
+		} else {
+			api.username = opts.AccessKey
+			api.password = opts.SecretKey
+		}
+		steveRancher = api
+		steveClusters = map[string]*steveAPI{}
+	}
+
+	if cluster := steveClusters[id]; cluster != nil {
+		return cluster, nil
+	}
+
+	cluster := &steveAPI{
+		api:   steveRancher,
+		path:  "/k8s/clusters/" + url.PathEscape(id) + "/v1",
+		lists: map[string]*steveList{},
+	}
+	steveClusters[id] = cluster
+	return cluster, nil
+}
+
+// listAll fetches all objects of steveType in every namespace, or reuses
+// those fetched within steveListTTL.
+func (s *steveAPI) listAll(steveType string) ([]kubeObject, error) {
+	s.mu.Lock()
+	list := s.lists[steveType]
+	if list == nil {
+		list = &steveList{}
+		s.lists[steveType] = list
+	}
+	s.mu.Unlock()
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if time.Since(list.fetched) < steveListTTL {
+		return list.objs, nil
+	}
+
+	objs, err := s.list(steveType, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	list.objs = objs
+	list.fetched = time.Now()
+	return objs, nil
+}
+
+// list fetches all objects of steveType, in namespace if set, page by page,
+// leaving out the ones being removed.
+func (s *steveAPI) list(steveType, namespace string, query url.Values) ([]kubeObject, error) {
+	path := s.path + "/" + steveType
+	if namespace != "" {
+		path += "/" + url.PathEscape(namespace)
+	}
+
+	var objs []kubeObject
+	cont := ""
+	for {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("limit", strconv.Itoa(kubeListLimit))
+		if cont != "" {
+			q.Set("continue", cont)
+		}
+
+		var page steveCollection
+		err := s.api.do(http.MethodGet, path+"?"+q.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Data {
+			if !beingRemoved(item) {
+				objs = append(objs, item)
+			}
+		}
+
+		cont = page.Continue
+		if cont == "" {
+			break
+		}
+	}
+
+	log.Debugf("    Listed %d %s through Steve", len(objs), steveType)
+	return objs, nil
+}
+
+// steveObject picks the fields the v3 API has for every object.
+func steveObject(obj kubeObject) kubeObject {
+	meta := objectMeta(obj)
+	state, _ := meta["state"].(kubeObject)
+	return kubeObject{
+		"id":     obj["id"],
+		"name":   meta["name"],
+		"state":  state["name"],
+		"labels": meta["labels"],
+	}
+}
+
+func listFilter(opts *types.ListOpts, key string) string {
+	if opts == nil {
+		return ""
+	}
+	value, _ := opts.Filters[key].(string)
+	return value
+}
+
+func ownedObject(obj kubeObject) bool {
+	owners, _ := objectMeta(obj)["ownerReferences"].([]interface{})
+	return len(owners) > 0
+}
+
+// useSteveCluster switches the operations of a cluster client the
+// collectors use over to Steve. It must be called with clientsMu held.
+func useSteveCluster(opts *clientbase.ClientOpts, id string, cli *rancherCluster.Client) error {
+	api, err := newSteveAPI(opts, id)
+	if err != nil {
+		return err
+	}
+
+	cli.Namespace = &steveNamespaces{
+		NamespaceOperations: cli.Namespace,
+		cluster:             api,
+	}
+	return nil
+}
+
+// useSteveProject is useSteveCluster for project clients.
+func useSteveProject(opts *clientbase.ClientOpts, id string, cli *rancherProject.Client) error {
+	clusterID, _ := splitID(id)
+	cluster, err := newSteveAPI(opts, clusterID)
+	if err != nil {
+		return err
+	}
+	local, err := newSteveAPI(opts, localCluster)
+	if err != nil {
+		return err
+	}
+
+	project := &steveProject{
+		id:      id,
+		cluster: cluster,
+		local:   local,
+	}
+	cli.Workload = &steveWorkloads{WorkloadOperations: cli.Workload, project: project}
+	cli.Pod = &stevePods{PodOperations: cli.Pod, project: project}
+	cli.HorizontalPodAutoscaler = &steveHPAs{HorizontalPodAutoscalerOperations: cli.HorizontalPodAutoscaler, project: project}
+	cli.App = &steveApps{AppOperations: cli.App, project: project}
+	return nil
+}
+
+type steveNamespaces struct {
+	rancherCluster.NamespaceOperations
+	cluster *steveAPI
+}
+
+func (o *steveNamespaces) List(opts *types.ListOpts) (*rancherCluster.NamespaceCollection, error) {
+	return o.ListAll(opts)
+}
+
+func (o *steveNamespaces) ListAll(opts *types.ListOpts) (*rancherCluster.NamespaceCollection, error) {
+	query := url.Values{}
+	if projectID := listFilter(opts, "projectId"); projectID != "" {
+		_, name := splitID(projectID)
+		query.Set("labelSelector", projectIDLabel+"="+name)
+	}
+
+	objs, err := o.cluster.list("namespaces", "", query)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []kubeObject{}
+	for _, obj := range objs {
+		out := steveObject(obj)
+		annotations, _ := objectMeta(obj)["annotations"].(kubeObject)
+		out["projectId"] = annotations[projectIDAnnotation]
+		namespaces = append(namespaces, out)
+	}
+
+	collection := &rancherCluster.NamespaceCollection{}
+	return collection, convertObject(namespaces, &collection.Data)
+}
+
+// steveProject lists the resources in the namespaces of a project.
+type steveProject struct {
+	id      string
+	cluster *steveAPI
+	local   *steveAPI
+}
+
+func (p *steveProject) namespaces(opts *types.ListOpts) ([]string, error) {
+	if namespace := listFilter(opts, "namespaceId"); namespace != "" {
+		return []string{namespace}, nil
+	}
+
+	_, name := splitID(p.id)
+	query := url.Values{}
+	query.Set("labelSelector", projectIDLabel+"="+name)
+	objs, err := p.cluster.list("namespaces", "", query)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, obj := range objs {
+		if name, _ := objectMeta(obj)["name"].(string); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+// list fetches the objects of steveType in the project, with the v3 name
+// filter applied.
+func (p *steveProject) list(steveType string, opts *types.ListOpts) ([]kubeObject, error) {
+	namespaces, err := p.namespaces(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.listIn(steveType, namespaces, listFilter(opts, "name"))
+}
+
+// listIn fetches the objects of steveType in namespaces, only the ones
+// called name if set. A single namespace is listed on its own, more are
+// picked from the objects of the whole cluster, listed once for all its
+// projects.
+func (p *steveProject) listIn(steveType string, namespaces []string, name string) ([]kubeObject, error) {
+	var objs []kubeObject
+	var err error
+	switch len(namespaces) {
+	case 0:
+		return []kubeObject{}, nil
+	case 1:
+		objs, err = p.cluster.list(steveType, namespaces[0], nil)
+	default:
+		objs, err = p.cluster.listAll(steveType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inProject := map[string]bool{}
+	for _, namespace := range namespaces {
+		inProject[namespace] = true
+	}
+
+	out := []kubeObject{}
+	for _, obj := range objs {
+		meta := objectMeta(obj)
+		namespace, _ := meta["namespace"].(string)
+		if len(namespaces) > 1 && !inProject[namespace] {
+			continue
+		}
+		if name == "" || meta["name"] == name {
+			out = append(out, obj)
+		}
+	}
+	return out, nil
+}
+
+type steveWorkloads struct {
+	rancherProject.WorkloadOperations
+	project *steveProject
+}
+
+func (o *steveWorkloads) List(opts *types.ListOpts) (*rancherProject.WorkloadCollection, error) {
+	return o.ListAll(opts)
+}
+
+// ListAll lists the workloads of every type, leaving out the ones managed
+// by another workload, like the v3 API does.
+func (o *steveWorkloads) ListAll(opts *types.ListOpts) (*rancherProject.WorkloadCollection, error) {
+	namespaces, err := o.project.namespaces(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := []kubeObject{}
+	for _, workloadType := range workloadTypes {
+		objs, err := o.project.listIn(workloadType.steveType, namespaces, listFilter(opts, "name"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			if ownedObject(obj) {
+				continue
+			}
+			meta := objectMeta(obj)
+			namespace, _ := meta["namespace"].(string)
+			name, _ := meta["name"].(string)
+			out := steveObject(obj)
+			out["id"] = workloadType.kind + ":" + namespace + ":" + name
+			out["namespaceId"] = namespace
+			workloads = append(workloads, out)
+		}
+	}
+
+	collection := &rancherProject.WorkloadCollection{}
+	return collection, convertObject(workloads, &collection.Data)
+}
+
+type stevePods struct {
+	rancherProject.PodOperations
+	project *steveProject
+}
+
+func (o *stevePods) List(opts *types.ListOpts) (*rancherProject.PodCollection, error) {
+	return o.ListAll(opts)
+}
+
+func (o *stevePods) ListAll(opts *types.ListOpts) (*rancherProject.PodCollection, error) {
+	objs, err := o.project.list("pods", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []kubeObject{}
+	for _, obj := range objs {
+		pods = append(pods, steveObject(obj))
+	}
+
+	collection := &rancherProject.PodCollection{}
+	return collection, convertObject(pods, &collection.Data)
+}
+
+type steveHPAs struct {
+	rancherProject.HorizontalPodAutoscalerOperations
+	project *steveProject
+}
+
+func (o *steveHPAs) List(opts *types.ListOpts) (*rancherProject.HorizontalPodAutoscalerCollection, error) {
+	return o.ListAll(opts)
+}
+
+func (o *steveHPAs) ListAll(opts *types.ListOpts) (*rancherProject.HorizontalPodAutoscalerCollection, error) {
+	objs, err := o.project.list("autoscaling.horizontalpodautoscalers", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hpas := []kubeObject{}
+	for _, obj := range objs {
+		hpas = append(hpas, steveObject(obj))
+	}
+
+	collection := &rancherProject.HorizontalPodAutoscalerCollection{}
+	return collection, convertObject(hpas, &collection.Data)
+}
+
+// steveApps lists the catalog apps of a project, which live in the project
+// namespace of the local cluster.
+type steveApps struct {
+	rancherProject.AppOperations
+	project *steveProject
+}
+
+func (o *steveApps) List(opts *types.ListOpts) (*rancherProject.AppCollection, error) {
+	return o.ListAll(opts)
+}
+
+func (o *steveApps) ListAll(opts *types.ListOpts) (*rancherProject.AppCollection, error) {
+	_, namespace := splitID(o.project.id)
+	objs, err := o.project.local.list("project.cattle.io.apps", namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	name := listFilter(opts, "name")
+	apps := []kubeObject{}
+	for _, obj := range objs {
+		if name != "" && objectMeta(obj)["name"] != name {
+			continue
+		}
+		out := steveObject(obj)
+		out["externalId"] = objectSection(obj, "spec")["externalId"]
+		apps = append(apps, out)
+	}
+
+	collection := &rancherProject.AppCollection{}
+	return collection, convertObject(apps, &collection.Data)
+}
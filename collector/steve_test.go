@@ -0,0 +1,228 @@
+package collector_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rancher/norman/clientbase"
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/collector"
+)
+
+func steveItem(id, namespace, name string, extra map[string]interface{}) map[string]interface{} {
+	meta := map[string]interface{}{
+		"name":  name,
+		"state": map[string]interface{}{"name": "active"},
+	}
+	if namespace != "" {
+		meta["namespace"] = namespace
+	}
+	item := map[string]interface{}{"id": id, "metadata": meta}
+	for k, v := range extra {
+		if k == "metadata" {
+			for mk, mv := range v.(map[string]interface{}) {
+				meta[mk] = mv
+			}
+			continue
+		}
+		item[k] = v
+	}
+	return item
+}
+
+// steveRequests counts the requests to each path of a Steve server.
+type steveRequests struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *steveRequests) add(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[path]++
+}
+
+func (r *steveRequests) count(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[path]
+}
+
+func newSteveServer(t *testing.T) (*httptest.Server, *steveRequests) {
+	requests := &steveRequests{counts: map[string]int{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Bearer token-abc:secret", req.Header.Get("Authorization"))
+		requests.add(req.URL.Path)
+		query := req.URL.Query()
+
+		switch req.URL.Path {
+		case "/k8s/clusters/c-steve/v1/namespaces":
+			if query.Get("labelSelector") == "field.cattle.io/projectId=p-two" {
+				writeJSON(w, map[string]interface{}{
+					"data": []interface{}{
+						steveItem("other", "", "other", nil),
+						steveItem("spare", "", "spare", nil),
+					},
+				})
+				return
+			}
+			if query.Get("labelSelector") != "" {
+				assert.Equal(t, "field.cattle.io/projectId=p-one", query.Get("labelSelector"))
+			}
+			if query.Get("continue") == "" {
+				writeJSON(w, map[string]interface{}{
+					"continue": "next",
+					"data": []interface{}{
+						steveItem("default", "", "default", map[string]interface{}{
+							"metadata": map[string]interface{}{
+								"annotations": map[string]interface{}{"field.cattle.io/projectId": "c-steve:p-one"},
+							},
+						}),
+					},
+				})
+				return
+			}
+			assert.Equal(t, "next", query.Get("continue"))
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{
+					steveItem("web", "", "web", map[string]interface{}{
+						"metadata": map[string]interface{}{
+							"annotations": map[string]interface{}{"field.cattle.io/projectId": "c-steve:p-one"},
+						},
+					}),
+				},
+			})
+		case "/k8s/clusters/c-steve/v1/apps.deployments":
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{
+					steveItem("web/frontend", "web", "frontend", nil),
+					steveItem("other/backend", "other", "backend", nil),
+				},
+			})
+		case "/k8s/clusters/c-steve/v1/apps.deployments/web":
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{steveItem("web/frontend", "web", "frontend", nil)},
+			})
+		case "/k8s/clusters/c-steve/v1/apps.replicasets", "/k8s/clusters/c-steve/v1/apps.replicasets/web":
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{
+					steveItem("web/frontend-5d9f", "web", "frontend-5d9f", map[string]interface{}{
+						"metadata": map[string]interface{}{
+							"ownerReferences": []interface{}{map[string]interface{}{"kind": "Deployment", "name": "frontend"}},
+						},
+					}),
+				},
+			})
+		case "/k8s/clusters/c-steve/v1/pods":
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{
+					steveItem("default/pod", "default", "pod", nil),
+					steveItem("web/pod", "web", "pod", nil),
+					steveItem("other/pod", "other", "pod", nil),
+				},
+			})
+		case "/k8s/clusters/local/v1/project.cattle.io.apps/p-one":
+			writeJSON(w, map[string]interface{}{
+				"data": []interface{}{
+					steveItem("p-one/wordpress", "p-one", "wordpress", map[string]interface{}{
+						"spec": map[string]interface{}{"externalId": "catalog://?catalog=library&template=wordpress&version=1.0.0"},
+					}),
+				},
+			})
+		default:
+			writeJSON(w, map[string]interface{}{"data": []interface{}{}})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newSteveOpts(url string) *collector.CollectorOpts {
+	client := &rancher.Client{}
+	client.Opts = &clientbase.ClientOpts{
+		URL:      url + "/v3",
+		TokenKey: "token-abc:secret",
+	}
+	return &collector.CollectorOpts{
+		Client:     client,
+		Downstream: collector.DownstreamSteve,
+	}
+}
+
+func TestSteveNamespaces(t *testing.T) {
+	collector.ResetClients()
+	defer collector.ResetClients()
+
+	server, _ := newSteveServer(t)
+	opt := newSteveOpts(server.URL)
+	clusterClient, err := collector.GetClusterClient(opt, "c-steve")
+	assert.Nil(t, err)
+
+	namespaces, err := clusterClient.Namespace.ListAll(nil)
+	assert.Nil(t, err)
+	assert.Len(t, namespaces.Data, 2)
+	assert.Equal(t, "default", namespaces.Data[0].Name)
+	assert.Equal(t, "c-steve:p-one", namespaces.Data[0].ProjectID)
+	assert.Equal(t, "active", namespaces.Data[0].State)
+	assert.Equal(t, "web", namespaces.Data[1].Name)
+}
+
+func TestSteveProjectResources(t *testing.T) {
+	collector.ResetClients()
+	defer collector.ResetClients()
+
+	server, requests := newSteveServer(t)
+	opt := newSteveOpts(server.URL)
+	projectClient, err := collector.GetProjectClient(opt, "c-steve:p-one")
+	assert.Nil(t, err)
+
+	nonRemoved := collector.NonRemoved()
+	workloads, err := projectClient.Workload.ListAll(&nonRemoved)
+	assert.Nil(t, err)
+	assert.Len(t, workloads.Data, 1)
+	assert.Equal(t, "deployment:web:frontend", workloads.Data[0].ID)
+	assert.Equal(t, "web", workloads.Data[0].NamespaceId)
+
+	pods, err := projectClient.Pod.ListAll(&nonRemoved)
+	assert.Nil(t, err)
+	assert.Len(t, pods.Data, 2)
+
+	// The other projects of the cluster reuse the list of its pods.
+	otherClient, err := collector.GetProjectClient(opt, "c-steve:p-two")
+	assert.Nil(t, err)
+	pods, err = otherClient.Pod.ListAll(&nonRemoved)
+	assert.Nil(t, err)
+	assert.Len(t, pods.Data, 1)
+	assert.Equal(t, 1, requests.count("/k8s/clusters/c-steve/v1/pods"))
+
+	hpas, err := projectClient.HorizontalPodAutoscaler.ListAll(&nonRemoved)
+	assert.Nil(t, err)
+	assert.Len(t, hpas.Data, 0)
+
+	apps, err := projectClient.App.ListAll(&nonRemoved)
+	assert.Nil(t, err)
+	assert.Len(t, apps.Data, 1)
+	assert.Equal(t, "wordpress", apps.Data[0].Name)
+	assert.Equal(t, "catalog://?catalog=library&template=wordpress&version=1.0.0", apps.Data[0].ExternalID)
+}
+
+func TestSteveWorkloadFilters(t *testing.T) {
+	collector.ResetClients()
+	defer collector.ResetClients()
+
+	server, _ := newSteveServer(t)
+	opt := newSteveOpts(server.URL)
+	projectClient, err := collector.GetProjectClient(opt, "c-steve:p-one")
+	assert.Nil(t, err)
+
+	listOpts := collector.NonRemoved()
+	listOpts.Filters["name"] = "rancher"
+	listOpts.Filters["namespaceId"] = "web"
+	workloads, err := projectClient.Workload.List(&listOpts)
+	assert.Nil(t, err)
+	assert.Len(t, workloads.Data, 0)
+}
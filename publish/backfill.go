@@ -0,0 +1,101 @@
+package publish
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RecordDocMigration is the migration adding record.doc, after which the
+// records stored before need a backfill.
+const RecordDocMigration = 6
+
+// docsCheckInterval is how often queries check again whether every record
+// has its jsonb doc, while some don't.
+const docsCheckInterval = time.Minute
+
+// docs tracks whether the backfill of record.doc is done, so queries can
+// read it directly instead of falling back to data.
+type docs struct {
+	mu      sync.Mutex
+	ready   bool
+	checked time.Time
+}
+
+// recordDoc is the SQL expression for the data of record r as jsonb.
+// Until every record has its doc, records without one are cast from data.
+func (p *Postgres) recordDoc() string {
+	if p.docsReady() {
+		return "r.doc"
+	}
+	return "coalesce(r.doc, r.data::jsonb)"
+}
+
+func (p *Postgres) docsReady() bool {
+	p.docs.mu.Lock()
+	defer p.docs.mu.Unlock()
+
+	if p.docs.ready || time.Since(p.docs.checked) < docsCheckInterval {
+		return p.docs.ready
+	}
+	p.docs.checked = time.Now()
+
+	missing, err := p.missingDocs()
+	if err != nil {
+		log.Errorf("Error checking for records without a jsonb doc: %s", err)
+		return false
+	}
+	p.docs.ready = !missing
+	return p.docs.ready
+}
+
+func (p *Postgres) missingDocs() (bool, error) {
+	var missing bool
+	err := p.Conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM record WHERE doc IS NULL AND data IS NOT NULL)`).Scan(&missing)
+	return missing, err
+}
+
+// BackfillDocs fills in the jsonb doc of records stored before it existed,
+// batch records at a time, with a pause in between so it can run next to a
+// live server. It stops early when stop is closed, and returns how many
+// records it filled in.
+func (p *Postgres) BackfillDocs(batch int, pause time.Duration, stop <-chan struct{}) (int, error) {
+	total := 0
+	for {
+		res, err := p.Conn.Exec(`UPDATE record SET doc = data::jsonb
+WHERE id IN (
+	SELECT id FROM record
+	WHERE doc IS NULL AND data IS NOT NULL
+	ORDER BY id
+	LIMIT $1
+)`, batch)
+		if err != nil {
+			return total, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += int(n)
+
+		if n == 0 {
+			p.docs.mu.Lock()
+			p.docs.ready = true
+			p.docs.mu.Unlock()
+
+			if total > 0 {
+				log.Infof("Filled in the jsonb doc of %d records", total)
+			}
+			return total, nil
+		}
+		log.Debugf("Filled in the jsonb doc of %d records so far", total)
+
+		select {
+		case <-stop:
+			return total, nil
+		case <-time.After(pause):
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package publish
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DenyUid  = "uid"
+	DenyCidr = "cidr"
+)
+
+// ErrNotDenied is returned for denylist entries that don't exist.
+var ErrNotDenied = errors.New("No such denylist entry")
+
+// DenyEntry is a uid or a CIDR whose records the server refuses.
+type DenyEntry struct {
+	Id      int       `json:"id"`
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Normalize checks the entry and puts its value in canonical form, lower
+// case uids and CIDRs of their network address. A bare IP is a CIDR of
+// that single address.
+func (e *DenyEntry) Normalize() error {
+	switch e.Kind {
+	case DenyUid:
+		e.Value = strings.ToLower(strings.TrimSpace(e.Value))
+		if e.Value == "" {
+			return errors.New("uid is required")
+		}
+	case DenyCidr:
+		value := strings.TrimSpace(e.Value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("Invalid CIDR %q", e.Value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("Invalid CIDR %q", e.Value)
+		}
+		e.Value = network.String()
+	default:
+		return fmt.Errorf("Kind must be %s or %s", DenyUid, DenyCidr)
+	}
+	return nil
+}
+
+// Denylist matches uids and IPs against the denylist entries.
+type Denylist struct {
+	mu   sync.RWMutex
+	uids map[string]bool
+	nets []*net.IPNet
+}
+
+func NewDenylist() *Denylist {
+	return &Denylist{uids: map[string]bool{}}
+}
+
+// Set replaces the entries matched against.
+func (d *Denylist) Set(entries []DenyEntry) {
+	uids := map[string]bool{}
+	nets := []*net.IPNet{}
+	for _, entry := range entries {
+		switch entry.Kind {
+		case DenyUid:
+			uids[strings.ToLower(entry.Value)] = true
+		case DenyCidr:
+			_, network, err := net.ParseCIDR(entry.Value)
+			if err != nil {
+				log.Warnf("Ignoring denylist entry %d: %s", entry.Id, err)
+				continue
+			}
+			nets = append(nets, network)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.uids = uids
+	d.nets = nets
+}
+
+// DeniesUid tells whether records of installation uid are refused.
+func (d *Denylist) DeniesUid(uid string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.uids[strings.ToLower(uid)]
+}
+
+// DeniesIp tells whether records from ip are refused.
+func (d *Denylist) DeniesIp(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, network := range d.nets {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedIp is the client address in X-Forwarded-For header values, the
+// last hop, which the proxy in front of the server appended. The hops
+// before it are whatever the client sent. It returns "" if the last hop
+// isn't an IP.
+func ForwardedIp(values []string) string {
+	hops := strings.Split(strings.Join(values, ","), ",")
+	ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// GetDenylist returns every denylist entry, oldest first.
+func (p *Postgres) GetDenylist() ([]DenyEntry, error) {
+	sql := `SELECT id, kind, value, coalesce(reason,''), created
+FROM denylist
+ORDER BY id`
+
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DenyEntry{}
+	for rows.Next() {
+		var e DenyEntry
+		err = rows.Scan(&e.Id, &e.Kind, &e.Value, &e.Reason, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
+
+// AddDenied stores entry, once normalized. Adding an entry that exists
+// updates its reason.
+func (p *Postgres) AddDenied(entry DenyEntry) (DenyEntry, error) {
+	err := entry.Normalize()
+	if err != nil {
+		return entry, err
+	}
+
+	err = p.Conn.QueryRow(`INSERT INTO denylist(kind,value,reason,created) VALUES ($1,$2,$3,NOW())
+ON CONFLICT(kind,value) DO UPDATE SET reason=excluded.reason
+RETURNING id, created`, entry.Kind, entry.Value, entry.Reason).Scan(&entry.Id, &entry.Created)
+	return entry, err
+}
+
+// DeleteDenied drops a denylist entry.
+func (p *Postgres) DeleteDenied(id int) error {
+	res, err := p.Conn.Exec(`DELETE FROM denylist WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotDenied
+	}
+	return nil
+}
+
+// HasInstallation tells whether installation uid is stored.
+func (p *Postgres) HasInstallation(uid string) (bool, error) {
+	var one int
+	err := p.Conn.QueryRow(`SELECT 1 FROM installation WHERE uid=$1`, uid).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
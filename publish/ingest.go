@@ -0,0 +1,477 @@
+package publish
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	record "github.com/rancher/telemetry/record"
+	schema "github.com/rancher/telemetry/schema"
+)
+
+// ingestRetryMax caps the wait between attempts at a batch while the
+// database is down.
+const ingestRetryMax = time.Minute
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue is at capacity.
+	ErrQueueFull = errors.New("Ingest queue is full")
+	// ErrQueueClosed is returned by Enqueue once the queue is shutting down.
+	ErrQueueClosed = errors.New("Ingest queue is closed")
+
+	ingestMetrics           = expvar.NewMap("ingest")
+	ingestAccepted          = new(expvar.Int)
+	ingestRejected          = new(expvar.Int)
+	ingestBatches           = new(expvar.Int)
+	ingestRecords           = new(expvar.Int)
+	ingestBatchErrors       = new(expvar.Int)
+	ingestQuarantined       = new(expvar.Int)
+	ingestDuplicates        = new(expvar.Int)
+	ingestBatchLatency      = new(expvar.Int)
+	ingestBatchLatencyMax   = new(expvar.Int)
+	ingestBatchLatencyTotal = new(expvar.Int)
+)
+
+func init() {
+	ingestMetrics.Set("accepted", ingestAccepted)
+	ingestMetrics.Set("rejected_full", ingestRejected)
+	ingestMetrics.Set("batches", ingestBatches)
+	ingestMetrics.Set("records", ingestRecords)
+	ingestMetrics.Set("batch_errors", ingestBatchErrors)
+	ingestMetrics.Set("quarantined", ingestQuarantined)
+	ingestMetrics.Set("duplicates", ingestDuplicates)
+	ingestMetrics.Set("batch_latency_ms", ingestBatchLatency)
+	ingestMetrics.Set("batch_latency_ms_max", ingestBatchLatencyMax)
+	ingestMetrics.Set("batch_latency_ms_total", ingestBatchLatencyTotal)
+}
+
+// IngestItem is a record on its way into the database: as it arrived,
+// upgraded to the current version, and the version it arrived as.
+type IngestItem struct {
+	Record   record.Record `json:"record"`
+	Upgraded record.Record `json:"upgraded,omitempty"`
+	From     int           `json:"from"`
+	ClientIp string        `json:"clientIp"`
+}
+
+func (i *IngestItem) uid() (string, error) {
+	install, ok := i.Upgraded[schema.InstallRecordKey].(map[string]interface{})
+	if !ok {
+		return "", errors.New("Record has no install section")
+	}
+	uid, ok := install["uid"].(string)
+	if !ok || uid == "" {
+		return "", errors.New("Record has no install uid")
+	}
+	return uid, nil
+}
+
+// recordId returns the id and sequence number the client gave the record,
+// if it is from a client that sets them.
+func (i *IngestItem) recordId() (sql.NullString, sql.NullInt64) {
+	var (
+		rid sql.NullString
+		seq sql.NullInt64
+	)
+
+	if id, ok := i.Upgraded[schema.RecordIdKey].(string); ok && id != "" {
+		rid = sql.NullString{String: strings.ToLower(id), Valid: true}
+	}
+
+	switch n := i.Upgraded[schema.RecordSeqKey].(type) {
+	case float64:
+		seq = sql.NullInt64{Int64: int64(n), Valid: true}
+	case int64:
+		seq = sql.NullInt64{Int64: n, Valid: true}
+	case int:
+		seq = sql.NullInt64{Int64: int64(n), Valid: true}
+	case json.Number:
+		if v, err := n.Int64(); err == nil {
+			seq = sql.NullInt64{Int64: v, Valid: true}
+		}
+	}
+
+	return rid, seq
+}
+
+// IngestWriter is where an IngestQueue stores its batches.
+type IngestWriter interface {
+	IngestBatch(items []*IngestItem) error
+	Ping() error
+	Quarantine(payload []byte, reason string, clientIp string) (int, error)
+}
+
+type queuedItem struct {
+	item    *IngestItem
+	journal string
+}
+
+// IngestQueue takes records in and writes them to an IngestWriter in
+// batches. Records are written to a journal before Enqueue returns, so
+// records still queued when the process stops are written after the next
+// start.
+type IngestQueue struct {
+	writer        IngestWriter
+	journal       *Spool
+	capacity      int
+	batchSize     int
+	flushInterval time.Duration
+
+	items chan queuedItem
+	stop  chan struct{}
+	done  chan struct{}
+
+	// pending tracks the Enqueue calls between reserving room and handing
+	// the record to the worker, so Close doesn't close items under them.
+	pending sync.WaitGroup
+
+	mu     sync.Mutex
+	depth  int
+	closed bool
+}
+
+// NewIngestQueue starts a queue holding up to capacity records, written in
+// batches of up to batchSize or whatever arrived within flushInterval. With
+// an empty journalDir queued records are only kept in memory.
+func NewIngestQueue(writer IngestWriter, capacity, batchSize int, flushInterval time.Duration, journalDir string) (*IngestQueue, error) {
+	if capacity < 1 || batchSize < 1 {
+		return nil, errors.New("Ingest queue size and batch size must be > 0")
+	}
+	if flushInterval <= 0 {
+		return nil, errors.New("Ingest flush interval must be > 0")
+	}
+
+	q := &IngestQueue{
+		writer:        writer,
+		capacity:      capacity,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	recovered := []queuedItem{}
+	if journalDir == "" {
+		log.Warn("No ingest journal configured, queued records will be lost if the server stops")
+	} else {
+		var err error
+		q.journal, err = NewSpool(journalDir, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		recovered, err = q.recover()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Recovered records count against the capacity, but must fit in the
+	// channel even if the capacity shrank since they were queued.
+	q.items = make(chan queuedItem, capacity+len(recovered))
+	for _, queued := range recovered {
+		q.items <- queued
+	}
+	q.depth = len(recovered)
+
+	ingestMetrics.Set("capacity", expvar.Func(func() interface{} {
+		return q.capacity
+	}))
+	ingestMetrics.Set("queue_depth", expvar.Func(func() interface{} {
+		return q.Depth()
+	}))
+
+	go q.run()
+	return q, nil
+}
+
+// recover reads back the records left in the journal by the last run.
+func (q *IngestQueue) recover() ([]queuedItem, error) {
+	names, err := q.journal.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []queuedItem{}
+	for _, name := range names {
+		data, err := q.journal.Read(name)
+		if err != nil {
+			return nil, err
+		}
+
+		item := &IngestItem{}
+		err = json.Unmarshal(data, item)
+		if err != nil {
+			log.Errorf("Dropping unreadable journaled record %s: %s", name, err)
+			q.removeJournal([]queuedItem{{journal: name}})
+			continue
+		}
+		if item.Upgraded == nil {
+			item.Upgraded = item.Record
+		}
+
+		out = append(out, queuedItem{item: item, journal: name})
+	}
+
+	if len(out) > 0 {
+		log.Infof("Recovered %d queued records from the ingest journal", len(out))
+	}
+	return out, nil
+}
+
+// Enqueue queues item to be written. It returns ErrQueueFull if the queue
+// is at capacity, and otherwise once item is in the journal.
+func (q *IngestQueue) Enqueue(item *IngestItem) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	if q.depth >= q.capacity {
+		q.mu.Unlock()
+		ingestRejected.Add(1)
+		return ErrQueueFull
+	}
+	q.depth++
+	q.pending.Add(1)
+	q.mu.Unlock()
+	defer q.pending.Done()
+
+	queued := queuedItem{item: item}
+	if q.journal != nil {
+		journaled := *item
+		if journaled.From == record.VERSION {
+			journaled.Upgraded = nil
+		}
+
+		data, err := json.Marshal(journaled)
+		if err == nil {
+			queued.journal, err = q.journal.Append(data)
+		}
+		if err != nil {
+			q.release(1)
+			return fmt.Errorf("Error writing to the ingest journal: %s", err)
+		}
+	}
+
+	q.items <- queued
+	ingestAccepted.Add(1)
+	return nil
+}
+
+// Depth is how many records are queued, including the batch being
+// written.
+func (q *IngestQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// Close stops taking records and writes the queued ones until deadline.
+// Records not written by then stay in the journal.
+func (q *IngestQueue) Close(deadline time.Time) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	q.pending.Wait()
+	close(q.items)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-timer.C:
+	}
+
+	close(q.stop)
+	<-q.done
+
+	left := q.Depth()
+	if left > 0 {
+		return fmt.Errorf("%d records still queued", left)
+	}
+	return nil
+}
+
+func (q *IngestQueue) release(n int) {
+	q.mu.Lock()
+	q.depth -= n
+	q.mu.Unlock()
+}
+
+func (q *IngestQueue) run() {
+	defer close(q.done)
+
+	for {
+		batch, open := q.next()
+		if len(batch) > 0 && !q.flush(batch) {
+			return
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// next waits for the next batch. It tells whether more may follow.
+func (q *IngestQueue) next() ([]queuedItem, bool) {
+	var batch []queuedItem
+
+	select {
+	case queued, ok := <-q.items:
+		if !ok {
+			return nil, false
+		}
+		batch = append(batch, queued)
+	case <-q.stop:
+		return nil, false
+	}
+
+	timer := time.NewTimer(q.flushInterval)
+	defer timer.Stop()
+
+	for len(batch) < q.batchSize {
+		select {
+		case queued, ok := <-q.items:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, queued)
+		case <-timer.C:
+			return batch, true
+		case <-q.stop:
+			return batch, false
+		}
+	}
+
+	return batch, true
+}
+
+// flush writes batch, waiting out database outages. It returns false if the
+// queue was stopped first.
+func (q *IngestQueue) flush(batch []queuedItem) bool {
+	wait := q.flushInterval
+	for {
+		var err error
+		batch, err = q.write(batch)
+		if err == nil {
+			return true
+		}
+
+		log.Errorf("Error writing %d queued records, retrying in %s: %s", len(batch), wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.stop:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		wait *= 2
+		if wait > ingestRetryMax {
+			wait = ingestRetryMax
+		}
+	}
+}
+
+// write stores batch in one go. If the writer refuses it while the
+// database is up, the records are written one by one and the ones refused
+// are quarantined. It only fails if the database is down, and then returns
+// the records still to write.
+func (q *IngestQueue) write(batch []queuedItem) ([]queuedItem, error) {
+	items := make([]*IngestItem, len(batch))
+	for i, queued := range batch {
+		items[i] = queued.item
+	}
+
+	start := time.Now()
+	err := q.writer.IngestBatch(items)
+	q.observe(time.Since(start), len(batch), err)
+	if err == nil {
+		q.finish(batch)
+		return nil, nil
+	}
+
+	if pingErr := q.writer.Ping(); pingErr != nil {
+		return batch, err
+	}
+
+	log.Warnf("Writing %d queued records one by one: %s", len(batch), err)
+	for i, queued := range batch {
+		err = q.writer.IngestBatch(items[i : i+1])
+		if err != nil {
+			if pingErr := q.writer.Ping(); pingErr != nil {
+				return batch[i:], err
+			}
+			q.quarantine(queued.item, err)
+		}
+		q.finish(batch[i : i+1])
+	}
+	return nil, nil
+}
+
+func (q *IngestQueue) quarantine(item *IngestItem, err error) {
+	ingestQuarantined.Add(1)
+
+	payload, marshalErr := json.Marshal(item.Record)
+	if marshalErr != nil {
+		log.Errorf("Dropping queued record the database refused: %s", err)
+		return
+	}
+
+	_, qErr := q.writer.Quarantine(payload, "Error storing Record: "+err.Error(), item.ClientIp)
+	if qErr != nil {
+		log.Errorf("Error quarantining queued record: %s", qErr)
+	}
+}
+
+// finish drops written records from the journal and frees their room.
+func (q *IngestQueue) finish(batch []queuedItem) {
+	q.removeJournal(batch)
+	q.release(len(batch))
+}
+
+func (q *IngestQueue) removeJournal(batch []queuedItem) {
+	if q.journal == nil {
+		return
+	}
+
+	for _, queued := range batch {
+		err := q.journal.Remove(queued.journal)
+		if err != nil {
+			log.Errorf("Error removing %s from the ingest journal: %s", queued.journal, err)
+		}
+	}
+}
+
+func (q *IngestQueue) observe(latency time.Duration, records int, err error) {
+	ms := latency.Milliseconds()
+
+	ingestBatches.Add(1)
+	ingestBatchLatency.Set(ms)
+	ingestBatchLatencyTotal.Add(ms)
+	if ms > ingestBatchLatencyMax.Value() {
+		ingestBatchLatencyMax.Set(ms)
+	}
+
+	if err != nil {
+		ingestBatchErrors.Add(1)
+		return
+	}
+	ingestRecords.Add(int64(records))
+}
@@ -0,0 +1,175 @@
+package publish_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+type fakeWriter struct {
+	mu          sync.Mutex
+	down        bool
+	block       chan struct{}
+	refuse      string
+	batches     [][]string
+	quarantined []string
+}
+
+func (f *fakeWriter) IngestBatch(items []*publish.IngestItem) error {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return errors.New("connection refused")
+	}
+
+	uids := []string{}
+	for _, item := range items {
+		uid := itemUid(item)
+		if uid == f.refuse {
+			return errors.New("refused " + uid)
+		}
+		uids = append(uids, uid)
+	}
+	f.batches = append(f.batches, uids)
+	return nil
+}
+
+func (f *fakeWriter) Ping() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeWriter) Quarantine(payload []byte, reason string, clientIp string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.quarantined = append(f.quarantined, reason)
+	return len(f.quarantined), nil
+}
+
+func (f *fakeWriter) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeWriter) written() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string{}, f.batches...)
+}
+
+func itemUid(item *publish.IngestItem) string {
+	return item.Upgraded["install"].(map[string]interface{})["uid"].(string)
+}
+
+func ingestItem(uid string) *publish.IngestItem {
+	r := record.Record{
+		"r":       record.VERSION,
+		"install": map[string]interface{}{"uid": uid},
+	}
+	return &publish.IngestItem{Record: r, Upgraded: r, From: record.VERSION, ClientIp: "1.2.3.0"}
+}
+
+func TestIngestQueueBatches(t *testing.T) {
+	writer := &fakeWriter{block: make(chan struct{})}
+	queue, err := publish.NewIngestQueue(writer, 10, 2, time.Hour, "")
+	assert.Nil(t, err)
+
+	// The first record is taken by the worker, which then waits for a second
+	// one to fill the batch.
+	for _, uid := range []string{"a", "b", "c"} {
+		assert.Nil(t, queue.Enqueue(ingestItem(uid)))
+	}
+	assert.Equal(t, 3, queue.Depth())
+	close(writer.block)
+
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, writer.written())
+	assert.Equal(t, 0, queue.Depth())
+	assert.Equal(t, publish.ErrQueueClosed, queue.Enqueue(ingestItem("d")))
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	writer := &fakeWriter{block: make(chan struct{})}
+	queue, err := publish.NewIngestQueue(writer, 2, 1, time.Millisecond, "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.Enqueue(ingestItem("a")))
+	assert.Nil(t, queue.Enqueue(ingestItem("b")))
+	assert.Equal(t, publish.ErrQueueFull, queue.Enqueue(ingestItem("c")))
+
+	close(writer.block)
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, writer.written())
+}
+
+func TestIngestQueueRecoversJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	writer := &fakeWriter{down: true}
+	queue, err := publish.NewIngestQueue(writer, 10, 10, time.Millisecond, dir)
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Enqueue(ingestItem("a")))
+	assert.Nil(t, queue.Enqueue(ingestItem("b")))
+	assert.NotNil(t, queue.Close(time.Now().Add(20*time.Millisecond)))
+
+	writer = &fakeWriter{}
+	queue, err = publish.NewIngestQueue(writer, 1, 10, time.Millisecond, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, publish.ErrQueueFull, queue.Enqueue(ingestItem("c")))
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+	assert.Equal(t, [][]string{{"a", "b"}}, writer.written())
+
+	writer = &fakeWriter{}
+	queue, err = publish.NewIngestQueue(writer, 1, 10, time.Millisecond, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queue.Depth())
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+}
+
+func TestIngestQueueWaitsForDatabase(t *testing.T) {
+	writer := &fakeWriter{down: true}
+	queue, err := publish.NewIngestQueue(writer, 10, 10, time.Millisecond, "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.Enqueue(ingestItem("a")))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, writer.written())
+	assert.Equal(t, 1, queue.Depth())
+
+	writer.setDown(false)
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+	assert.Equal(t, [][]string{{"a"}}, writer.written())
+}
+
+func TestIngestQueueQuarantinesRefused(t *testing.T) {
+	writer := &fakeWriter{refuse: "b", block: make(chan struct{})}
+	queue, err := publish.NewIngestQueue(writer, 10, 3, time.Hour, "")
+	assert.Nil(t, err)
+
+	for _, uid := range []string{"a", "b", "c"} {
+		assert.Nil(t, queue.Enqueue(ingestItem(uid)))
+	}
+	close(writer.block)
+
+	assert.Nil(t, queue.Close(time.Now().Add(time.Second)))
+	assert.Equal(t, [][]string{{"a"}, {"c"}}, writer.written())
+	assert.Equal(t, []string{"Error storing Record: refused b"}, writer.quarantined)
+}
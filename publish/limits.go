@@ -0,0 +1,183 @@
+package publish
+
+import (
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiterSweep is how many keys a RateLimiter tracks before it forgets
+// the ones whose bucket filled up again.
+const rateLimiterSweep = 10000
+
+var rejectedMetrics = expvar.NewMap("publish_rejected")
+
+func init() {
+	for _, r := range []Rejection{RejectedDeniedIp, RejectedDeniedUid, RejectedRateIp, RejectedRateUid, RejectedInstallCap} {
+		rejectedMetrics.Add(string(r), 0)
+	}
+}
+
+// Rejection is why a publish was turned away before being queued.
+type Rejection string
+
+const (
+	RejectedDeniedIp   Rejection = "denied_ip"
+	RejectedDeniedUid  Rejection = "denied_uid"
+	RejectedRateIp     Rejection = "rate_ip"
+	RejectedRateUid    Rejection = "rate_uid"
+	RejectedInstallCap Rejection = "install_cap"
+)
+
+// Count adds the rejection to the server metrics.
+func (r Rejection) Count() {
+	rejectedMetrics.Add(string(r), 1)
+}
+
+// RateLimiter is a token bucket per key. Each bucket holds up to burst
+// tokens and refills at perMinute tokens a minute.
+type RateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter letting perMinute requests a minute
+// through per key, after an initial burst. It returns nil, which lets
+// everything through, if perMinute isn't > 0.
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		perSecond: perMinute / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the bucket of key. If there is none, it tells
+// how long until there is.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= rateLimiterSweep {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.perSecond)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets buckets that are full again, as a new one would be. The
+// caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perSecond >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// InstallCap limits how many installations a source may create a day, so
+// a client can't make up endless uids.
+type InstallCap struct {
+	max   int
+	known func(uid string) (bool, error)
+
+	mu       sync.Mutex
+	day      string
+	bySource map[string]int
+	seen     map[string]bool
+}
+
+// NewInstallCap returns a cap of max new installations per source a day.
+// known tells whether an installation is stored already. It returns nil,
+// which lets everything through, if max isn't > 0.
+func NewInstallCap(max int, known func(uid string) (bool, error)) *InstallCap {
+	if max <= 0 {
+		return nil
+	}
+
+	return &InstallCap{
+		max:      max,
+		known:    known,
+		bySource: map[string]int{},
+		seen:     map[string]bool{},
+	}
+}
+
+// Allow tells whether source may publish a record of installation uid. It
+// may if the installation is known, or if source created fewer than the
+// maximum today.
+func (c *InstallCap) Allow(source, uid string, now time.Time) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+
+	c.mu.Lock()
+	seen := c.seen[uid]
+	c.mu.Unlock()
+	if seen {
+		return true, nil
+	}
+
+	known, err := c.known(uid)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if known {
+		c.seen[uid] = true
+		return true, nil
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	if day != c.day {
+		c.day = day
+		c.bySource = map[string]int{}
+	}
+
+	if c.bySource[source] >= c.max {
+		return false, nil
+	}
+
+	c.bySource[source]++
+	c.seen[uid] = true
+	return true, nil
+}
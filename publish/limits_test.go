@@ -0,0 +1,127 @@
+package publish_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := publish.NewRateLimiter(60, 2)
+	now := time.Now()
+
+	ok, _ := limiter.Allow("a", now)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a", now)
+	assert.True(t, ok)
+	ok, wait := limiter.Allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// Keys have buckets of their own.
+	ok, _ = limiter.Allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = limiter.Allow("a", now.Add(time.Second))
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a", now.Add(time.Second))
+	assert.False(t, ok)
+
+	// No limit lets everything through.
+	limiter = publish.NewRateLimiter(0, 0)
+	assert.Nil(t, limiter)
+	ok, _ = limiter.Allow("a", now)
+	assert.True(t, ok)
+}
+
+func TestInstallCap(t *testing.T) {
+	known := map[string]bool{"old": true}
+	lookups := 0
+	installs := publish.NewInstallCap(2, func(uid string) (bool, error) {
+		lookups++
+		return known[uid], nil
+	})
+	day := time.Date(2021, 8, 3, 12, 0, 0, 0, time.UTC)
+
+	for _, uid := range []string{"old", "new1", "new2", "new1"} {
+		ok, err := installs.Allow("1.2.3.0", uid, day)
+		assert.Nil(t, err)
+		assert.True(t, ok, uid)
+	}
+	assert.Equal(t, 3, lookups)
+
+	ok, _ := installs.Allow("1.2.3.0", "new3", day)
+	assert.False(t, ok)
+	ok, _ = installs.Allow("1.2.3.0", "old", day)
+	assert.True(t, ok)
+	ok, _ = installs.Allow("4.5.6.0", "new3", day)
+	assert.True(t, ok)
+
+	ok, _ = installs.Allow("1.2.3.0", "new4", day.Add(24*time.Hour))
+	assert.True(t, ok)
+}
+
+func TestDenylist(t *testing.T) {
+	entries := []publish.DenyEntry{
+		{Kind: publish.DenyUid, Value: " F4B2C1A0-8A4C-4F3E-9F9E-6A1D2C3B4A5F "},
+		{Kind: publish.DenyCidr, Value: "10.1.2.3/16"},
+		{Kind: publish.DenyCidr, Value: "192.168.0.7"},
+		{Kind: publish.DenyCidr, Value: "2001:db8::/32"},
+	}
+	for i := range entries {
+		assert.Nil(t, entries[i].Normalize())
+	}
+	assert.Equal(t, "f4b2c1a0-8a4c-4f3e-9f9e-6a1d2c3b4a5f", entries[0].Value)
+	assert.Equal(t, "10.1.0.0/16", entries[1].Value)
+	assert.Equal(t, "192.168.0.7/32", entries[2].Value)
+
+	denylist := publish.NewDenylist()
+	denylist.Set(entries)
+
+	assert.True(t, denylist.DeniesUid("f4b2c1a0-8a4c-4f3e-9f9e-6a1d2c3b4a5F"))
+	assert.False(t, denylist.DeniesUid("0c6a1f0e-7d0e-4c55-a2a4-9b9f9d0d4f11"))
+	assert.True(t, denylist.DeniesIp("10.1.200.1"))
+	assert.True(t, denylist.DeniesIp("192.168.0.7"))
+	assert.False(t, denylist.DeniesIp("192.168.0.7, 10.0.0.1"))
+	assert.False(t, denylist.DeniesIp("192.168.0.8"))
+	assert.True(t, denylist.DeniesIp("2001:db8::1"))
+	assert.False(t, denylist.DeniesIp("not an ip"))
+
+	for _, bad := range []publish.DenyEntry{
+		{Kind: publish.DenyCidr, Value: "10.0.0.0/33"},
+		{Kind: publish.DenyUid, Value: " "},
+		{Kind: "host", Value: "example.com"},
+	} {
+		assert.NotNil(t, bad.Normalize(), bad.Value)
+	}
+}
+
+func TestForwardedIp(t *testing.T) {
+	// Clients can put anything before the hop the proxy appends.
+	assert.Equal(t, "203.0.113.9", publish.ForwardedIp([]string{"203.0.113.9"}))
+	assert.Equal(t, "203.0.113.9", publish.ForwardedIp([]string{"10.1.2.3, 203.0.113.9"}))
+	assert.Equal(t, "203.0.113.9", publish.ForwardedIp([]string{"192.168.0.7,198.51.100.1", " 203.0.113.9 "}))
+	assert.Equal(t, "2001:db8::1", publish.ForwardedIp([]string{"unknown, 2001:db8::1"}))
+
+	assert.Equal(t, "", publish.ForwardedIp([]string{"203.0.113.9, not an ip"}))
+	assert.Equal(t, "", publish.ForwardedIp(nil))
+}
+
+func TestForwardedIpKeysLimits(t *testing.T) {
+	limiter := publish.NewRateLimiter(60, 1)
+	now := time.Now()
+
+	// Changing the hops the client controls doesn't give it a new bucket.
+	ok, _ := limiter.Allow(publish.ForwardedIp([]string{"10.0.0.1, 203.0.113.9"}), now)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(publish.ForwardedIp([]string{"10.0.0.2, 203.0.113.9"}), now)
+	assert.False(t, ok)
+
+	denylist := publish.NewDenylist()
+	denylist.Set([]publish.DenyEntry{{Kind: publish.DenyCidr, Value: "203.0.113.0/24"}})
+	assert.True(t, denylist.DeniesIp(publish.ForwardedIp([]string{"198.51.100.1, 203.0.113.9"})))
+	assert.False(t, denylist.DeniesIp(publish.ForwardedIp([]string{"203.0.113.9, 198.51.100.1"})))
+}
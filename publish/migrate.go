@@ -0,0 +1,370 @@
+package publish
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationLock is the advisory lock held while migrating, so servers
+// started together don't run the same migration twice.
+const migrationLock = 0x74656c656d
+
+// noTransaction starts migrations that can't run in a transaction.
+const noTransaction = "-- migrate: no-transaction"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned change to the DB schema, and how to revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is whether a migration is applied, and when.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// Migrations returns the migrations built in, oldest first. They are read
+// from migrations/<version>_<name>.up.sql and .down.sql.
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction, ok := cutDirection(file)
+		if !ok {
+			return nil, fmt.Errorf("Migration %s must end in .up.sql or .down.sql", file)
+		}
+
+		var version int
+		versionStr, name, _ := strings.Cut(base, "_")
+		if _, err := fmt.Sscanf(versionStr, "%d", &version); err != nil || version < 1 || name == "" {
+			return nil, fmt.Errorf("Migration %s must be named <version>_<name>", file)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", file))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("Migrations %s and %s have the same version", m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	out := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("Migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+
+	for i, m := range out {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("Migration %d is missing", i+1)
+		}
+	}
+
+	return out, nil
+}
+
+func cutDirection(file string) (string, string, bool) {
+	for _, direction := range []string{"up", "down"} {
+		suffix := "." + direction + ".sql"
+		if strings.HasSuffix(file, suffix) {
+			return strings.TrimSuffix(file, suffix), direction, true
+		}
+	}
+	return "", "", false
+}
+
+// LatestMigration is the version of the newest migration built in.
+func LatestMigration() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// SchemaVersion returns the version of the latest migration applied to the
+// DB, 0 if none is.
+func (p *Postgres) SchemaVersion() (int, error) {
+	err := p.addMigrationsTable(p.Conn)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = p.Conn.QueryRow(`SELECT coalesce(max(version),0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// MigrationStatus lists the migrations built in and those applied to the
+// DB, oldest first.
+func (p *Postgres) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.addMigrationsTable(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := p.appliedMigrations(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []MigrationStatus{}
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			status.AppliedAt = a.AppliedAt
+			delete(applied, m.Version)
+		}
+		out = append(out, status)
+	}
+
+	// Migrations applied by a newer server than this one.
+	for _, a := range applied {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+
+	return out, nil
+}
+
+// MigrateUp applies the migrations after the current schema version, up to
+// and including version to, or all of them if to is 0. It returns those it
+// applied.
+func (p *Postgres) MigrateUp(to int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	err = p.migrate(func(conn *sql.Conn, current int) error {
+		for _, m := range migrations {
+			if m.Version <= current {
+				continue
+			}
+			if to > 0 && m.Version > to {
+				break
+			}
+
+			log.Infof("Applying migration %d_%s", m.Version, m.Name)
+			err := runMigration(conn, m.Up, `INSERT INTO schema_migrations(version,name,applied_at) VALUES ($1,$2,NOW())`, m.Version, m.Name)
+			if err != nil {
+				return fmt.Errorf("Error applying migration %d_%s: %s", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateDown reverts the latest steps migrations applied. It returns those
+// it reverted.
+func (p *Postgres) MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	err = p.migrate(func(conn *sql.Conn, current int) error {
+		if current > len(migrations) {
+			return fmt.Errorf("Schema version %d is newer than this server knows how to revert", current)
+		}
+
+		for i := current - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+
+			log.Infof("Reverting migration %d_%s", m.Version, m.Name)
+			err := runMigration(conn, m.Down, `DELETE FROM schema_migrations WHERE version=$1`, m.Version)
+			if err != nil {
+				return fmt.Errorf("Error reverting migration %d_%s: %s", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// migrate runs fn with the current schema version, on a connection holding
+// the migration lock.
+func (p *Postgres) migrate(fn func(conn *sql.Conn, current int) error) error {
+	ctx := context.Background()
+	conn, err := p.Conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock)
+		if err != nil {
+			log.Errorf("Error releasing the migration lock: %s", err)
+		}
+	}()
+
+	err = p.addMigrationsTable(conn)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = conn.QueryRowContext(ctx, `SELECT coalesce(max(version),0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, current)
+}
+
+// runMigration runs the statements of a migration and the bookkeeping
+// query in one transaction. Migrations starting with noTransaction, which
+// CREATE INDEX CONCURRENTLY needs, run one statement at a time instead.
+func runMigration(conn *sql.Conn, statements string, bookkeeping string, args ...interface{}) error {
+	ctx := context.Background()
+
+	if strings.HasPrefix(statements, noTransaction) {
+		for _, statement := range splitStatements(statements) {
+			_, err := conn.ExecContext(ctx, statement)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := conn.ExecContext(ctx, bookkeeping, args...)
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, statements)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, bookkeeping, args...)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+// splitStatements splits a migration into statements, each ending with a
+// semicolon at the end of a line. Comment lines are left out.
+func splitStatements(statements string) []string {
+	out := []string{}
+	current := []string{}
+	for _, line := range strings.Split(statements, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			out = append(out, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		out = append(out, strings.Join(current, "\n"))
+	}
+	return out
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (p *Postgres) addMigrationsTable(db execer) error {
+	_, err := db.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version int PRIMARY KEY,
+	name varchar(255) NOT NULL,
+	applied_at timestamp NOT NULL
+)`)
+	return err
+}
+
+func (p *Postgres) appliedMigrations(db execer) (map[int]MigrationStatus, error) {
+	rows, err := db.QueryContext(context.Background(), `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int]MigrationStatus{}
+	for rows.Next() {
+		var (
+			status    MigrationStatus
+			appliedAt time.Time
+		)
+		err = rows.Scan(&status.Version, &status.Name, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		status.AppliedAt = &appliedAt
+		out[status.Version] = status
+	}
+
+	return out, rows.Err()
+}
@@ -0,0 +1,26 @@
+package publish_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := publish.Migrations()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up, m.Name)
+		assert.NotEmpty(t, m.Down, m.Name)
+	}
+	assert.Equal(t, "initial", migrations[0].Name)
+
+	latest, err := publish.LatestMigration()
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), latest)
+}
@@ -0,0 +1,4 @@
+DROP TABLE account;
+DROP TABLE byday;
+DROP TABLE installation;
+DROP TABLE record;
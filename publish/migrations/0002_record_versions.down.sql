@@ -0,0 +1,3 @@
+ALTER TABLE record
+  DROP COLUMN raw,
+  DROP COLUMN version;
@@ -0,0 +1,4 @@
+-- The original of upgraded records and the version they arrived as.
+ALTER TABLE record
+  ADD COLUMN IF NOT EXISTS raw json,
+  ADD COLUMN IF NOT EXISTS version int;
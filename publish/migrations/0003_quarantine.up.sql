@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS quarantine (
+  id serial PRIMARY KEY,
+  received timestamp NOT NULL,
+  client_ip varchar(255),
+  reason text NOT NULL,
+  payload text
+);
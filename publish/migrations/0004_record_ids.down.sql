@@ -0,0 +1,5 @@
+DROP INDEX record_rid;
+
+ALTER TABLE record
+  DROP COLUMN rid,
+  DROP COLUMN seq;
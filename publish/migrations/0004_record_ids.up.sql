@@ -0,0 +1,7 @@
+-- The id and sequence number clients give records. A record sent again has
+-- the same id and is only stored once.
+ALTER TABLE record
+  ADD COLUMN IF NOT EXISTS rid uuid,
+  ADD COLUMN IF NOT EXISTS seq bigint;
+
+CREATE UNIQUE INDEX IF NOT EXISTS record_rid ON record USING btree(rid);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS denylist (
+  id serial PRIMARY KEY,
+  kind varchar(16) NOT NULL,
+  value varchar(255) NOT NULL,
+  reason text,
+  created timestamp NOT NULL,
+  UNIQUE (kind, value)
+);
@@ -0,0 +1,4 @@
+DROP TRIGGER record_doc_sync ON record;
+DROP FUNCTION record_doc_sync();
+
+ALTER TABLE record DROP COLUMN doc;
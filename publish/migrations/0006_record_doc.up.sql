@@ -0,0 +1,16 @@
+-- The record data as jsonb, so queries don't parse whole documents again.
+-- The trigger keeps it in step with data, for servers that don't know about
+-- it yet. Records stored before are filled in by the backfill.
+ALTER TABLE record ADD COLUMN IF NOT EXISTS doc jsonb;
+
+CREATE OR REPLACE FUNCTION record_doc_sync() RETURNS trigger AS $$
+BEGIN
+  NEW.doc := NEW.data::jsonb;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS record_doc_sync ON record;
+CREATE TRIGGER record_doc_sync
+  BEFORE INSERT OR UPDATE OF data ON record
+  FOR EACH ROW EXECUTE PROCEDURE record_doc_sync();
@@ -0,0 +1,8 @@
+-- migrate: no-transaction
+-- The records the backfill still has to fill in the doc of. Built
+-- concurrently so writes go on meanwhile. If it fails, drop the invalid
+-- index it leaves behind before running the migration again.
+--
+-- The queries aggregate paths over the records byday and installation point
+-- at, and never filter records on their doc, so no index on it would help.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS record_doc_missing ON record USING btree(id) WHERE doc IS NULL AND data IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP TABLE rollup_value;
+DROP TABLE rollup_map;
+DROP TABLE rollup_field;
+DROP TABLE rollup_state;
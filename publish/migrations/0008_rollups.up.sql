@@ -0,0 +1,36 @@
+-- Per-day aggregates of the records in byday, for the fields the server is
+-- configured to roll up. rollup_state has the last day each field is rolled
+-- up through, days after it are read from the records.
+CREATE TABLE IF NOT EXISTS rollup_state (
+  kind varchar(16) NOT NULL,
+  field varchar(255) NOT NULL,
+  through date NOT NULL,
+  updated timestamp NOT NULL,
+  PRIMARY KEY (kind, field)
+);
+
+CREATE TABLE IF NOT EXISTS rollup_field (
+  field varchar(255) NOT NULL,
+  day date NOT NULL,
+  sum bigint,
+  min bigint,
+  max bigint,
+  count bigint NOT NULL,
+  PRIMARY KEY (field, day)
+);
+
+CREATE TABLE IF NOT EXISTS rollup_map (
+  field varchar(255) NOT NULL,
+  day date NOT NULL,
+  key text NOT NULL,
+  value bigint NOT NULL,
+  PRIMARY KEY (field, day, key)
+);
+
+CREATE TABLE IF NOT EXISTS rollup_value (
+  field varchar(255) NOT NULL,
+  day date NOT NULL,
+  key text NOT NULL,
+  value bigint NOT NULL,
+  PRIMARY KEY (field, day, key)
+);
@@ -0,0 +1,296 @@
+package publish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// ErrSpooled is wrapped around the reason a report couldn't be delivered
+// yet, and stays in the spool to be retried.
+var ErrSpooled = errors.New("Report is spooled for retry")
+
+// ErrOutboxClosed is returned by an Outbox once it is closed.
+var ErrOutboxClosed = errors.New("Outbox is closed")
+
+// Outbox delivers records to a Destination. Records that cannot be
+// delivered are kept in a Spool and retried in order with exponential
+// backoff until they go through or expire.
+type Outbox struct {
+	publisher  *Destination
+	spool      *Spool
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// sendMu serializes deliveries so spooled records always go out before
+	// newer ones, and guards closed.
+	sendMu sync.Mutex
+	closed bool
+	wake   chan struct{}
+
+	mu        sync.Mutex
+	attempts  int
+	nextRetry time.Time
+	lastError string
+}
+
+type OutboxStats struct {
+	SpoolStats
+	Attempts  int        `json:"attempts"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// NewOutbox creates an Outbox for publisher. Each destination gets its own
+// directory under spool-dir so one being down does not hold back the others.
+func NewOutbox(c *cli.Context, publisher *Destination) (*Outbox, error) {
+	out := &Outbox{
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+	}
+
+	var err error
+	out.minBackoff, err = time.ParseDuration(c.String("retry-min"))
+	if err != nil {
+		return nil, err
+	}
+
+	out.maxBackoff, err = time.ParseDuration(c.String("retry-max"))
+	if err != nil {
+		return nil, err
+	}
+
+	if out.minBackoff <= 0 || out.maxBackoff < out.minBackoff {
+		return nil, errors.New("retry-min must be > 0 and <= retry-max")
+	}
+
+	dir := c.String("spool-dir")
+	if dir == "" {
+		log.Warnf("No spool-dir configured, undelivered reports to %s will be dropped", publisher.Name)
+		return out, nil
+	}
+
+	maxAge, err := time.ParseDuration(c.String("spool-max-age"))
+	if err != nil {
+		return nil, err
+	}
+
+	out.spool, err = NewSpool(filepath.Join(dir, publisher.Name), c.Int64("spool-max-size"), maxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Report queues r behind any records still waiting in the spool and tries
+// to deliver them right away. r is written to the spool before the first
+// attempt, so it is not lost if the process stops while sending it. If the
+// spool isn't emptied, the error wraps ErrSpooled.
+func (o *Outbox) Report(r record.Record, clientIp string) error {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+
+	if o.closed {
+		return ErrOutboxClosed
+	}
+
+	if o.spool == nil {
+		return o.publisher.Report(r, clientIp)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	err = o.spool.Add(b)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.drainLocked()
+	o.notify()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSpooled, err)
+	}
+	return nil
+}
+
+// Run drains the spool until stop is closed.
+func (o *Outbox) Run(stop <-chan struct{}) {
+	if o.spool == nil {
+		return
+	}
+
+	for {
+		wait, _ := o.drain()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Close waits for a delivery in progress and closes the destination. Run
+// should be stopped first. Spooled records are left for the next Outbox of
+// the destination.
+func (o *Outbox) Close() error {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.publisher.Close()
+}
+
+func (o *Outbox) Destination() *Destination {
+	return o.publisher
+}
+
+func (o *Outbox) Stats() OutboxStats {
+	out := OutboxStats{}
+
+	if o.spool != nil {
+		stats, err := o.spool.Stats()
+		if err != nil {
+			log.Errorf("Error reading spool: %s", err)
+		}
+		out.SpoolStats = stats
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out.Attempts = o.attempts
+	out.LastError = o.lastError
+	if !o.nextRetry.IsZero() {
+		next := o.nextRetry
+		out.NextRetry = &next
+	}
+
+	return out
+}
+
+// drain sends spooled records oldest first and returns how long to wait
+// before trying again, along with why records are left in the spool.
+func (o *Outbox) drain() (time.Duration, error) {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+
+	if o.closed {
+		return o.maxBackoff, ErrOutboxClosed
+	}
+	return o.drainLocked()
+}
+
+// drainLocked is drain for callers already holding sendMu.
+func (o *Outbox) drainLocked() (time.Duration, error) {
+	for {
+		if wait, lastError := o.backoff(); wait > 0 {
+			return wait, fmt.Errorf("retrying in %s after: %s", wait.Round(time.Millisecond), lastError)
+		}
+
+		name, data, err := o.spool.Peek()
+		if err != nil {
+			log.Errorf("Error reading spool: %s", err)
+			return o.failed(err), err
+		}
+
+		if name == "" {
+			return o.maxBackoff, nil
+		}
+
+		var r record.Record
+		err = json.Unmarshal(data, &r)
+		if err != nil {
+			log.Errorf("Dropping unreadable spooled report %s: %s", name, err)
+			o.remove(name)
+			continue
+		}
+
+		err = o.publisher.Report(r, "")
+		if err != nil {
+			log.Warnf("Error publishing spooled report %s to %s: %s", name, o.publisher.Name, err)
+			return o.failed(err), err
+		}
+
+		log.Infof("Published spooled report %s to %s", name, o.publisher.Name)
+		o.remove(name)
+		o.succeeded()
+	}
+}
+
+func (o *Outbox) remove(name string) {
+	err := o.spool.Remove(name)
+	if err != nil {
+		log.Errorf("Error removing spooled report %s: %s", name, err)
+	}
+}
+
+// backoff is how long until the next retry, and the error that caused it.
+func (o *Outbox) backoff() (time.Duration, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return time.Until(o.nextRetry), o.lastError
+}
+
+// failed schedules the next retry with exponential backoff and jitter.
+func (o *Outbox) failed(err error) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.attempts++
+	o.lastError = err.Error()
+
+	wait := o.minBackoff
+	for i := 1; i < o.attempts && wait < o.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > o.maxBackoff {
+		wait = o.maxBackoff
+	}
+
+	// Spread retries over [wait/2, wait) so many clients coming back at
+	// once don't retry in lockstep.
+	if half := int64(wait / 2); half > 0 {
+		wait = time.Duration(half + rand.Int63n(half))
+	}
+
+	o.nextRetry = time.Now().Add(wait)
+	return wait
+}
+
+func (o *Outbox) succeeded() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.attempts = 0
+	o.lastError = ""
+	o.nextRetry = time.Time{}
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
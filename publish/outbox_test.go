@@ -0,0 +1,101 @@
+package publish_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+func TestOutboxRetriesSpooledReports(t *testing.T) {
+	var (
+		up       int32
+		received int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	c := newContext(
+		"retry-min", "10ms",
+		"retry-max", "20ms",
+		"spool-dir", t.TempDir(),
+		"spool-max-age", "1h",
+	)
+	dest, err := publish.NewDestination(c, "test="+server.URL)
+	assert.Nil(t, err)
+	outbox, err := publish.NewOutbox(c, dest)
+	assert.Nil(t, err)
+
+	// Undelivered reports are errors, even though they are kept.
+	assert.ErrorIs(t, outbox.Report(record.Record{"n": 1}, ""), publish.ErrSpooled)
+	assert.ErrorIs(t, outbox.Report(record.Record{"n": 2}, ""), publish.ErrSpooled)
+
+	stats := outbox.Stats()
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, "Server returned 503", stats.LastError)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go outbox.Run(stop)
+	atomic.StoreInt32(&up, 1)
+
+	assert.Eventually(t, func() bool {
+		return outbox.Stats().Pending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+	assert.Equal(t, "", outbox.Stats().LastError)
+	assert.Equal(t, int64(2), dest.Stats().Successes)
+
+	assert.Nil(t, outbox.Report(record.Record{"n": 3}, ""))
+	assert.Equal(t, int64(3), dest.Stats().Successes)
+}
+
+func TestOutboxWithoutSpool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := newContext("retry-min", "10ms", "retry-max", "20ms")
+	dest, err := publish.NewDestination(c, "test="+server.URL)
+	assert.Nil(t, err)
+	outbox, err := publish.NewOutbox(c, dest)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, outbox.Report(record.Record{}, ""))
+	assert.Equal(t, 0, outbox.Stats().Pending)
+}
+
+func TestOutboxClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+
+	c := newContext("retry-min", "10ms", "retry-max", "20ms")
+	dest, err := publish.NewDestination(c, "records=file://"+filepath.ToSlash(path))
+	assert.Nil(t, err)
+	outbox, err := publish.NewOutbox(c, dest)
+	assert.Nil(t, err)
+
+	assert.Nil(t, outbox.Report(record.Record{"n": 1}, ""))
+	assert.Nil(t, outbox.Close())
+	assert.Nil(t, outbox.Close())
+
+	// A closed outbox doesn't open the file again.
+	assert.Nil(t, os.Remove(path))
+	assert.ErrorIs(t, outbox.Report(record.Record{"n": 2}, ""), publish.ErrOutboxClosed)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
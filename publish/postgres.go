@@ -18,6 +18,8 @@ type Postgres struct {
 	telemetryVersion string
 
 	Conn *sql.DB
+
+	docs docs
 }
 
 func NewPostgres(c *cli.Context) *Postgres {
@@ -62,115 +64,251 @@ func NewPostgres(c *cli.Context) *Postgres {
 	return out
 }
 
+// Report upgrades r to the current record version and stores it.
 func (p *Postgres) Report(r record.Record, clientIp string) error {
-	log.Debugf("Publishing to Postgres")
-
-	install := r["install"].(map[string]interface{})
-	uid := install["uid"].(string)
-
-	tx, err := p.Conn.Begin()
+	upgraded, from, err := record.Upgrade(r)
 	if err != nil {
-		log.Errorf("Error creating transaction: %s", err)
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
-		}
 		return err
 	}
 
-	recordId, err := p.addRecord(tx, uid, r)
-	log.Debugf("Add Record: %v, %s", recordId, err)
-	if err != nil {
-		log.Errorf("Error adding record: %s", err)
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
+	return p.Ingest(r, upgraded, from, clientIp)
+}
+
+// Ingest stores upgraded, the record r turned into by the upgraders, along
+// with the version r arrived as. r is kept as well if it was upgraded.
+func (p *Postgres) Ingest(r, upgraded record.Record, from int, clientIp string) error {
+	return p.IngestBatch([]*IngestItem{{
+		Record:   r,
+		Upgraded: upgraded,
+		From:     from,
+		ClientIp: clientIp,
+	}})
+}
+
+// IngestBatch stores items in a single transaction, with one statement per
+// table. Records whose id is already stored are skipped, so a record that
+// is sent again is only stored once.
+func (p *Postgres) IngestBatch(items []*IngestItem) error {
+	log.Debugf("Publishing %d records to Postgres", len(items))
+
+	uids := make([]string, len(items))
+	for i, item := range items {
+		uid, err := item.uid()
+		if err != nil {
+			return err
 		}
-		return err
+		uids[i] = uid
 	}
 
-	_, err = p.upsertInstall(tx, uid, clientIp, recordId)
+	tx, err := p.Conn.Begin()
 	if err != nil {
-		log.Errorf("Error updating install: %s", err)
+		log.Errorf("Error creating transaction: %s", err)
 		return err
 	}
 
-	_, err = p.upsertByDay(tx, uid, recordId)
+	latest, err := p.addRecords(tx, uids, items)
 	if err != nil {
-		log.Errorf("Error updating day: %s", err)
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
+		log.Errorf("Error adding records: %s", err)
+		return rollback(tx, err)
+	}
+
+	// Nothing else changes if every record was sent before.
+	if len(latest) > 0 {
+		err = p.upsertInstalls(tx, latest)
+		if err != nil {
+			log.Errorf("Error updating installs: %s", err)
+			return rollback(tx, err)
+		}
+
+		err = p.upsertByDay(tx, latest)
+		if err != nil {
+			log.Errorf("Error updating day: %s", err)
+			return rollback(tx, err)
 		}
-		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
 		log.Errorf("Error commiting transatcion: %s", err)
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
-		}
-		return err
+		return rollback(tx, err)
 	}
 
 	log.Debugf("Published to Postgres")
 	return nil
 }
 
-func (p *Postgres) testDb() error {
-	var one int
-	err := p.Conn.QueryRow(`SELECT 1`).Scan(&one)
+func rollback(tx *sql.Tx, err error) error {
+	rbErr := tx.Rollback()
+	if rbErr != nil && rbErr != sql.ErrTxDone {
+		return fmt.Errorf("tx err: %v, rb err: %v", err, rbErr)
+	}
+	return err
+}
+
+// latestRecord is the newest record of an installation in a batch.
+type latestRecord struct {
+	uid      string
+	id       int
+	clientIp string
+}
+
+// addRecords inserts the records of items and returns the newest one of
+// each installation, in the order installations first appear. Records with
+// an id that is already stored, in the table or earlier in items, are left
+// out.
+func (p *Postgres) addRecords(tx *sql.Tx, uids []string, items []*IngestItem) ([]*latestRecord, error) {
+	values := []string{}
+	args := []interface{}{}
+	rids := make([]sql.NullString, len(items))
+	seen := map[string]bool{}
+	for i, item := range items {
+		rid, seq := item.recordId()
+		rids[i] = rid
+		if rid.Valid {
+			if seen[rid.String] {
+				continue
+			}
+			seen[rid.String] = true
+		}
+
+		data, err := json.Marshal(item.Upgraded)
+		if err != nil {
+			return nil, err
+		}
+
+		var raw record.Record
+		if item.From != record.VERSION {
+			raw = item.Record
+		}
+		rawData, err := marshalRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,NOW())", n+1, n+2, n+3, n+4, n+5, n+6))
+		args = append(args, uids[i], string(data), rawData, item.From, rid, seq)
+	}
+
+	rows, err := tx.Query(`INSERT INTO record(uid,data,raw,version,rid,seq,ts) VALUES `+strings.Join(values, ",")+`
+ON CONFLICT (rid) DO NOTHING
+RETURNING id, uid, rid`, args...)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	added := 0
+	ids := map[string]int{}
+	stored := map[string]bool{}
+	for rows.Next() {
+		var id int
+		var uid string
+		var rid sql.NullString
+		err = rows.Scan(&id, &uid, &rid)
+		if err != nil {
+			return nil, err
+		}
+		added++
+		if id > ids[uid] {
+			ids[uid] = id
+		}
+		if rid.Valid {
+			stored[rid.String] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	if one != 1 {
-		return fmt.Errorf("SELECT 1 == %d?!", one)
+	if added < len(items) {
+		log.Debugf("Skipped %d records already stored", len(items)-added)
+		ingestDuplicates.Add(int64(len(items) - added))
 	}
 
-	return nil
+	out := []*latestRecord{}
+	byUid := map[string]*latestRecord{}
+	for i, uid := range uids {
+		if ids[uid] == 0 || (rids[i].Valid && !stored[rids[i].String]) {
+			continue
+		}
+
+		latest := byUid[uid]
+		if latest == nil {
+			latest = &latestRecord{uid: uid, id: ids[uid]}
+			byUid[uid] = latest
+			out = append(out, latest)
+		}
+		latest.clientIp = items[i].ClientIp
+	}
+
+	return out, nil
 }
 
-func (p *Postgres) addRecord(tx *sql.Tx, uid string, r record.Record) (int, error) {
-	var id int
+// marshalRaw encodes the original of an upgraded record, or nil for NULL if
+// it wasn't upgraded.
+func marshalRaw(raw record.Record) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
 
-	b, err := json.Marshal(r)
+	data, err := json.Marshal(raw)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	err = tx.QueryRow(`INSERT INTO record(uid,data,ts) VALUES ($1,$2,NOW()) RETURNING id`, uid, string(b)).Scan(&id)
-	return id, err
+	return string(data), nil
 }
 
-func (p *Postgres) upsertInstall(tx *sql.Tx, uid string, clientIp string, recordId int) (int, error) {
-	var id int
+func (p *Postgres) upsertInstalls(tx *sql.Tx, latest []*latestRecord) error {
+	values := []string{}
+	args := []interface{}{}
+	for _, l := range latest {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d,$%d,$%d,NOW(),NOW())", n+1, n+2, n+3))
+		args = append(args, l.uid, l.clientIp, l.id)
+	}
 
-	err := tx.QueryRow(`
+	_, err := tx.Exec(`
 		INSERT INTO installation(uid,last_ip,last_record,first_seen,last_seen)
-		VALUES ($1,$2,$3,NOW(),NOW()) 
+		VALUES `+strings.Join(values, ",")+`
 		ON CONFLICT(uid) DO UPDATE SET 
 			last_seen=NOW(),
-			last_ip=$2,
-			last_record=$3
-		RETURNING id`, uid, clientIp, recordId).Scan(&id)
-	return id, err
+			last_ip=excluded.last_ip,
+			last_record=excluded.last_record`, args...)
+	return err
 }
 
-func (p *Postgres) upsertByDay(tx *sql.Tx, uid string, recordId int) (int, error) {
-	var id int
-
+func (p *Postgres) upsertByDay(tx *sql.Tx, latest []*latestRecord) error {
 	today := time.Now().Format("2006-01-02")
 
-	err := tx.QueryRow(`
+	values := []string{}
+	args := []interface{}{today}
+	for _, l := range latest {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d,$1,$%d)", n+1, n+2))
+		args = append(args, l.uid, l.id)
+	}
+
+	_, err := tx.Exec(`
 		INSERT INTO byday(uid,day,record_id)
-		VALUES ($1,$2,$3) 
+		VALUES `+strings.Join(values, ",")+`
 		ON CONFLICT(uid,day) DO UPDATE SET 
-			record_id=$3
-		RETURNING id`, uid, today, recordId).Scan(&id)
-	return id, err
+			record_id=excluded.record_id`, args...)
+	return err
+}
+
+func (p *Postgres) testDb() error {
+	var one int
+	err := p.Conn.QueryRow(`SELECT 1`).Scan(&one)
+	if err != nil {
+		return err
+	}
+
+	if one != 1 {
+		return fmt.Errorf("SELECT 1 == %d?!", one)
+	}
+
+	return nil
 }
 
 func (p *Postgres) GetAccountHash(user string) (string, error) {
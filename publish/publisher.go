@@ -0,0 +1,144 @@
+package publish
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// Publisher sends a record somewhere. clientIp is the address the record
+// came from, if there is one.
+type Publisher interface {
+	Report(r record.Record, clientIp string) error
+}
+
+var _ Publisher = (*Postgres)(nil)
+
+// Factory creates a Publisher for a destination URL.
+type Factory func(c *cli.Context, dest *url.URL) (Publisher, error)
+
+var (
+	factories = map[string]Factory{}
+
+	invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9._-]+")
+)
+
+// Register makes f available for destinations using scheme.
+func Register(scheme string, f Factory) {
+	factories[scheme] = f
+}
+
+// New creates a Publisher for dest with the factory registered for its
+// scheme.
+func New(c *cli.Context, dest string) (Publisher, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := factories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("No publisher for %q destinations", u.Scheme)
+	}
+
+	return f(c, u)
+}
+
+// Destination is a named Publisher that keeps track of how its deliveries
+// went.
+type Destination struct {
+	Name      string
+	publisher Publisher
+
+	mu    sync.Mutex
+	stats DestinationStats
+}
+
+type DestinationStats struct {
+	Name        string     `json:"name"`
+	Successes   int64      `json:"successes"`
+	Failures    int64      `json:"failures"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// NewDestination creates a Destination from a "[name=]url" spec. Without a
+// name, one is made up from the URL.
+func NewDestination(c *cli.Context, spec string) (*Destination, error) {
+	name := ""
+	dest := spec
+	if i := strings.Index(spec, "="); i > 0 && !strings.Contains(spec[:i], ":") {
+		name = spec[:i]
+		dest = spec[i+1:]
+	}
+
+	if name == "" {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		name = u.Host + u.Path
+	}
+
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "_"), "_.")
+	if name == "" {
+		return nil, fmt.Errorf("Invalid destination name in %q", spec)
+	}
+
+	publisher, err := New(c, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Destination{
+		Name:      name,
+		publisher: publisher,
+		stats: DestinationStats{
+			Name: name,
+		},
+	}, nil
+}
+
+func (d *Destination) Report(r record.Record, clientIp string) error {
+	err := d.publisher.Report(r, clientIp)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		d.stats.Successes++
+		d.stats.LastSuccess = &now
+	} else {
+		d.stats.Failures++
+		d.stats.LastFailure = &now
+		d.stats.LastError = err.Error()
+	}
+
+	return err
+}
+
+func (d *Destination) Stats() DestinationStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stats
+}
+
+// Close releases what the publisher holds, such as an open file, if it is
+// an io.Closer.
+func (d *Destination) Close() error {
+	if closer, ok := d.publisher.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
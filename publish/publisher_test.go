@@ -0,0 +1,59 @@
+package publish_test
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+// newContext returns a context with the given string flags set.
+func newContext(flags ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for i := 0; i+1 < len(flags); i += 2 {
+		set.String(flags[i], flags[i+1], "")
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestDestinationNames(t *testing.T) {
+	dest, err := publish.NewDestination(newContext(), "https://telemetry.example.com/publish")
+	assert.Nil(t, err)
+	assert.Equal(t, "telemetry.example.com_publish", dest.Name)
+
+	dest, err = publish.NewDestination(newContext(), "internal=http://10.0.0.1:8115/publish")
+	assert.Nil(t, err)
+	assert.Equal(t, "internal", dest.Name)
+
+	_, err = publish.NewDestination(newContext(), "nope://somewhere")
+	assert.NotNil(t, err)
+}
+
+func TestDestinationAccounting(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dest, err := publish.NewDestination(newContext(), "test="+server.URL)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dest.Report(record.Record{}, ""))
+	status = http.StatusInternalServerError
+	assert.NotNil(t, dest.Report(record.Record{}, ""))
+
+	stats := dest.Stats()
+	assert.Equal(t, "test", stats.Name)
+	assert.Equal(t, int64(1), stats.Successes)
+	assert.Equal(t, int64(1), stats.Failures)
+	assert.NotNil(t, stats.LastSuccess)
+	assert.NotNil(t, stats.LastFailure)
+	assert.Equal(t, "Server returned 500", stats.LastError)
+}
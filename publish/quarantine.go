@@ -0,0 +1,111 @@
+package publish
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotQuarantined is returned for quarantined payloads that don't exist.
+var ErrNotQuarantined = errors.New("No such quarantined payload")
+
+// Quarantined is a payload the server refused to store as a record, and
+// why. Payload is left out of listings.
+type Quarantined struct {
+	Id       int       `json:"id"`
+	Received time.Time `json:"received"`
+	ClientIp string    `json:"clientIp"`
+	Reason   string    `json:"reason"`
+	Size     int       `json:"size"`
+	Payload  string    `json:"payload,omitempty"`
+}
+
+// Quarantine keeps payload, which could not be stored as a record because
+// of reason, for inspection. Bytes text columns can't hold are replaced.
+func (p *Postgres) Quarantine(payload []byte, reason string, clientIp string) (int, error) {
+	var id int
+
+	text := strings.ToValidUTF8(strings.ReplaceAll(string(payload), "\x00", ""), "\uFFFD")
+	err := p.Conn.QueryRow(`INSERT INTO quarantine(received,client_ip,reason,payload) VALUES (NOW(),$1,$2,$3) RETURNING id`,
+		clientIp, reason, text).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("Quarantined payload %d: %s", id, reason)
+	return id, nil
+}
+
+// GetQuarantined lists the most recent quarantined payloads, up to limit.
+func (p *Postgres) GetQuarantined(limit int) ([]Quarantined, error) {
+	sql := `SELECT id, received, coalesce(client_ip,''), reason, length(coalesce(payload,''))
+FROM quarantine
+ORDER BY id DESC
+LIMIT $1`
+
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Quarantined{}
+	for rows.Next() {
+		var q Quarantined
+		err = rows.Scan(&q.Id, &q.Received, &q.ClientIp, &q.Reason, &q.Size)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+
+	return out, rows.Err()
+}
+
+// GetQuarantinedById returns a quarantined payload, payload included.
+func (p *Postgres) GetQuarantinedById(id int) (*Quarantined, error) {
+	q := &Quarantined{}
+	err := p.Conn.QueryRow(`SELECT id, received, coalesce(client_ip,''), reason, coalesce(payload,'')
+FROM quarantine
+WHERE id = $1`, id).Scan(&q.Id, &q.Received, &q.ClientIp, &q.Reason, &q.Payload)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotQuarantined
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.Size = len(q.Payload)
+	return q, nil
+}
+
+// UpdateQuarantineReason records why a quarantined payload was refused
+// again.
+func (p *Postgres) UpdateQuarantineReason(id int, reason string) error {
+	return p.changeQuarantined(`UPDATE quarantine SET reason=$2 WHERE id=$1`, id, reason)
+}
+
+// DeleteQuarantined drops a quarantined payload.
+func (p *Postgres) DeleteQuarantined(id int) error {
+	return p.changeQuarantined(`DELETE FROM quarantine WHERE id=$1`, id)
+}
+
+func (p *Postgres) changeQuarantined(query string, args ...interface{}) error {
+	res, err := p.Conn.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotQuarantined
+	}
+	return nil
+}
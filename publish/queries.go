@@ -1,6 +1,7 @@
 package publish
 
 import (
+	dbsql "database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,16 +24,35 @@ type ApiInstallation struct {
 type ApiRecord struct {
 	Id     int64       `json:"id"`
 	Uid    string      `json:"uid"`
+	Rid    string      `json:"rid,omitempty"`
+	Seq    int64       `json:"seq,omitempty"`
 	Ts     time.Time   `json:"ts"`
 	Record interface{} `json:"record"`
 }
 
+// ErrNoRecord is returned for records that don't exist.
+var ErrNoRecord = errors.New("No such record")
+
 type RecordsByUid map[string]ApiRecord
 type RecordsByDateByUid map[string]RecordsByUid
 
 type AggregatedFields map[string]int64
 type AggregatedFieldsByDate map[string]AggregatedFields
 
+type CollectorHealth struct {
+	Reports int64 `json:"reports"`
+	// Disabled counts the installs that chose not to run the collector, and
+	// are left out of the other numbers.
+	Disabled      int64            `json:"disabled"`
+	Ok            int64            `json:"ok"`
+	Failed        int64            `json:"failed"`
+	Errors        AggregatedFields `json:"errors"`
+	DurationAvgMs int64            `json:"duration_avg_ms"`
+	DurationMaxMs int64            `json:"duration_max_ms"`
+	ApiCallsAvg   int64            `json:"api_calls_avg"`
+}
+type CollectorHealthByKey map[string]*CollectorHealth
+
 func (p *Postgres) Ping() error {
 	sql := `SELECT 1`
 	var one int
@@ -212,16 +232,34 @@ ORDER BY id DESC`
 }
 
 func (p *Postgres) GetRecordById(id string) (ApiRecord, error) {
-	sql := `SELECT id, uid, ts, data
+	sql := `SELECT id, uid, coalesce(rid::text,''), coalesce(seq,0), ts, data
 FROM record
 WHERE 
 	id = $1`
 
+	return p.getRecord(sql, id)
+}
+
+// GetRecordByRid returns the record a client published with id rid.
+func (p *Postgres) GetRecordByRid(rid string) (ApiRecord, error) {
+	sql := `SELECT id, uid, coalesce(rid::text,''), coalesce(seq,0), ts, data
+FROM record
+WHERE 
+	rid = $1`
+
+	rec, err := p.getRecord(sql, strings.ToLower(rid))
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return rec, ErrNoRecord
+	}
+	return rec, err
+}
+
+func (p *Postgres) getRecord(sql string, arg interface{}) (ApiRecord, error) {
 	var rec ApiRecord
 	var data []byte
 
 	log.Debugf("Query: %s", sql)
-	err := p.Conn.QueryRow(sql, id).Scan(&rec.Id, &rec.Uid, &rec.Ts, &data)
+	err := p.Conn.QueryRow(sql, arg).Scan(&rec.Id, &rec.Uid, &rec.Rid, &rec.Seq, &rec.Ts, &data)
 	if err != nil {
 		return rec, err
 	}
@@ -295,7 +333,7 @@ func (p *Postgres) GetRecordsByDay(day string) ([]ApiInstallation, error) {
 }
 
 func (p *Postgres) SumOfActiveInstalls(hours int, fields []string) (AggregatedFields, error) {
-	fieldSql, err := fieldQuery(fields, "r.data")
+	fieldSql, err := fieldQuery(fields, p.recordDoc())
 	if err != nil {
 		return nil, err
 	}
@@ -343,18 +381,17 @@ func (p *Postgres) SumOfActiveInstallsMap(hours int, field string) (AggregatedFi
 		return nil, errors.New("Invalid field")
 	}
 
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
+	path := jsonPath(strings.Split(field, "."))
 
 	sql := `SELECT jet.key, sum(jet.value::int)
 FROM installation i
 	JOIN record r ON (i.last_record = r.id),
-	json_each_text(json_extract_path(r.data,%s)) AS jet
+	jsonb_each_text(%s #> %s) AS jet
 WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
 GROUP BY jet.key
 ORDER BY jet.key`
 
-	sql = fmt.Sprintf(sql, path, hours)
+	sql = fmt.Sprintf(sql, p.recordDoc(), path, hours)
 	log.Debugf("Query: %s", sql)
 	rows, err := p.Conn.Query(sql)
 	if err != nil {
@@ -384,18 +421,16 @@ func (p *Postgres) SumOfActiveInstallsValue(hours int, field string) (Aggregated
 		return nil, errors.New("Invalid field")
 	}
 
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
+	path := jsonPath(strings.Split(field, "."))
 
-	sql := `SELECT key, count(*) AS value 
+	sql := `SELECT (%s #>> %s) AS key, count(*) AS value 
 FROM installation i
-	JOIN record r ON (i.last_record = r.id),
-	json_extract_path_text(r.data,%s) AS key
+	JOIN record r ON (i.last_record = r.id)
 WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
 GROUP BY key
 ORDER BY value DESC`
 
-	sql = fmt.Sprintf(sql, path, hours)
+	sql = fmt.Sprintf(sql, p.recordDoc(), path, hours)
 	log.Debugf("Query: %s", sql)
 	rows, err := p.Conn.Query(sql)
 	if err != nil {
@@ -420,7 +455,125 @@ ORDER BY value DESC`
 	return out, nil
 }
 
+func (p *Postgres) SumOfActiveCollectors(hours int) (CollectorHealthByKey, error) {
+	sql := `SELECT jet.key,
+	count(*),
+	coalesce(sum((jet.value->>'ok')::int),0),
+	coalesce(round(avg((jet.value->>'duration_ms')::bigint)),0)::bigint,
+	coalesce(max((jet.value->>'duration_ms')::bigint),0),
+	coalesce(round(avg((jet.value->>'api_calls')::int)),0)::bigint
+FROM installation i
+	JOIN record r ON (i.last_record = r.id),
+	jsonb_each(%s #> '{meta,collectors}') AS jet
+WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
+GROUP BY jet.key
+ORDER BY jet.key`
+
+	sql = fmt.Sprintf(sql, p.recordDoc(), hours)
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(CollectorHealthByKey)
+
+	for rows.Next() {
+		var key string
+		entry := &CollectorHealth{
+			Errors: make(AggregatedFields),
+		}
+
+		err = rows.Scan(&key, &entry.Reports, &entry.Ok, &entry.DurationAvgMs, &entry.DurationMaxMs, &entry.ApiCallsAvg)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Failed = entry.Reports - entry.Ok
+		out[key] = entry
+	}
+
+	sql = `SELECT jet.key, jet.value->>'error' AS error, count(*)
+FROM installation i
+	JOIN record r ON (i.last_record = r.id),
+	jsonb_each(%s #> '{meta,collectors}') AS jet
+WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
+	AND coalesce(jet.value->>'error','') <> ''
+GROUP BY jet.key, error`
+
+	sql = fmt.Sprintf(sql, p.recordDoc(), hours)
+	log.Debugf("Query: %s", sql)
+	errRows, err := p.Conn.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer errRows.Close()
+
+	for errRows.Next() {
+		var key string
+		var class string
+		var count int64
+
+		err = errRows.Scan(&key, &class, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := out[key]
+		if ok {
+			entry.Errors[class] = count
+		}
+	}
+
+	sql = `SELECT jdt.key, count(*)
+FROM installation i
+	JOIN record r ON (i.last_record = r.id),
+	jsonb_array_elements_text(%s #> '{meta,disabled}') AS jdt(key)
+WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
+GROUP BY jdt.key`
+
+	sql = fmt.Sprintf(sql, p.recordDoc(), hours)
+	log.Debugf("Query: %s", sql)
+	disabledRows, err := p.Conn.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer disabledRows.Close()
+
+	for disabledRows.Next() {
+		var key string
+		var count int64
+
+		err = disabledRows.Scan(&key, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := out[key]
+		if !ok {
+			entry = &CollectorHealth{
+				Errors: make(AggregatedFields),
+			}
+			out[key] = entry
+		}
+		entry.Disabled = count
+	}
+
+	return out, nil
+}
+
+// SumByDay aggregates fields by day over the last days, of installation uid
+// or of all of them if uid is empty. Fields rolled up are read from the
+// rollups for all installations.
 func (p *Postgres) SumByDay(days int, fields []string, uid string) (AggregatedFieldsByDate, error) {
+	if uid == "" && days > 0 && p.rolledUp(RollupFields, fields) {
+		return p.sumByDayRollup(days, fields)
+	}
+	return p.sumByDay(days, fields, uid)
+}
+
+func (p *Postgres) sumByDay(days int, fields []string, uid string) (AggregatedFieldsByDate, error) {
 	sql := `SELECT
 	%s,
 	b.day
@@ -433,7 +586,7 @@ ORDER BY day`
 
 	today := time.Now().Format("2006-01-02")
 
-	fieldSql, err := fieldQuery(fields, "r.data")
+	fieldSql, err := fieldQuery(fields, p.recordDoc())
 	if err != nil {
 		return nil, err
 	}
@@ -487,20 +640,31 @@ ORDER BY day`
 	return out, nil
 }
 
+// SumByDayMap sums the values of map field by key and day, like SumByDay.
 func (p *Postgres) SumByDayMap(days int, field string, uid string) (AggregatedFieldsByDate, error) {
+	if uid == "" && days > 0 && p.rolledUp(RollupMaps, []string{field}) {
+		out, err := p.sumByDayMap(0, field, "")
+		if err != nil {
+			return nil, err
+		}
+		return p.sumByDayKeysRollup(out, RollupMaps, days, field)
+	}
+	return p.sumByDayMap(days, field, uid)
+}
+
+func (p *Postgres) sumByDayMap(days int, field string, uid string) (AggregatedFieldsByDate, error) {
 	if !fieldIsValid(field) {
 		return nil, errors.New("Invalid field")
 	}
 
 	today := time.Now().Format("2006-01-02")
 
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
+	path := jsonPath(strings.Split(field, "."))
 
 	sql := `SELECT b.day, jet.key, sum(jet.value::int)
 FROM byday b
 	JOIN record r ON (b.record_id = r.id),
-	json_each_text(json_extract_path(r.data,%s)) AS jet
+	jsonb_each_text(%s #> %s) AS jet
 WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')
 	AND b.uid %s $1
 GROUP BY b.day, jet.key
@@ -511,7 +675,7 @@ ORDER BY b.day, jet.key`
 		op = "<>"
 	}
 
-	sql = fmt.Sprintf(sql, path, today, days, op)
+	sql = fmt.Sprintf(sql, p.recordDoc(), path, today, days, op)
 	log.Debugf("Query: %s", sql)
 	rows, err := p.Conn.Query(sql, uid)
 	if err != nil {
@@ -545,20 +709,30 @@ ORDER BY b.day, jet.key`
 	return out, nil
 }
 
+// SumByDayValue counts the values of string field by day, like SumByDay.
 func (p *Postgres) SumByDayValue(days int, field string, uid string) (AggregatedFieldsByDate, error) {
+	if uid == "" && days > 0 && p.rolledUp(RollupValues, []string{field}) {
+		out, err := p.sumByDayValue(0, field, "")
+		if err != nil {
+			return nil, err
+		}
+		return p.sumByDayKeysRollup(out, RollupValues, days, field)
+	}
+	return p.sumByDayValue(days, field, uid)
+}
+
+func (p *Postgres) sumByDayValue(days int, field string, uid string) (AggregatedFieldsByDate, error) {
 	if !fieldIsValid(field) {
 		return nil, errors.New("Invalid field")
 	}
 
 	today := time.Now().Format("2006-01-02")
 
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
+	path := jsonPath(strings.Split(field, "."))
 
-	sql := `SELECT b.day, key, count(*) AS value 
+	sql := `SELECT b.day, (%s #>> %s) AS key, count(*) AS value 
 FROM byday b
-	JOIN record r ON (b.record_id = r.id),
-	json_extract_path_text(r.data,%s) AS key
+	JOIN record r ON (b.record_id = r.id)
 WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')
 	AND b.uid %s $1
 GROUP BY b.day, key
@@ -569,7 +743,7 @@ ORDER BY b.day, value DESC`
 		op = "<>"
 	}
 
-	sql = fmt.Sprintf(sql, path, today, days, op)
+	sql = fmt.Sprintf(sql, p.recordDoc(), path, today, days, op)
 	log.Debugf("Query: %s", sql)
 	rows, err := p.Conn.Query(sql, uid)
 	if err != nil {
@@ -608,7 +782,23 @@ func fieldIsValid(field string) bool {
 	return field != "" && validField.MatchString(field)
 }
 
-func fieldQuery(fields []string, dataField string) (string, error) {
+// jsonPath is the jsonb path to parts, for the #> and #>> operators. Parts
+// are checked by fieldIsValid first.
+func jsonPath(parts []string) string {
+	return "'{" + strings.Join(parts, ",") + "}'"
+}
+
+// fieldAggregate is the aggregate function of field, picked by its suffix.
+func fieldAggregate(field string) string {
+	for _, fn := range []string{"min", "avg", "max"} {
+		if strings.HasSuffix(field, "_"+fn) {
+			return fn
+		}
+	}
+	return "sum"
+}
+
+func fieldQuery(fields []string, doc string) (string, error) {
 	out := []string{}
 
 	for _, field := range fields {
@@ -618,21 +808,14 @@ func fieldQuery(fields []string, dataField string) (string, error) {
 
 		parts := strings.Split(field, ".")
 		prefix := ""
-		fn := ""
+		fn := fieldAggregate(field)
 		suffix := ""
-		if strings.HasSuffix(field, "_min") {
-			fn = "min"
-		} else if strings.HasSuffix(field, "_avg") {
+		if fn == "avg" {
 			prefix = "round("
-			fn = "avg"
 			suffix = ")::int"
-		} else if strings.HasSuffix(field, "_max") {
-			fn = "max"
-		} else {
-			fn = "sum"
 		}
 
-		out = append(out, "  "+prefix+fn+"(json_extract_path("+dataField+",'"+strings.Join(parts, "','")+"')::text::int)"+suffix+" AS \""+field+"\"")
+		out = append(out, "  "+prefix+fn+"(("+doc+" #>> "+jsonPath(parts)+")::int)"+suffix+" AS \""+field+"\"")
 	}
 
 	return strings.Join(out, ",\n"), nil
@@ -0,0 +1,218 @@
+package publish_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/rancher/telemetry/publish"
+)
+
+// The benchmarks run the history queries over records read from their json
+// data, as before record.doc, and from their jsonb doc once backfilled. They
+// need a Postgres to generate the dataset in, e.g.
+//
+//	TELEMETRY_BENCH_DSN="host=localhost user=telemetry password=... dbname=telemetry sslmode=disable" \
+//		go test ./publish -run '^$' -bench History
+//
+// The DSN must be in key=value form. The dataset goes in a schema of its
+// own, dropped afterwards. TELEMETRY_BENCH_INSTALLS sets how many installs
+// report each day, 1000 by default, over TELEMETRY_BENCH_DAYS, 28 by default.
+
+const benchSchema = "telemetry_bench"
+
+var (
+	benchFields = []string{"cluster.active", "cluster.node.count", "cluster.namespace.total"}
+	benchMap    = "cluster.namespace.os"
+	benchValue  = "install.version"
+)
+
+func BenchmarkHistory(b *testing.B) {
+	p, days := benchDb(b)
+
+	queries := []struct {
+		name string
+		run  func() (publish.AggregatedFieldsByDate, error)
+	}{
+		{"SumByDay", func() (publish.AggregatedFieldsByDate, error) {
+			return p.SumByDay(days, benchFields, "")
+		}},
+		{"SumByDayMap", func() (publish.AggregatedFieldsByDate, error) {
+			return p.SumByDayMap(days, benchMap, "")
+		}},
+		{"SumByDayValue", func() (publish.AggregatedFieldsByDate, error) {
+			return p.SumByDayValue(days, benchValue, "")
+		}},
+	}
+
+	// Records without a doc are read from data, like before the backfill.
+	_, err := p.Conn.Exec(`UPDATE record SET doc = NULL`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, q := range queries {
+		q := q
+		b.Run(q.name+"/json", func(b *testing.B) {
+			benchQuery(b, q.run)
+		})
+	}
+
+	_, err = p.BackfillDocs(10000, 0, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, q := range queries {
+		q := q
+		b.Run(q.name+"/jsonb", func(b *testing.B) {
+			benchQuery(b, q.run)
+		})
+	}
+}
+
+func benchQuery(b *testing.B, run func() (publish.AggregatedFieldsByDate, error)) {
+	for i := 0; i < b.N; i++ {
+		out, err := run()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(out) == 0 {
+			b.Fatal("No days in the result")
+		}
+	}
+}
+
+// benchDb migrates the bench schema and fills it with records of installs
+// reporting every day. It returns the DB and how many days back they go.
+func benchDb(b *testing.B) (*publish.Postgres, int) {
+	dsn := os.Getenv("TELEMETRY_BENCH_DSN")
+	if dsn == "" {
+		b.Skip("TELEMETRY_BENCH_DSN is not set")
+	}
+
+	installs := benchEnvInt(b, "TELEMETRY_BENCH_INSTALLS", 1000)
+	days := benchEnvInt(b, "TELEMETRY_BENCH_DAYS", 28)
+
+	db, err := sql.Open("postgres", dsn+" search_path="+benchSchema)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_, err := db.Exec(`DROP SCHEMA IF EXISTS ` + benchSchema + ` CASCADE`)
+		if err != nil {
+			b.Error(err)
+		}
+		db.Close()
+	})
+
+	_, err = db.Exec(`DROP SCHEMA IF EXISTS ` + benchSchema + ` CASCADE; CREATE SCHEMA ` + benchSchema)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	p := &publish.Postgres{Conn: db}
+	_, err = p.MigrateUp(0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	uids := make([]string, installs)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("%08x-0000-4000-8000-%012x", rng.Uint32(), rng.Int63n(1<<48))
+	}
+
+	type benchEntry struct {
+		Uid string                 `json:"uid"`
+		Doc map[string]interface{} `json:"doc"`
+	}
+
+	for d := days; d >= 0; d-- {
+		day := time.Now().AddDate(0, 0, -d).Format("2006-01-02")
+
+		for start := 0; start < installs; start += 1000 {
+			entries := []benchEntry{}
+			for _, uid := range uids[start:benchMin(start+1000, installs)] {
+				entries = append(entries, benchEntry{uid, benchRecord(rng, uid)})
+			}
+			batch, _ := json.Marshal(entries)
+
+			_, err = db.Exec(`WITH r AS (
+	INSERT INTO record(uid,ts,data)
+	SELECT e->>'uid', $2::date, e->'doc' FROM json_array_elements($1::json) AS e
+	RETURNING id, uid, ts
+)
+INSERT INTO byday(uid,day,record_id) SELECT uid, ts::date, id FROM r`, string(batch), day)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	_, err = db.Exec(`ANALYZE`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	return p, days
+}
+
+func benchEnvInt(b *testing.B, name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+
+	var n int
+	_, err := fmt.Sscanf(s, "%d", &n)
+	if err != nil || n < 1 {
+		b.Fatalf("Invalid %s: %s", name, s)
+	}
+	return n
+}
+
+func benchMin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// benchRecord generates a record shaped like those clients send, with the
+// values spread over a realistic number of versions and OSes.
+func benchRecord(rng *rand.Rand, uid string) map[string]interface{} {
+	versions := []string{"v2.4.17", "v2.5.9", "v2.5.10", "v2.6.0", "v2.6.1"}
+	oses := []string{"linux", "windows"}
+
+	byOs := map[string]int{}
+	for _, name := range oses {
+		if n := rng.Intn(20); n > 0 {
+			byOs[name] = n
+		}
+	}
+
+	return map[string]interface{}{
+		"r": 2,
+		"install": map[string]interface{}{
+			"uid":     uid,
+			"version": versions[rng.Intn(len(versions))],
+		},
+		"cluster": map[string]interface{}{
+			"active": rng.Intn(10),
+			"total":  rng.Intn(20),
+			"node": map[string]interface{}{
+				"count": rng.Intn(200),
+			},
+			"namespace": map[string]interface{}{
+				"total": rng.Intn(100),
+				"os":    byOs,
+			},
+		},
+	}
+}
@@ -0,0 +1,389 @@
+package publish
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of rollups, each kept in a rollup_<kind> table.
+const (
+	RollupFields = "field"
+	RollupMaps   = "map"
+	RollupValues = "value"
+)
+
+// RollupMigration is the migration adding the rollup tables.
+const RollupMigration = 8
+
+// rollupLock is the advisory lock held while rolling up a day, so servers
+// sharing the DB don't roll up the same one twice.
+const rollupLock = 0x726f6c6c7570
+
+// RollupConfig is the fields whose daily aggregates are rolled up: numeric
+// paths as read by SumByDay, map paths as read by SumByDayMap and string
+// paths as read by SumByDayValue.
+type RollupConfig struct {
+	Fields []string
+	Maps   []string
+	Values []string
+}
+
+// NewRollupConfig checks the fields of each kind. They may be given as
+// comma separated lists, and are deduplicated.
+func NewRollupConfig(fields, maps, values []string) (RollupConfig, error) {
+	var config RollupConfig
+	var err error
+
+	config.Fields, err = rollupPaths(fields)
+	if err != nil {
+		return config, err
+	}
+	config.Maps, err = rollupPaths(maps)
+	if err != nil {
+		return config, err
+	}
+	config.Values, err = rollupPaths(values)
+	return config, err
+}
+
+func rollupPaths(in []string) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, list := range in {
+		for _, field := range strings.Split(list, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" || seen[field] {
+				continue
+			}
+			if !fieldIsValid(field) {
+				return nil, fmt.Errorf("Invalid rollup field %q", field)
+			}
+			seen[field] = true
+			out = append(out, field)
+		}
+	}
+	return out, nil
+}
+
+// Empty tells whether there is nothing to roll up.
+func (c RollupConfig) Empty() bool {
+	return len(c.Fields) == 0 && len(c.Maps) == 0 && len(c.Values) == 0
+}
+
+// RollupStats is the daily aggregate of a numeric path, over the records
+// that have it.
+type RollupStats struct {
+	Sum   int64
+	Min   int64
+	Max   int64
+	Count int64
+}
+
+// Aggregate returns the value SumByDay reports for field, picked by its
+// suffix like fieldQuery does, or false if no record has it.
+func (s RollupStats) Aggregate(field string) (int64, bool) {
+	if s.Count == 0 {
+		return 0, false
+	}
+
+	switch fieldAggregate(field) {
+	case "min":
+		return s.Min, true
+	case "max":
+		return s.Max, true
+	case "avg":
+		return int64(math.Round(float64(s.Sum) / float64(s.Count))), true
+	}
+	return s.Sum, true
+}
+
+// Rollup rolls up the closed days of the fields in config, each from the day
+// after the last one it is rolled up through, until stop is closed. A field
+// that fails is logged and skipped. It returns how many days of fields it
+// rolled up.
+func (p *Postgres) Rollup(config RollupConfig, stop <-chan struct{}) int {
+	kinds := []struct {
+		kind   string
+		fields []string
+	}{
+		{RollupFields, config.Fields},
+		{RollupMaps, config.Maps},
+		{RollupValues, config.Values},
+	}
+
+	total := 0
+	for _, k := range kinds {
+		for _, field := range k.fields {
+			n, err := p.rollupField(k.kind, field, stop)
+			total += n
+			if err != nil {
+				log.Errorf("Error rolling up %s %s: %s", k.kind, field, err)
+			}
+		}
+	}
+
+	if total > 0 {
+		log.Infof("Rolled up %d days of fields", total)
+	}
+	return total
+}
+
+func (p *Postgres) rollupField(kind, field string, stop <-chan struct{}) (int, error) {
+	day, err := p.rollupStart(kind, field)
+	if err != nil || day.IsZero() {
+		return 0, err
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+
+	n := 0
+	for ; day.Format("2006-01-02") <= yesterday; day = day.AddDate(0, 0, 1) {
+		select {
+		case <-stop:
+			return n, nil
+		default:
+		}
+
+		err = p.rollupDay(kind, field, day.Format("2006-01-02"))
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// rollupStart is the first day of field not rolled up yet, zero if there
+// are no records at all.
+func (p *Postgres) rollupStart(kind, field string) (time.Time, error) {
+	var through time.Time
+	err := p.Conn.QueryRow(`SELECT through FROM rollup_state WHERE kind=$1 AND field=$2`, kind, field).Scan(&through)
+	if err == nil {
+		return through.AddDate(0, 0, 1), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+
+	var first sql.NullTime
+	err = p.Conn.QueryRow(`SELECT min(day) FROM byday`).Scan(&first)
+	return first.Time, err
+}
+
+// rollupDay replaces the aggregates of field on day, and moves its state
+// past it.
+func (p *Postgres) rollupDay(kind, field, day string) error {
+	insert, err := rollupQuery(kind, field, p.recordDoc())
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.Conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, rollupLock)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	// Another server may have rolled it up meanwhile.
+	var done bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM rollup_state WHERE kind=$1 AND field=$2 AND through >= $3)`, kind, field, day).Scan(&done)
+	if err != nil || done {
+		return rollback(tx, err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM rollup_`+kind+` WHERE field=$1 AND day=$2`, field, day)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	log.Debugf("Query: %s", insert)
+	_, err = tx.Exec(insert, field, day)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO rollup_state(kind,field,through,updated) VALUES ($1,$2,$3,NOW())
+ON CONFLICT(kind,field) DO UPDATE SET through=excluded.through, updated=excluded.updated`, kind, field, day)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+// rollupQuery aggregates field over the records of a day, like SumByDay,
+// SumByDayMap or SumByDayValue do for all installs, into its rollup table.
+// It takes the field and the day as parameters.
+func rollupQuery(kind, field, doc string) (string, error) {
+	if !fieldIsValid(field) {
+		return "", errors.New("Invalid field")
+	}
+
+	path := jsonPath(strings.Split(field, "."))
+
+	switch kind {
+	case RollupFields:
+		sql := `INSERT INTO rollup_field(field,day,sum,min,max,count)
+SELECT $1, $2::date, sum(f.v), min(f.v), max(f.v), count(f.v)
+FROM (
+	SELECT (%s #>> %s)::int AS v
+	FROM byday b
+		JOIN record r ON (b.record_id = r.id)
+	WHERE b.day = $2::date
+		AND b.uid <> ''
+) AS f
+HAVING count(*) > 0`
+		return fmt.Sprintf(sql, doc, path), nil
+	case RollupMaps:
+		sql := `INSERT INTO rollup_map(field,day,key,value)
+SELECT $1, $2::date, jet.key, sum(jet.value::int)
+FROM byday b
+	JOIN record r ON (b.record_id = r.id),
+	jsonb_each_text(%s #> %s) AS jet
+WHERE b.day = $2::date
+	AND b.uid <> ''
+GROUP BY jet.key`
+		return fmt.Sprintf(sql, doc, path), nil
+	case RollupValues:
+		sql := `INSERT INTO rollup_value(field,day,key,value)
+SELECT $1, $2::date, (%s #>> %s) AS key, count(*)
+FROM byday b
+	JOIN record r ON (b.record_id = r.id)
+WHERE b.day = $2::date
+	AND b.uid <> ''
+	AND (%s #>> %s) IS NOT NULL
+GROUP BY key`
+		return fmt.Sprintf(sql, doc, path, doc, path), nil
+	}
+
+	return "", fmt.Errorf("Invalid rollup kind %q", kind)
+}
+
+// rolledUp tells whether each of fields is rolled up through yesterday, so
+// only today needs reading from the records.
+func (p *Postgres) rolledUp(kind string, fields []string) bool {
+	unique := map[string]bool{}
+	for _, field := range fields {
+		unique[field] = true
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+
+	var n int
+	err := p.Conn.QueryRow(`SELECT count(*) FROM rollup_state WHERE kind=$1 AND field = ANY($2) AND through >= $3`,
+		kind, pq.Array(fields), yesterday).Scan(&n)
+	if err != nil {
+		// The rollup tables are missing until the schema is migrated.
+		log.Debugf("Error checking rollups, reading records: %s", err)
+		return false
+	}
+	return n == len(unique)
+}
+
+// sumByDayRollup is SumByDay for all installs, of today from the records
+// and of the days before from the rollups.
+func (p *Postgres) sumByDayRollup(days int, fields []string) (AggregatedFieldsByDate, error) {
+	out, err := p.sumByDay(0, fields, "")
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+	today := time.Now().Format("2006-01-02")
+
+	sql := `SELECT field, day, coalesce(sum,0), coalesce(min,0), coalesce(max,0), count
+FROM rollup_field
+WHERE field = ANY($1)
+	AND day >= $2
+	AND day < $3`
+
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, pq.Array(fields), since, today)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var field string
+		var day time.Time
+		var stats RollupStats
+
+		err = rows.Scan(&field, &day, &stats.Sum, &stats.Min, &stats.Max, &stats.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		dayStr := day.Format("2006-01-02")
+		entry, ok := out[dayStr]
+		if !ok {
+			entry = make(AggregatedFields)
+			out[dayStr] = entry
+		}
+
+		for _, f := range fields {
+			if f != field {
+				continue
+			}
+			if val, ok := stats.Aggregate(f); ok {
+				entry[f] = val
+			}
+		}
+	}
+
+	return out, rows.Err()
+}
+
+// sumByDayKeysRollup is SumByDayMap or SumByDayValue for all installs, with
+// today's counts in out, adding those of the days before from the rollups.
+func (p *Postgres) sumByDayKeysRollup(out AggregatedFieldsByDate, kind string, days int, field string) (AggregatedFieldsByDate, error) {
+	since := time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+	today := time.Now().Format("2006-01-02")
+
+	sql := `SELECT day, key, value
+FROM rollup_` + kind + `
+WHERE field = $1
+	AND day >= $2
+	AND day < $3`
+
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, field, since, today)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var key string
+		var val int64
+
+		err = rows.Scan(&day, &key, &val)
+		if err != nil {
+			return nil, err
+		}
+
+		dayStr := day.Format("2006-01-02")
+		byDate, ok := out[dayStr]
+		if !ok {
+			byDate = make(AggregatedFields)
+			out[dayStr] = byDate
+		}
+
+		byDate[key] = val
+	}
+
+	return out, rows.Err()
+}
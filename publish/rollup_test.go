@@ -0,0 +1,47 @@
+package publish_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+)
+
+func TestRollupConfig(t *testing.T) {
+	config, err := publish.NewRollupConfig(
+		[]string{"cluster.node.count, cluster.cpu.cores_max", "cluster.node.count"},
+		nil,
+		[]string{"install.version"},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cluster.node.count", "cluster.cpu.cores_max"}, config.Fields)
+	assert.Empty(t, config.Maps)
+	assert.Equal(t, []string{"install.version"}, config.Values)
+	assert.False(t, config.Empty())
+
+	config, err = publish.NewRollupConfig(nil, []string{" , "}, nil)
+	assert.Nil(t, err)
+	assert.True(t, config.Empty())
+
+	_, err = publish.NewRollupConfig(nil, []string{"cluster.namespace.os;"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestRollupStats(t *testing.T) {
+	stats := publish.RollupStats{Sum: 15, Min: 1, Max: 8, Count: 2}
+
+	for field, expected := range map[string]int64{
+		"cluster.node.count":    15,
+		"cluster.cpu.cores_min": 1,
+		"cluster.cpu.cores_max": 8,
+		"cluster.cpu.cores_avg": 8,
+	} {
+		val, ok := stats.Aggregate(field)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, val, field)
+	}
+
+	_, ok := publish.RollupStats{}.Aggregate("cluster.node.count")
+	assert.False(t, ok)
+}
@@ -0,0 +1,268 @@
+package publish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const spoolExt = ".json"
+
+// Spool is an on-disk FIFO of payloads that could not be delivered yet.
+// Entries are plain files named after the time they were added, so the
+// queue survives restarts and keeps its order.
+type Spool struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu  sync.Mutex
+	seq int
+}
+
+type SpoolStats struct {
+	Pending int        `json:"pending"`
+	Bytes   int64      `json:"bytes"`
+	Oldest  *time.Time `json:"oldest,omitempty"`
+}
+
+type spoolEntry struct {
+	name  string
+	added time.Time
+	size  int64
+}
+
+func NewSpool(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}, nil
+}
+
+// Add appends data to the end of the spool and then enforces the size and
+// age limits, dropping the oldest entries first.
+func (s *Spool) Add(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.write(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.prune()
+	return err
+}
+
+// Append appends data to the end of the spool without enforcing the limits
+// and returns the name of its entry.
+func (s *Spool) Append(data []byte) (string, error) {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	return s.writeEntry(data, seq)
+}
+
+// write stores data as a new entry. The caller must hold s.mu.
+func (s *Spool) write(data []byte) (string, error) {
+	s.seq++
+	return s.writeEntry(data, s.seq)
+}
+
+func (s *Spool) writeEntry(data []byte, seq int) (string, error) {
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), seq%1000000, spoolExt)
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Entries returns the names of the entries in the spool, oldest first,
+// without enforcing the limits.
+func (s *Spool) Entries() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, entry.name)
+	}
+	return out, nil
+}
+
+// Read returns the data of the entry name.
+func (s *Spool) Read(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, name))
+}
+
+// Peek returns the oldest entry in the spool. An empty name means the spool
+// is empty.
+func (s *Spool) Peek() (string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.prune()
+	if err != nil || len(entries) == 0 {
+		return "", nil, err
+	}
+
+	name := entries[0].name
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, data, nil
+}
+
+func (s *Spool) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Spool) Stats() (SpoolStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := SpoolStats{}
+
+	entries, err := s.prune()
+	if err != nil {
+		return out, err
+	}
+
+	out.Pending = len(entries)
+	for _, entry := range entries {
+		out.Bytes += entry.size
+	}
+
+	if len(entries) > 0 {
+		oldest := entries[0].added
+		out.Oldest = &oldest
+	}
+
+	return out, nil
+}
+
+// prune drops entries past the age and size limits and returns the rest,
+// oldest first. The caller must hold s.mu.
+func (s *Spool) prune() ([]spoolEntry, error) {
+	entries, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	for len(entries) > 0 {
+		entry := entries[0]
+		expired := s.maxAge > 0 && time.Since(entry.added) > s.maxAge
+		oversize := s.maxSize > 0 && total > s.maxSize
+		if !expired && !oversize {
+			break
+		}
+
+		log.Warnf("Dropping spooled report %s (expired=%t, oversize=%t)", entry.name, expired, oversize)
+		err = os.Remove(filepath.Join(s.dir, entry.name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		total -= entry.size
+		entries = entries[1:]
+	}
+
+	return entries, nil
+}
+
+func (s *Spool) list() ([]spoolEntry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []spoolEntry{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil {
+			log.Debugf("Ignoring unknown file in spool: %s", name)
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		out = append(out, spoolEntry{
+			name:  name,
+			added: time.Unix(0, nanos),
+			size:  info.Size(),
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+
+	return out, nil
+}
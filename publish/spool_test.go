@@ -0,0 +1,92 @@
+package publish_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolKeepsOrder(t *testing.T) {
+	spool, err := publish.NewSpool(t.TempDir(), 0, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Add([]byte("first")))
+	assert.Nil(t, spool.Add([]byte("second")))
+
+	stats, err := spool.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, int64(len("first")+len("second")), stats.Bytes)
+	assert.NotNil(t, stats.Oldest)
+
+	name, data, err := spool.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(data))
+	assert.Nil(t, spool.Remove(name))
+
+	name, data, err = spool.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.Nil(t, spool.Remove(name))
+
+	name, _, err = spool.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := publish.NewSpool(dir, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, spool.Add([]byte("pending")))
+
+	spool, err = publish.NewSpool(dir, 0, 0)
+	assert.Nil(t, err)
+	_, data, err := spool.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "pending", string(data))
+}
+
+func TestSpoolDropsOldestOverSize(t *testing.T) {
+	spool, err := publish.NewSpool(t.TempDir(), 10, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Add([]byte("123456")))
+	assert.Nil(t, spool.Add([]byte("abcdef")))
+
+	stats, err := spool.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Pending)
+
+	_, data, err := spool.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdef", string(data))
+}
+
+func TestSpoolDropsExpired(t *testing.T) {
+	spool, err := publish.NewSpool(t.TempDir(), 0, time.Millisecond)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Add([]byte("stale")))
+	time.Sleep(5 * time.Millisecond)
+
+	stats, err := spool.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Pending)
+}
+
+func TestSpoolIgnoresUnknownFiles(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := publish.NewSpool(dir, 0, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(dir+"/notes.json", []byte("{}"), 0600))
+	assert.Nil(t, os.WriteFile(dir+"/.tmp-123", []byte("{}"), 0600))
+
+	stats, err := spool.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Pending)
+}
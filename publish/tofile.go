@@ -0,0 +1,321 @@
+package publish
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+const rotatedTimeFormat = "20060102T150405.000"
+
+// ToFile appends records as JSON lines to a local file. The file is rotated
+// when it would grow past maxSize or when the day changes, and only the
+// newest retain rotated files are kept.
+type ToFile struct {
+	path     string
+	maxSize  int64
+	compress bool
+	retain   int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// rotated is the time in the name of the last rotated file. Names must
+	// keep increasing, or a name freed by pruning would be reused for a newer
+	// file that then sorts, and is pruned, as the oldest.
+	rotated time.Time
+}
+
+func init() {
+	Register("file", newToFilePublisher)
+}
+
+func NewToFile(path string, maxSize int64, compress bool, retain int) (*ToFile, error) {
+	if path == "" {
+		return nil, errors.New("No file path given")
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ToFile{
+		path:     path,
+		maxSize:  maxSize,
+		compress: compress,
+		retain:   retain,
+	}
+
+	// Carry on after the files a previous run rotated, even if the clock
+	// has since been set back.
+	for _, name := range p.rotatedFiles() {
+		if at, ok := p.rotatedTime(name); ok && at.After(p.rotated) {
+			p.rotated = at
+		}
+	}
+
+	return p, nil
+}
+
+func newToFilePublisher(c *cli.Context, dest *url.URL) (Publisher, error) {
+	path := dest.Opaque
+	if path == "" {
+		path = dest.Host + dest.Path
+	}
+
+	return NewToFile(filepath.FromSlash(path), c.Int64("file-max-size"), c.Bool("file-compress"), c.Int("file-retain"))
+}
+
+func (p *ToFile) Report(r record.Record, clientIp string) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file == nil {
+		err = p.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	newDay := !sameDay(p.opened, now)
+	tooBig := p.maxSize > 0 && p.size > 0 && p.size+int64(len(b)) > p.maxSize
+	if newDay || tooBig {
+		// A day's file is named after that day, not the first write past it.
+		at := now
+		if newDay {
+			at = p.opened
+		}
+		err = p.rotate(at)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := p.file.Write(b)
+	p.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return p.file.Sync()
+}
+
+func (p *ToFile) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file == nil {
+		return nil
+	}
+
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// open opens the current file for appending, picking up where a previous
+// run left off.
+func (p *ToFile) open() error {
+	file, err := os.OpenFile(p.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	p.file = file
+	p.size = info.Size()
+	p.opened = time.Now()
+	if p.size > 0 {
+		p.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+// rotate moves the current file aside, named after at, compressing it if
+// asked to, prunes old rotated files and opens a fresh one.
+func (p *ToFile) rotate(at time.Time) error {
+	err := p.file.Close()
+	p.file = nil
+	if err != nil {
+		return err
+	}
+
+	if p.size > 0 {
+		name, err := p.rotatedName(at)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(p.path, name)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Rotated %s to %s", p.path, name)
+
+		if p.compress {
+			err = gzipFile(name)
+			if err != nil {
+				log.Errorf("Error compressing %s: %s", name, err)
+			}
+		}
+
+		p.prune()
+	}
+
+	return p.open()
+}
+
+func (p *ToFile) rotatedName(at time.Time) (string, error) {
+	ext := filepath.Ext(p.path)
+	base := strings.TrimSuffix(p.path, ext)
+
+	at = at.Truncate(time.Millisecond)
+	if !at.After(p.rotated) {
+		at = p.rotated.Add(time.Millisecond)
+	}
+
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("%s-%s%s", base, at.Format(rotatedTimeFormat), ext)
+
+		_, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			_, err = os.Stat(name + ".gz")
+		}
+		if os.IsNotExist(err) {
+			p.rotated = at
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		at = at.Add(time.Millisecond)
+	}
+
+	return "", fmt.Errorf("No free name to rotate %s to", p.path)
+}
+
+// prune removes the oldest rotated files beyond the retention count.
+func (p *ToFile) prune() {
+	if p.retain <= 0 {
+		return
+	}
+
+	rotated := p.rotatedFiles()
+	for len(rotated) > p.retain {
+		log.Debugf("Removing rotated file %s", rotated[0])
+		err := os.Remove(rotated[0])
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing rotated file %s: %s", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// rotatedFiles lists the rotated files, oldest first.
+func (p *ToFile) rotatedFiles() []string {
+	ext := filepath.Ext(p.path)
+	base := strings.TrimSuffix(p.path, ext)
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		log.Errorf("Error listing rotated files of %s: %s", p.path, err)
+		return nil
+	}
+
+	// Other files may share the prefix, only those named by rotate count.
+	rotated := []string{}
+	for _, name := range matches {
+		if _, ok := p.rotatedTime(name); ok {
+			rotated = append(rotated, name)
+		}
+	}
+
+	// The timestamp in the name sorts them oldest first.
+	sort.Strings(rotated)
+	return rotated
+}
+
+// rotatedTime parses the time in the name of a rotated file.
+func (p *ToFile) rotatedTime(name string) (time.Time, bool) {
+	ext := filepath.Ext(p.path)
+	prefix := strings.TrimSuffix(p.path, ext) + "-"
+	stamp := strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(stamp, prefix) || !strings.HasSuffix(stamp, ext) {
+		return time.Time{}, false
+	}
+	stamp = strings.TrimSuffix(strings.TrimPrefix(stamp, prefix), ext)
+
+	at, err := time.ParseInLocation(rotatedTimeFormat, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,174 @@
+package publish_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+func readLines(t *testing.T, name string) []record.Record {
+	file, err := os.Open(name)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(file)
+		assert.Nil(t, err)
+		scanner = bufio.NewScanner(zr)
+	}
+
+	out := []record.Record{}
+	for scanner.Scan() {
+		r := record.Record{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &r))
+		out = append(out, r)
+	}
+	assert.Nil(t, scanner.Err())
+
+	return out
+}
+
+func rotated(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "records-*"))
+	assert.Nil(t, err)
+	return matches
+}
+
+func TestToFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	p, err := publish.NewToFile(path, 0, false, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, p.Report(record.Record{"n": 1}, ""))
+	assert.Nil(t, p.Close())
+
+	p, err = publish.NewToFile(path, 0, false, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Report(record.Record{"n": 2}, ""))
+	assert.Nil(t, p.Close())
+
+	lines := readLines(t, path)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, float64(1), lines[0]["n"])
+	assert.Equal(t, float64(2), lines[1]["n"])
+}
+
+func TestToFileRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+	p, err := publish.NewToFile(path, 10, true, 0)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	assert.Nil(t, p.Report(record.Record{"n": 1}, ""))
+	assert.Nil(t, p.Report(record.Record{"n": 2}, ""))
+
+	files := rotated(t, dir)
+	assert.Equal(t, 1, len(files))
+	assert.True(t, strings.HasSuffix(files[0], ".jsonl.gz"))
+	assert.Equal(t, float64(1), readLines(t, files[0])[0]["n"])
+	assert.Equal(t, float64(2), readLines(t, path)[0]["n"])
+}
+
+func TestToFileRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+	p, err := publish.NewToFile(path, 1, false, 2)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, p.Report(record.Record{"n": i}, ""))
+	}
+
+	files := rotated(t, dir)
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, float64(3), readLines(t, files[0])[0]["n"])
+	assert.Equal(t, float64(4), readLines(t, files[1])[0]["n"])
+	assert.Equal(t, float64(5), readLines(t, path)[0]["n"])
+}
+
+func TestToFileRotatesAfterPreviousRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+
+	// Rotated by a run whose clock was ahead.
+	ahead := filepath.Join(dir, "records-"+time.Now().Add(time.Hour).Format("20060102T150405.000")+".jsonl")
+	assert.Nil(t, os.WriteFile(ahead, []byte("{\"n\":0}\n"), 0600))
+
+	p, err := publish.NewToFile(path, 1, false, 1)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	assert.Nil(t, p.Report(record.Record{"n": 1}, ""))
+	assert.Nil(t, p.Report(record.Record{"n": 2}, ""))
+
+	files := rotated(t, dir)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, float64(1), readLines(t, files[0])[0]["n"])
+}
+
+func TestToFileRotatesByDay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	assert.Nil(t, os.WriteFile(path, []byte("{\"n\":1}\n"), 0600))
+	assert.Nil(t, os.Chtimes(path, yesterday, yesterday))
+
+	p, err := publish.NewToFile(path, 0, false, 0)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	assert.Nil(t, p.Report(record.Record{"n": 2}, ""))
+
+	files := rotated(t, dir)
+	assert.Equal(t, 1, len(files))
+	assert.Contains(t, filepath.Base(files[0]), "records-"+yesterday.Format("20060102")+"T")
+	assert.Equal(t, float64(1), readLines(t, files[0])[0]["n"])
+	assert.Equal(t, float64(2), readLines(t, path)[0]["n"])
+}
+
+func TestToFileLeavesOtherFilesAlone(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+
+	others := []string{
+		filepath.Join(dir, "records-backup.jsonl"),
+		filepath.Join(dir, "records-backup.jsonl.old"),
+		filepath.Join(dir, "records-99991231T235959.999.jsonl.old"),
+	}
+	for _, name := range others {
+		assert.Nil(t, os.WriteFile(name, []byte("{\"n\":0}\n"), 0600))
+	}
+
+	p, err := publish.NewToFile(path, 1, false, 1)
+	assert.Nil(t, err)
+	defer p.Close()
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, p.Report(record.Record{"n": i}, ""))
+	}
+
+	for _, name := range others {
+		_, err := os.Stat(name)
+		assert.Nil(t, err, name)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "records-2*.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, float64(2), readLines(t, files[0])[0]["n"])
+	assert.Equal(t, float64(3), readLines(t, path)[0]["n"])
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -16,19 +17,35 @@ import (
 type ToUrl struct {
 	url              string
 	telemetryVersion string
+	client           *http.Client
 }
 
-func NewToUrl(c *cli.Context) *ToUrl {
+func init() {
+	Register("http", newToUrlPublisher)
+	Register("https", newToUrlPublisher)
+}
+
+func NewToUrl(c *cli.Context, url string) (*ToUrl, error) {
+	client, err := NewHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
 	out := &ToUrl{
 		telemetryVersion: c.App.Version,
-		url:              c.String("to-url"),
+		url:              url,
+		client:           client,
 	}
 
 	if out.url == "" {
 		log.Warn("No to-url configured, not publishing")
 	}
 
-	return out
+	return out, nil
+}
+
+func newToUrlPublisher(c *cli.Context, dest *url.URL) (Publisher, error) {
+	return NewToUrl(c, dest.String())
 }
 
 func (p *ToUrl) Report(r record.Record, clientIp string) error {
@@ -41,7 +58,7 @@ func (p *ToUrl) Report(r record.Record, clientIp string) error {
 		return err
 	}
 
-	res, err := http.Post(p.url, "application/json", bytes.NewBuffer(b))
+	res, err := p.client.Post(p.url, "application/json", bytes.NewBuffer(b))
 	if err != nil {
 		return err
 	}
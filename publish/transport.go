@@ -0,0 +1,124 @@
+package publish
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// NewHTTPClient creates the client used to send reports, configured by the
+// publish-* flags. Unlike http.DefaultClient, every request made with it
+// has a deadline, so a hung endpoint cannot block reporting forever.
+func NewHTTPClient(c *cli.Context) (*http.Client, error) {
+	connectTimeout, err := parseTimeout(c, "publish-connect-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := parseTimeout(c, "publish-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout, err := parseTimeout(c, "publish-idle-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if proxyUrl := c.String("publish-proxy"); proxyUrl != "" {
+		u, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig, err := newTLSConfig(c.String("publish-ca-file"), c.String("publish-cert-file"), c.String("publish-key-file"))
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		IdleConnTimeout:       idleTimeout,
+		MaxIdleConns:          10,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// newTLSConfig trusts caFile on top of the system roots and presents
+// certFile/keyFile as client certificate, when given.
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	out := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Warnf("Error loading system CA certificates, only trusting %s: %s", caFile, err)
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in " + caFile)
+		}
+		out.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("publish-cert-file and publish-key-file must be given together")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		out.Certificates = []tls.Certificate{cert}
+	}
+
+	return out, nil
+}
+
+func parseTimeout(c *cli.Context, name string) (time.Duration, error) {
+	value := c.String(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New(name + " must be a valid GoLang duration string")
+	}
+
+	return dur, nil
+}
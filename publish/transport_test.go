@@ -0,0 +1,86 @@
+package publish_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/publish"
+	"github.com/rancher/telemetry/record"
+)
+
+func writeCA(t *testing.T, server *httptest.Server) string {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(name, data, 0600))
+	return name
+}
+
+func TestToUrlTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p, err := publish.NewToUrl(newContext("publish-timeout", "100ms"), server.URL)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	assert.NotNil(t, p.Report(record.Record{}, ""))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestToUrlCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	p, err := publish.NewToUrl(newContext(), server.URL)
+	assert.Nil(t, err)
+	assert.NotNil(t, p.Report(record.Record{}, ""))
+
+	p, err = publish.NewToUrl(newContext("publish-ca-file", writeCA(t, server)), server.URL)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Report(record.Record{}, ""))
+}
+
+func TestToUrlClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// The test server's own certificate doubles as client certificate.
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+
+	p, err := publish.NewToUrl(newContext("publish-ca-file", writeCA(t, server)), server.URL)
+	assert.Nil(t, err)
+	assert.NotNil(t, p.Report(record.Record{}, ""))
+
+	p, err = publish.NewToUrl(newContext(
+		"publish-ca-file", writeCA(t, server),
+		"publish-cert-file", certFile,
+		"publish-key-file", keyFile,
+	), server.URL)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Report(record.Record{}, ""))
+
+	_, err = publish.NewToUrl(newContext("publish-cert-file", certFile), server.URL)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,125 @@
+package publish
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// upgradeBatch is how many records UpgradeRecords reads at a time.
+const upgradeBatch = 500
+
+// UpgradeStats is how a run of UpgradeRecords went.
+type UpgradeStats struct {
+	Records  int `json:"records"`
+	Upgraded int `json:"upgraded"` // arrived as an older version
+	Updated  int `json:"updated"`
+	Failed   int `json:"failed"`
+}
+
+type storedRecord struct {
+	id      int
+	data    []byte
+	version sql.NullInt64
+}
+
+// UpgradeRecords runs the upgraders again over every stored record, from
+// the payload it arrived with, and stores the result. Records the upgraders
+// fail on are logged and left alone. Nothing is written if dryRun is set.
+func (p *Postgres) UpgradeRecords(dryRun bool) (UpgradeStats, error) {
+	stats := UpgradeStats{}
+
+	last := 0
+	for {
+		batch, err := p.recordsAfter(last)
+		if err != nil {
+			return stats, err
+		}
+		if len(batch) == 0 {
+			return stats, nil
+		}
+
+		for _, stored := range batch {
+			last = stored.id
+			stats.Records++
+
+			original := record.Record{}
+			err = json.Unmarshal(stored.data, &original)
+			if err != nil {
+				log.Warnf("Skipping record %d: %s", stored.id, err)
+				stats.Failed++
+				continue
+			}
+
+			upgraded, from, err := record.Upgrade(original)
+			if err != nil {
+				log.Warnf("Skipping record %d: %s", stored.id, err)
+				stats.Failed++
+				continue
+			}
+			if from != record.VERSION {
+				stats.Upgraded++
+			}
+
+			// Records that arrived current and already say so stay as they are.
+			if from == record.VERSION && stored.version.Valid {
+				continue
+			}
+			stats.Updated++
+			if dryRun {
+				continue
+			}
+
+			err = p.updateRecord(stored.id, original, upgraded, from)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+}
+
+func (p *Postgres) recordsAfter(id int) ([]storedRecord, error) {
+	rows, err := p.Conn.Query(`SELECT id, coalesce(raw, data), version
+FROM record
+WHERE id > $1
+ORDER BY id
+LIMIT $2`, id, upgradeBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []storedRecord{}
+	for rows.Next() {
+		stored := storedRecord{}
+		err = rows.Scan(&stored.id, &stored.data, &stored.version)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stored)
+	}
+
+	return out, rows.Err()
+}
+
+func (p *Postgres) updateRecord(id int, original, upgraded record.Record, from int) error {
+	data, err := json.Marshal(upgraded)
+	if err != nil {
+		return err
+	}
+
+	var raw record.Record
+	if from != record.VERSION {
+		raw = original
+	}
+	rawData, err := marshalRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.Conn.Exec(`UPDATE record SET data=$2, raw=$3, version=$4 WHERE id=$1`, id, string(data), rawData, from)
+	return err
+}
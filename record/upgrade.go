@@ -0,0 +1,128 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// VERSION is the shape of the records clients send now. Records of older
+// versions are upgraded to it.
+const VERSION = 2
+
+// Upgrader turns a record of one version into the next one.
+type Upgrader func(r Record) (Record, error)
+
+// upgraders holds the upgrader from each version to the next.
+var upgraders = map[int]Upgrader{
+	1: upgradeV1,
+}
+
+// Version returns the version r is stamped with. Records from before
+// versions were stamped are version 1.
+func Version(r Record) (int, error) {
+	v, ok := r["r"]
+	if !ok {
+		return 1, nil
+	}
+
+	var version float64
+	switch n := v.(type) {
+	case float64:
+		version = n
+	case int:
+		version = float64(n)
+	case json.Number:
+		f, err := n.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("Invalid record version %s", n)
+		}
+		version = f
+	default:
+		return 0, fmt.Errorf("Invalid record version %v", v)
+	}
+
+	if version < 1 || version != math.Trunc(version) {
+		return 0, fmt.Errorf("Invalid record version %v", v)
+	}
+	return int(version), nil
+}
+
+// Upgrade runs r through the upgraders up to VERSION. It returns the
+// upgraded record and the version r arrived as. r itself is left alone.
+func Upgrade(r Record) (Record, int, error) {
+	from, err := Version(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > VERSION {
+		return nil, from, fmt.Errorf("Record version %d is newer than %d", from, VERSION)
+	}
+	if from == VERSION {
+		return r, from, nil
+	}
+
+	out, err := deepCopy(r)
+	if err != nil {
+		return nil, from, err
+	}
+
+	for version := from; version < VERSION; version++ {
+		upgrade, ok := upgraders[version]
+		if !ok {
+			return nil, from, fmt.Errorf("No upgrader from record version %d", version)
+		}
+
+		out, err = upgrade(out)
+		if err != nil {
+			return nil, from, fmt.Errorf("Error upgrading record version %d: %s", version, err)
+		}
+		out["r"] = version + 1
+	}
+
+	return out, from, nil
+}
+
+func deepCopy(r Record) (Record, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	out := Record{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// upgradeV1 turns a Rancher 1.x record into a Rancher 2.x one. Hosts become
+// nodes and environments become projects, along with their orchestration.
+// Stacks, services and containers have no counterpart and are left out.
+func upgradeV1(r Record) (Record, error) {
+	out := Record{}
+	for _, key := range []string{"r", "ts", "install"} {
+		if v, ok := r[key]; ok {
+			out[key] = v
+		}
+	}
+
+	if host, ok := r["host"]; ok {
+		out["node"] = host
+	}
+
+	if env, ok := r["environment"]; ok {
+		envMap, ok := env.(map[string]interface{})
+		if !ok && env != nil {
+			return nil, fmt.Errorf("environment is a %T", env)
+		}
+
+		project := map[string]interface{}{}
+		for _, key := range []string{"total", "orch"} {
+			if v, ok := envMap[key]; ok {
+				project[key] = v
+			}
+		}
+		out["project"] = project
+	}
+
+	return out, nil
+}
@@ -0,0 +1,70 @@
+package record_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/record"
+)
+
+func decode(t *testing.T, data string) record.Record {
+	r := record.Record{}
+	assert.Nil(t, json.Unmarshal([]byte(data), &r))
+	return r
+}
+
+func TestUpgradeV1(t *testing.T) {
+	in := decode(t, `{
+		"r": 1,
+		"ts": "2018-06-01T00:00:00Z",
+		"install": {"uid": "abc", "version": "v1.6.14"},
+		"environment": {"total": 3, "active": 2, "orch": {"cattle": 2, "kubernetes": 1}},
+		"host": {"total": 5, "cpu": {"cores_total": 20}, "docker": {"17.03.2-ce": 5}},
+		"stack": {"total": 10}
+	}`)
+
+	out, from, err := record.Upgrade(in)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, from)
+	assert.Equal(t, decode(t, `{
+		"r": 2,
+		"ts": "2018-06-01T00:00:00Z",
+		"install": {"uid": "abc", "version": "v1.6.14"},
+		"project": {"total": 3, "orch": {"cattle": 2, "kubernetes": 1}},
+		"node": {"total": 5, "cpu": {"cores_total": 20}, "docker": {"17.03.2-ce": 5}}
+	}`), decode(t, mustJSON(t, out)))
+
+	// The original is left alone.
+	assert.Equal(t, float64(1), in["r"])
+	assert.Contains(t, in, "stack")
+}
+
+func TestUpgradeVersions(t *testing.T) {
+	out, from, err := record.Upgrade(decode(t, `{"install": {"uid": "abc"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, from)
+	assert.Equal(t, 2, out["r"])
+
+	current := decode(t, `{"r": 2, "install": {"uid": "abc"}}`)
+	out, from, err = record.Upgrade(current)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, from)
+	assert.Equal(t, current, out)
+
+	_, from, err = record.Upgrade(decode(t, `{"r": 3}`))
+	assert.Equal(t, "Record version 3 is newer than 2", err.Error())
+	assert.Equal(t, 3, from)
+
+	for _, bad := range []string{`{"r": "2"}`, `{"r": 1.5}`, `{"r": 0}`} {
+		_, _, err = record.Upgrade(decode(t, bad))
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	assert.Nil(t, err)
+	return string(data)
+}
@@ -0,0 +1,205 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_VERSION = 1
+
+	// archiveURL stands for the Rancher server in archived responses, so
+	// captures don't carry the customer's hostname.
+	archiveURL = "https://rancher.invalid"
+	redacted   = "REDACTED"
+)
+
+// sensitiveKey matches the JSON keys whose string values are redacted from
+// archived responses.
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passphrase|secret|token|privatekey|private_key|accesskey|apikey|credential|kubeconfig|certdata|keydata)`)
+
+// identityKey matches the JSON keys of host names, addresses and user names,
+// whose string values are redacted as well.
+var identityKey = regexp.MustCompile(`(?i)(hostname|nodename|address$|username|email)`)
+
+// principalKey matches the JSON keys of principal IDs. Only their provider
+// is kept, which is what the collectors count users by.
+var principalKey = regexp.MustCompile(`(?i)principalids?$`)
+
+// keptSettings are the settings the collectors read, whose values are kept.
+// The values of all other settings, such as server-url, are redacted.
+var keptSettings = map[string]bool{
+	"cluster-template-enforcement": true,
+	"server-version":               true,
+	"telemetry-uid":                true,
+	"ui-default-landing":           true,
+}
+
+// Archive is a capture of the Rancher API responses a collection got.
+type Archive struct {
+	Version  int       `json:"version"`
+	Recorded time.Time `json:"recorded"`
+	Entries  []Entry   `json:"entries"`
+}
+
+// Entry is a response along with the request it answered.
+type Entry struct {
+	Method      string `json:"method"`
+	URI         string `json:"uri"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        string `json:"body"`
+}
+
+// Load reads an archive written by Save.
+func Load(path string) (*Archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read archive %s: %s", path, err)
+	}
+	defer gz.Close()
+
+	archive := &Archive{}
+	err = json.NewDecoder(gz).Decode(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read archive %s: %s", path, err)
+	}
+	if archive.Version != ARCHIVE_VERSION {
+		return nil, fmt.Errorf("Archive %s has version %d, expected %d", path, archive.Version, ARCHIVE_VERSION)
+	}
+
+	return archive, nil
+}
+
+// Save writes the archive as gzipped JSON, replacing path atomically.
+func (a *Archive) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	err = json.NewEncoder(gz).Encode(a)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// requestKey identifies a request regardless of the order of its query
+// parameters.
+func requestKey(method string, u *url.URL) string {
+	return method + " " + u.Path + "?" + u.Query().Encode()
+}
+
+// redact replaces the values of sensitive keys in a JSON body. Bodies that
+// aren't JSON are returned as they are.
+//
+// Names of clusters, projects, nodes and workloads, as well as labels and
+// annotations, are kept: the collectors count and group by them.
+func redact(body []byte) []byte {
+	// Numbers are kept as they are, as float64 would round large IDs.
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var data interface{}
+	if err := dec.Decode(&data); err != nil {
+		return body
+	}
+
+	out, err := json.Marshal(redactValue(data))
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// redactValue only replaces strings, so the redacted body still fits the
+// types the collectors decode it into.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redactObject(v)
+		for key, value := range v {
+			if principalKey.MatchString(key) {
+				v[key] = redactPrincipals(value)
+				continue
+			}
+			if _, ok := value.(string); ok && (sensitiveKey.MatchString(key) || identityKey.MatchString(key)) {
+				v[key] = redacted
+				continue
+			}
+			v[key] = redactValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
+
+// redactObject redacts the display names of users and the values of the
+// settings not in keptSettings, as Rancher or Kubernetes returns them.
+func redactObject(v map[string]interface{}) {
+	switch {
+	case v["type"] == "user":
+		redactString(v, "name")
+	case v["type"] == "setting" || v["kind"] == "Setting":
+		name, _ := v["id"].(string)
+		if metadata, ok := v["metadata"].(map[string]interface{}); ok {
+			name, _ = metadata["name"].(string)
+		}
+		if !keptSettings[name] {
+			redactString(v, "value")
+			redactString(v, "default")
+		}
+	}
+}
+
+func redactString(v map[string]interface{}, key string) {
+	if s, ok := v[key].(string); ok && s != "" {
+		v[key] = redacted
+	}
+}
+
+// redactPrincipals replaces the IDs in principal IDs like
+// "github_user://1234", keeping the provider before "://".
+func redactPrincipals(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if i := strings.Index(v, "://"); i >= 0 {
+			return v[:i+3] + redacted
+		}
+		if v != "" {
+			return redacted
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactPrincipals(value)
+		}
+	}
+	return v
+}
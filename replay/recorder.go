@@ -0,0 +1,193 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Recorder is a local proxy in front of the Rancher API that keeps a
+// redacted copy of every response. Links in responses are rewritten to
+// point at the proxy, so clients following them stay on it.
+type Recorder struct {
+	listener net.Listener
+	server   *http.Server
+	client   *http.Client
+
+	mu       sync.Mutex
+	upstream *url.URL
+	entries  []Entry
+	seen     map[string]bool
+}
+
+// NewRecorder starts a Recorder on a loopback port. It reaches Rancher
+// trusting caCerts, a PEM bundle, or the system pool if empty.
+func NewRecorder(caCerts string, insecure bool) (*Recorder, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+	if caCerts != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caCerts)) {
+			return nil, errors.New("No certificates found in the CA data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		listener: listener,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			// Redirects go back to the client, rewritten like any response.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		seen: map[string]bool{},
+	}
+	r.server = &http.Server{Handler: r}
+	go r.server.Serve(listener)
+
+	return r, nil
+}
+
+// URL is the base URL to use in place of the Rancher server.
+func (r *Recorder) URL() string {
+	return "http://" + r.listener.Addr().String()
+}
+
+// SetUpstream points the proxy at the Rancher server with base URL rawURL.
+func (r *Recorder) SetUpstream(rawURL string) error {
+	upstream, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return err
+	}
+	if upstream.Scheme == "" || upstream.Host == "" {
+		return errors.New("Upstream must be an absolute URL")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.upstream = upstream
+	return nil
+}
+
+// Reset forgets the responses recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = nil
+	r.seen = map[string]bool{}
+}
+
+// Archive returns the responses recorded since the last Reset. Only the
+// first response to each request is kept.
+func (r *Recorder) Archive() *Archive {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &Archive{
+		Version:  ARCHIVE_VERSION,
+		Recorded: time.Now().UTC(),
+		Entries:  append([]Entry{}, r.entries...),
+	}
+}
+
+func (r *Recorder) Close() error {
+	return r.server.Close()
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	upstream := r.upstream
+	r.mu.Unlock()
+
+	if upstream == nil {
+		http.Error(w, "No upstream set", http.StatusBadGateway)
+		return
+	}
+
+	target := *upstream
+	target.Path = upstream.Path + req.URL.Path
+	target.RawQuery = req.URL.RawQuery
+
+	out, err := http.NewRequest(req.Method, target.String(), req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for _, header := range []string{"Authorization", "Accept", "Content-Type", "Cookie"} {
+		if value := req.Header.Get(header); value != "" {
+			out.Header.Set(header, value)
+		}
+	}
+
+	resp, err := r.client.Do(out)
+	if err != nil {
+		log.Debugf("Recorder failed to reach %s: %s", target.String(), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	base := upstream.Scheme + "://" + upstream.Host
+	r.record(req.Method, req.URL, resp, bytes.ReplaceAll(body, []byte(base), []byte(archiveURL)))
+
+	if location := resp.Header.Get("Location"); location != "" {
+		w.Header().Set("Location", strings.Replace(location, base, r.URL(), 1))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(bytes.ReplaceAll(body, []byte(base), []byte(r.URL())))
+}
+
+func (r *Recorder) record(method string, u *url.URL, resp *http.Response, body []byte) {
+	key := requestKey(method, u)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen[key] {
+		return
+	}
+	r.seen[key] = true
+
+	r.entries = append(r.entries, Entry{
+		Method:      method,
+		URI:         u.RequestURI(),
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        string(redact(body)),
+	})
+}
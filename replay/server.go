@@ -0,0 +1,87 @@
+package replay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server stands in for the Rancher API, answering requests with the
+// responses of an archive.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+	entries  map[string]Entry
+
+	mu     sync.Mutex
+	misses []string
+}
+
+// NewServer starts a Server for archive on a loopback port.
+func NewServer(archive *Archive) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		entries:  map[string]Entry{},
+	}
+	for _, entry := range archive.Entries {
+		req, err := http.NewRequest(entry.Method, entry.URI, nil)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("Invalid archive entry %s %s: %s", entry.Method, entry.URI, err)
+		}
+		s.entries[requestKey(entry.Method, req.URL)] = entry
+	}
+
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(listener)
+
+	return s, nil
+}
+
+// URL is the base URL to use in place of the Rancher server.
+func (s *Server) URL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+// Misses returns the requests that had no response in the archive.
+func (s *Server) Misses() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.misses...)
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := requestKey(req.Method, req.URL)
+	entry, ok := s.entries[key]
+	if !ok {
+		log.Warnf("No recorded response for %s %s", req.Method, req.URL.RequestURI())
+		s.mu.Lock()
+		s.misses = append(s.misses, req.Method+" "+req.URL.RequestURI())
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"type":"error","status":404,"code":"NotFound","message":"not recorded"}`)
+		return
+	}
+
+	if entry.ContentType != "" {
+		w.Header().Set("Content-Type", entry.ContentType)
+	}
+	w.WriteHeader(entry.Status)
+	w.Write([]byte(strings.ReplaceAll(entry.Body, archiveURL, s.URL())))
+}
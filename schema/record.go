@@ -0,0 +1,167 @@
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+const (
+	// InstallRecordKey is the section identifying the installation a record
+	// comes from, by its uid.
+	InstallRecordKey = "install"
+	// RecordIdKey and RecordSeqKey hold the id the client gave a record and
+	// how many records the installation sent before it. A record sent again
+	// keeps both.
+	RecordIdKey  = "rid"
+	RecordSeqKey = "seq"
+
+	draft = "https://json-schema.org/draft/2020-12/schema"
+)
+
+//go:embed record.v*.json
+var published embed.FS
+
+var records = map[int]*Schema{}
+
+func init() {
+	entries, err := published.ReadDir(".")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		var version int
+		if _, err := fmt.Sscanf(entry.Name(), "record.v%d.json", &version); err != nil {
+			continue
+		}
+
+		data, err := published.ReadFile(entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		s := &Schema{}
+		if err := json.Unmarshal(data, s); err != nil {
+			panic(fmt.Sprintf("Invalid %s: %s", entry.Name(), err))
+		}
+		records[version] = s
+	}
+}
+
+// Versions returns the record versions there is a published schema for.
+func Versions() []int {
+	out := []int{}
+	for version := range records {
+		out = append(out, version)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// ForVersion returns the published schema of records of version, or nil if
+// there is none.
+func ForVersion(version int) *Schema {
+	return records[version]
+}
+
+// Published returns the schema of records of version as published, or nil
+// if there is none.
+func Published(version int) []byte {
+	data, err := published.ReadFile(fmt.Sprintf("record.v%d.json", version))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Section is a record section and the Go value it is encoded from.
+type Section struct {
+	Key   string
+	Value interface{}
+}
+
+// NewRecordSchema generates the schema of records of version, made of meta
+// and sections. Every section may be null, for collectors that failed, and
+// sections it doesn't know about, like those of plugins, may be anything.
+// Only the uid of the install section is required, as it may be all there
+// is when the installation collector is disabled.
+func NewRecordSchema(version int, meta Section, sections ...Section) *Schema {
+	out := &Schema{
+		Schema:      draft,
+		Title:       fmt.Sprintf("Rancher telemetry record, version %d", version),
+		Description: "A report of a Rancher installation, as sent by the telemetry client.",
+		Type:        Types{"object"},
+		Properties: map[string]*Schema{
+			"r":  {Type: Types{"integer"}, Const: version},
+			"ts": {Type: Types{"string"}, Format: "date-time"},
+
+			RecordIdKey:  {Type: Types{"string"}, Format: "uuid"},
+			RecordSeqKey: {Type: Types{"integer"}},
+		},
+		Required: []string{"r", "ts", InstallRecordKey},
+	}
+
+	out.Properties[meta.Key] = FromType(reflect.TypeOf(meta.Value))
+	for _, section := range sections {
+		s := Nullable(FromType(reflect.TypeOf(section.Value)))
+		if section.Key == InstallRecordKey {
+			s.Required = []string{"uid"}
+		}
+		out.Properties[section.Key] = s
+	}
+
+	return out
+}
+
+// Marshal encodes s the way schemas are published.
+func (s *Schema) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ValidateRecord checks r against the published schema of its version. The
+// record is checked as it is encoded, so it may hold collector structs.
+func ValidateRecord(r record.Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	decoded := map[string]interface{}{}
+	err = dec.Decode(&decoded)
+	if err != nil {
+		return err
+	}
+
+	version, err := recordVersion(decoded["r"])
+	if err != nil {
+		return &ValidationError{Errors: []string{err.Error()}}
+	}
+	s := ForVersion(version)
+	if s == nil {
+		return &ValidationError{Errors: []string{fmt.Sprintf("r: no schema for record version %d", version)}}
+	}
+
+	return s.Validate(decoded)
+}
+
+func recordVersion(v interface{}) (int, error) {
+	number, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("r: expected the record version, got %s", jsonType(v))
+	}
+	version, err := number.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("r: expected the record version, got %s", number)
+	}
+	return int(version), nil
+}
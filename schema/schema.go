@@ -0,0 +1,273 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxErrors is how many mismatches a ValidationError reports at most.
+const maxErrors = 10
+
+var validUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Schema is the subset of JSON Schema, draft 2020-12, that describes the
+// telemetry record: types, constants, date-time and uuid strings, objects and
+// arrays.
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type   Types       `json:"type,omitempty"`
+	Const  interface{} `json:"const,omitempty"`
+	Format string      `json:"format,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// Types is the JSON type, or types, a value may have. It is written as a
+// single string when there is only one.
+type Types []string
+
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = Types{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+func (t Types) Has(typ string) bool {
+	for _, have := range t {
+		if have == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Nullable returns a copy of s that also accepts null.
+func Nullable(s *Schema) *Schema {
+	out := *s
+	if len(out.Type) > 0 && !out.Type.Has("null") {
+		out.Type = append(append(Types{}, out.Type...), "null")
+	}
+	return &out
+}
+
+// FromType describes the JSON encoding of values of type t. Struct fields
+// are described but not required, so records from clients that predate a
+// field still match. Maps, slices and pointers may be null.
+func FromType(t reflect.Type) *Schema {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return &Schema{Type: Types{"string"}, Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return Nullable(FromType(t.Elem()))
+	case reflect.Bool:
+		return &Schema{Type: Types{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: Types{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: Types{"number"}}
+	case reflect.String:
+		return &Schema{Type: Types{"string"}}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: Types{"array", "null"}, Items: FromType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: Types{"object", "null"}, AdditionalProperties: FromType(t.Elem())}
+	case reflect.Struct:
+		out := &Schema{Type: Types{"object"}, Properties: map[string]*Schema{}}
+		addFields(out, t)
+		return out
+	}
+
+	// Interfaces and anything else may hold any value.
+	return &Schema{}
+}
+
+func addFields(out *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addFields(out, embedded)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		out.Properties[name] = FromType(field.Type)
+	}
+}
+
+// Lookup returns the schema of the value at path, following properties and
+// additionalProperties, or nil if s doesn't describe it.
+func (s *Schema) Lookup(path []string) *Schema {
+	cur := s
+	for _, part := range path {
+		switch {
+		case cur.Properties[part] != nil:
+			cur = cur.Properties[part]
+		case cur.AdditionalProperties != nil:
+			cur = cur.AdditionalProperties
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// ValidationError lists where a value doesn't match a schema.
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return "Record doesn't match the schema: " + strings.Join(e.Errors, "; ")
+}
+
+// Validate checks v, a value as decoded by encoding/json, against s. It
+// returns a *ValidationError listing the first mismatches if there are any.
+func (s *Schema) Validate(v interface{}) error {
+	errs := []string{}
+	s.validate("", v, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) > maxErrors {
+		errs = append(errs[:maxErrors], fmt.Sprintf("and %d more", len(errs)-maxErrors))
+	}
+	return &ValidationError{Errors: errs}
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]string) {
+	at := path
+	if at == "" {
+		at = "(root)"
+	}
+
+	typ := jsonType(v)
+	if len(s.Type) > 0 && !s.Type.Has(typ) && !(typ == "integer" && s.Type.Has("number")) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", at, strings.Join(s.Type, " or "), typ))
+		return
+	}
+
+	if s.Const != nil && !sameJSON(s.Const, v) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %v", at, s.Const))
+		return
+	}
+
+	switch value := v.(type) {
+	case string:
+		switch s.Format {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				*errs = append(*errs, fmt.Sprintf("%s: expected an RFC 3339 date-time", at))
+			}
+		case "uuid":
+			if !validUUID.MatchString(value) {
+				*errs = append(*errs, fmt.Sprintf("%s: expected a UUID", at))
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := value[key]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: missing %s", at, key))
+			}
+		}
+
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			child := s.Properties[key]
+			if child == nil {
+				child = s.AdditionalProperties
+			}
+			if child == nil {
+				continue
+			}
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			child.validate(childPath, value[key], errs)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
@@ -0,0 +1,119 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rancher/telemetry/collector"
+	"github.com/rancher/telemetry/record"
+	"github.com/rancher/telemetry/schema"
+)
+
+var update = flag.Bool("update", false, "rewrite the published schemas from the collector structs")
+
+// currentSchema is the schema of the current record version, generated from
+// the collector structs.
+func currentSchema() *schema.Schema {
+	sections := []schema.Section{}
+	for _, c := range []collector.Collector{
+		collector.App{},
+		collector.Cluster{},
+		collector.ClusterTemplate{},
+		collector.Installation{},
+		collector.MultiClusterApp{},
+		collector.Node{},
+		collector.Project{},
+	} {
+		sections = append(sections, schema.Section{Key: c.RecordKey(), Value: c})
+	}
+	return schema.NewRecordSchema(2, schema.Section{Key: collector.MetaRecordKey, Value: collector.Meta{}}, sections...)
+}
+
+func TestSchemaMatchesCollectors(t *testing.T) {
+	data, err := currentSchema().Marshal()
+	assert.Nil(t, err)
+
+	if *update {
+		assert.Nil(t, os.WriteFile("record.v2.json", data, 0644))
+		return
+	}
+
+	assert.Equal(t, string(data), string(schema.Published(2)), "record.v2.json is out of date, run go test ./schema -update")
+	assert.Equal(t, []int{2}, schema.Versions())
+}
+
+func TestSchemaValidRecord(t *testing.T) {
+	r := record.Record{
+		"r":   2,
+		"ts":  "2021-08-03T03:04:30Z",
+		"rid": "0c6a1f0e-7d0e-4c55-a2a4-9b9f9d0d4f11",
+		"seq": 7,
+		"install": collector.Installation{
+			Uid:   "f4b2c1a0-8a4c-4f3e-9f9e-6a1d2c3b4a5f",
+			Users: collector.LabelCount{"github": 3},
+		},
+		"cluster": collector.Cluster{
+			Ns: &collector.NsInfo{NsTotal: 4},
+		},
+		"project": nil,
+		"meta": collector.Meta{
+			Collectors: map[string]*collector.CollectorMeta{"install": {Ok: 1}},
+			Enabled:    []string{"install"},
+		},
+		"someplugin": map[string]interface{}{"anything": "goes"},
+	}
+	assert.Nil(t, schema.ValidateRecord(r))
+
+	// Only the uid of the install section is required.
+	r["install"] = map[string]interface{}{"uid": "f4b2c1a0-8a4c-4f3e-9f9e-6a1d2c3b4a5f"}
+	assert.Nil(t, schema.ValidateRecord(r))
+}
+
+func TestSchemaInvalidRecord(t *testing.T) {
+	var r record.Record
+	err := json.Unmarshal([]byte(`{
+		"r": 2,
+		"ts": "yesterday",
+		"rid": "not-a-uuid",
+		"seq": "7",
+		"install": {"uid": 42, "users": {"github": "many"}},
+		"cluster": {"active": 1.5, "namespace": {"total": "4"}},
+		"node": []
+	}`), &r)
+	assert.Nil(t, err)
+
+	err = schema.ValidateRecord(r)
+	verr, ok := err.(*schema.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"cluster.active: expected integer, got number",
+		"cluster.namespace.total: expected integer, got string",
+		"install.uid: expected string, got integer",
+		"install.users.github: expected integer, got string",
+		"node: expected object or null, got array",
+		"rid: expected a UUID",
+		"seq: expected integer, got string",
+		"ts: expected an RFC 3339 date-time",
+	}, verr.Errors)
+
+	err = schema.ValidateRecord(record.Record{"r": 2, "ts": "2021-08-03T03:04:30Z"})
+	assert.Equal(t, "Record doesn't match the schema: (root): missing install", err.Error())
+
+	err = schema.ValidateRecord(record.Record{"r": 1})
+	assert.Equal(t, "Record doesn't match the schema: r: no schema for record version 1", err.Error())
+
+	err = schema.ValidateRecord(record.Record{"r": "2"})
+	assert.Equal(t, "Record doesn't match the schema: r: expected the record version, got string", err.Error())
+}
+
+func TestSchemaLookup(t *testing.T) {
+	s := schema.ForVersion(2)
+	assert.True(t, s.Lookup([]string{"cluster", "cpu", "cores_total"}).Type.Has("integer"))
+	assert.True(t, s.Lookup([]string{"install", "users", "github"}).Type.Has("integer"))
+	assert.True(t, s.Lookup([]string{"mca", "targetAvg"}).Type.Has("number"))
+	assert.Nil(t, s.Lookup([]string{"cluster", "nope"}))
+}